@@ -0,0 +1,156 @@
+package main
+
+// Anonymisation of user and IP label values, so that metrics can be stored somewhere they may be
+// seen by people who should not see usernames or client IPs. Values are replaced by a keyed hash
+// (HMAC-SHA256 with a secret key), so that the same user always has the same value, but the user
+// can only be identified by someone who knows the key (see the anonymise command).
+// IPs may alternatively be truncated to their subnet, e.g. 10.1.2.0/24.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/perforce/p4prometheus/config"
+)
+
+// Length of hashed values - 64 bits is plenty to avoid collisions between users
+const anonymiseHashLen = 16
+
+type anonymiser struct {
+	config *config.Config
+}
+
+func newAnonymiser(config *config.Config) *anonymiser {
+	return &anonymiser{config: config}
+}
+
+func (a *anonymiser) enabled() bool {
+	return a.config.AnonymiseUsers != "" || a.config.AnonymiseIPs != ""
+}
+
+func (a *anonymiser) hash(value string) string {
+	mac := hmac.New(sha256.New, []byte(a.config.AnonymiseKey))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:anonymiseHashLen]
+}
+
+// user - returns the anonymised value for a user
+func (a *anonymiser) user(user string) string {
+	if a.config.AnonymiseUsers != config.AnonymiseHash {
+		return user
+	}
+	return a.hash(user)
+}
+
+// ip - returns the anonymised value for an IP address
+func (a *anonymiser) ip(ip string) string {
+	switch a.config.AnonymiseIPs {
+	case config.AnonymiseHash:
+		return a.hash(ip)
+	case config.AnonymiseSubnet:
+		return a.subnet(ip)
+	}
+	return ip
+}
+
+// subnet - returns the network containing the IP, e.g. 10.1.2.0/24. Values which are not IPs
+// (e.g. "unknown") are returned unchanged.
+func (a *anonymiser) subnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		mask := net.CIDRMask(a.config.IPv4SubnetPrefix, 32)
+		return fmt.Sprintf("%s/%d", v4.Mask(mask), a.config.IPv4SubnetPrefix)
+	}
+	mask := net.CIDRMask(a.config.IPv6SubnetPrefix, 128)
+	return fmt.Sprintf("%s/%d", parsed.Mask(mask), a.config.IPv6SubnetPrefix)
+}
+
+// labels - returns a copy of the labels with any user/ip values anonymised
+func (a *anonymiser) labels(labels []labelPair) []labelPair {
+	result := make([]labelPair, len(labels))
+	for i, l := range labels {
+		switch l.name {
+		case "user":
+			l.value = a.user(l.value)
+		case "ip":
+			l.value = a.ip(l.value)
+		}
+		result[i] = l
+	}
+	return result
+}
+
+// apply - anonymises all series with user or ip labels. As several IPs may be in the same subnet,
+// values for series which become the same are added together.
+func (a *anonymiser) apply(metrics []byte) []byte {
+	if !a.enabled() {
+		return metrics
+	}
+	mf := newMetricFamilies()
+	mf.add(metrics)
+	for _, name := range mf.order {
+		f := mf.families[name]
+		samples := make([]string, 0, len(f.samples))
+		values := make(map[string]float64)
+		index := make(map[string]int)
+		for _, line := range f.samples {
+			series, v, err := parseSample(line)
+			if err != nil || !strings.Contains(series, "{") {
+				samples = append(samples, line)
+				continue
+			}
+			sname, labels, err := parseSeries(series)
+			if err != nil {
+				samples = append(samples, line)
+				continue
+			}
+			newSeries := formatSeries(sname, a.labels(labels))
+			if i, ok := index[newSeries]; ok {
+				values[newSeries] += v
+				samples[i] = formatSample(newSeries, values[newSeries])
+				continue
+			}
+			values[newSeries] = v
+			index[newSeries] = len(samples)
+			if newSeries == series {
+				samples = append(samples, line)
+			} else {
+				samples = append(samples, formatSample(newSeries, v))
+			}
+		}
+		f.samples = samples
+	}
+	return mf.bytes()
+}
+
+// runAnonymise - prints the anonymised value for each user (or IP), e.g. to find a user's
+// metrics when investigating an issue
+func runAnonymise(w io.Writer, cfg *config.Config, values []string, ips bool) error {
+	a := newAnonymiser(cfg)
+	if ips && cfg.AnonymiseIPs == "" {
+		return fmt.Errorf("anonymise_ips is not set in the config file")
+	}
+	if !ips && cfg.AnonymiseUsers == "" {
+		return fmt.Errorf("anonymise_users is not set in the config file")
+	}
+	for _, v := range values {
+		if ips {
+			fmt.Fprintf(w, "%s\t%s\n", v, a.ip(v))
+			continue
+		}
+		// As per the log parser
+		if !cfg.CaseSensitiveServer {
+			v = strings.ToLower(v)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", v, a.user(v))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymiseValues(t *testing.T) {
+	cfg := &config.Config{AnonymiseUsers: config.AnonymiseHash, AnonymiseIPs: config.AnonymiseSubnet,
+		AnonymiseKey: "secret", IPv4SubnetPrefix: 24, IPv6SubnetPrefix: 64}
+	a := newAnonymiser(cfg)
+	h := a.user("robert")
+	assert.Len(t, h, anonymiseHashLen)
+	assert.Equal(t, h, a.user("robert"))
+	assert.NotEqual(t, h, a.user("fred"))
+	cfg.AnonymiseKey = "other"
+	assert.NotEqual(t, h, a.user("robert"))
+
+	assert.Equal(t, "10.1.2.0/24", a.ip("10.1.2.3"))
+	assert.Equal(t, "2001:db8:1:2::/64", a.ip("2001:db8:1:2:3:4:5:6"))
+	assert.Equal(t, "unknown", a.ip("unknown"))
+	cfg.IPv4SubnetPrefix = 16
+	assert.Equal(t, "10.1.0.0/16", a.ip("10.1.2.3"))
+
+	cfg.AnonymiseIPs = config.AnonymiseHash
+	assert.Equal(t, a.hash("10.1.2.3"), a.ip("10.1.2.3"))
+	cfg.AnonymiseIPs = ""
+	cfg.AnonymiseUsers = ""
+	assert.Equal(t, "10.1.2.3", a.ip("10.1.2.3"))
+	assert.Equal(t, "robert", a.user("robert"))
+}
+
+func TestAnonymiseApply(t *testing.T) {
+	cfg := &config.Config{AnonymiseUsers: config.AnonymiseHash, AnonymiseIPs: config.AnonymiseSubnet,
+		AnonymiseKey: "secret", IPv4SubnetPrefix: 24, IPv6SubnetPrefix: 64}
+	a := newAnonymiser(cfg)
+	input := `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 3
+# HELP p4_cmd_user_counter A count of completed p4 cmds (by user)
+# TYPE p4_cmd_user_counter counter
+p4_cmd_user_counter{serverid="myserverid",user="robert"} 2
+p4_cmd_user_counter{serverid="myserverid",user="fred"} 1
+# HELP p4_cmd_ip_counter A count of completed p4 cmds (by IP)
+# TYPE p4_cmd_ip_counter counter
+p4_cmd_ip_counter{serverid="myserverid",ip="10.1.2.3"} 2
+p4_cmd_ip_counter{serverid="myserverid",ip="10.1.3.1"} 4
+p4_cmd_ip_counter{serverid="myserverid",ip="10.1.2.4"} 1
+`
+	expected := `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 3
+# HELP p4_cmd_user_counter A count of completed p4 cmds (by user)
+# TYPE p4_cmd_user_counter counter
+p4_cmd_user_counter{serverid="myserverid",user="` + a.user("robert") + `"} 2
+p4_cmd_user_counter{serverid="myserverid",user="` + a.user("fred") + `"} 1
+# HELP p4_cmd_ip_counter A count of completed p4 cmds (by IP)
+# TYPE p4_cmd_ip_counter counter
+p4_cmd_ip_counter{serverid="myserverid",ip="10.1.2.0/24"} 3
+p4_cmd_ip_counter{serverid="myserverid",ip="10.1.3.0/24"} 4
+`
+	assert.Equal(t, expected, string(a.apply([]byte(input))))
+
+	a = newAnonymiser(&config.Config{})
+	assert.Equal(t, input, string(a.apply([]byte(input))))
+}
+
+func TestRunAnonymise(t *testing.T) {
+	cfg := &config.Config{AnonymiseUsers: config.AnonymiseHash, AnonymiseKey: "secret", CaseSensitiveServer: true}
+	a := newAnonymiser(cfg)
+	var out strings.Builder
+	assert.NoError(t, runAnonymise(&out, cfg, []string{"Robert"}, false))
+	assert.Equal(t, "Robert\t"+a.user("Robert")+"\n", out.String())
+
+	// Users are lowercased by the log parser for case insensitive servers
+	out.Reset()
+	cfg.CaseSensitiveServer = false
+	assert.NoError(t, runAnonymise(&out, cfg, []string{"Robert"}, false))
+	assert.Equal(t, "robert\t"+a.user("robert")+"\n", out.String())
+
+	assert.Error(t, runAnonymise(&out, cfg, []string{"10.1.2.3"}, true))
+	cfg.AnonymiseIPs = config.AnonymiseHash
+	out.Reset()
+	assert.NoError(t, runAnonymise(&out, cfg, []string{"10.1.2.3"}, true))
+	assert.Equal(t, "10.1.2.3\t"+a.hash("10.1.2.3")+"\n", out.String())
+}
+
+func TestHistoricalWriterAnonymise(t *testing.T) {
+	cfg := &config.Config{AnonymiseIPs: config.AnonymiseSubnet, IPv4SubnetPrefix: 24}
+	hw := newHistoricalWriter(logger, newAnonymiser(cfg))
+	hw.add(`p4_cmd_ip_counter;serverid=myserverid;ip=10.1.2.3 1 1441207389
+p4_cmd_ip_counter;serverid=myserverid;ip=10.1.2.4 2 1441207389
+`)
+	hw.add(`p4_cmd_ip_counter;serverid=myserverid;ip=10.1.2.3 2 1441207404
+p4_cmd_ip_counter;serverid=myserverid;ip=10.1.2.4 2 1441207404
+`)
+	var om strings.Builder
+	assert.NoError(t, hw.write(&om, formatOpenMetrics))
+	assert.Equal(t, `p4_cmd_ip_counter{serverid="myserverid",ip="10.1.2.0/24"} 3 1441207389
+p4_cmd_ip_counter{serverid="myserverid",ip="10.1.2.0/24"} 4 1441207404
+# EOF
+`, om.String())
+}
@@ -0,0 +1,234 @@
+package main
+
+// Filtering of commands by user, cmd, program and IP before the log lines reach the parser, so that
+// e.g. service accounts and replication (rmt-*) commands don't dominate p4_cmd_counter and
+// p4_cmd_user_counter. The log blocks of excluded commands are dropped, and the commands counted in
+// p4_cmd_excluded_counter/p4_cmd_excluded_cumulative_seconds so that totals can still be calculated.
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+)
+
+// As for the parser, the first line of a block is followed by the command, e.g.
+//
+//	Perforce server info:
+//		2023/01/02 15:04:05 pid 1616 swarm@ws 10.0.0.1 [Swarm/2023.1] 'user-fstat -T depotFile //...'
+var (
+	reFilterCmd       = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] '([\w-]+)(?: .*)?'`)
+	reFilterPid       = regexp.MustCompile(`^\t\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d pid (\d+) `)
+	reFilterCompleted = regexp.MustCompile(`^\t\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d pid (\d+) completed ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s`)
+)
+
+const filterTrackLapse = "--- lapse "
+
+// Excluded commands are forgotten once the log has moved on, so that only the commands still
+// running (or whose track output may still follow) are kept. Completed commands are kept long enough
+// for the track block which follows the completed line, and commands with no completed line (e.g. older
+// p4d versions, or those still running) for much longer.
+const (
+	filterPruneInterval = time.Minute
+	filterCompletedAge  = time.Minute
+	filterRunningAge    = 24 * time.Hour
+)
+
+func blockStart(line string) bool {
+	return line == "Perforce server info:" || line == "Perforce server error:"
+}
+
+// filtering - whether any commands are to be excluded
+func filtering(cfg *config.Config) bool {
+	return cfg.FilterUsers.Active() || cfg.FilterCmds.Active() || cfg.FilterPrograms.Active() || cfg.FilterIPs.Active()
+}
+
+// valueFilter - compiled include/exclude regexes, as validated by config
+type valueFilter struct {
+	include, exclude []*regexp.Regexp
+}
+
+func newValueFilter(f config.Filter) *valueFilter {
+	vf := &valueFilter{}
+	for _, re := range f.Include {
+		vf.include = append(vf.include, regexp.MustCompile(re))
+	}
+	for _, re := range f.Exclude {
+		vf.exclude = append(vf.exclude, regexp.MustCompile(re))
+	}
+	return vf
+}
+
+func (vf *valueFilter) excludes(value string) bool {
+	for _, re := range vf.exclude {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	if len(vf.include) == 0 {
+		return false
+	}
+	for _, re := range vf.include {
+		if re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludedCmd - a command whose blocks are being dropped. Kept after the command has completed,
+// as track output is logged after the completed line.
+type excludedCmd struct {
+	header    string    // Start time, pid, user etc and cmd, to recognise further blocks of the same command
+	lapse     float64   // Seconds from the completed or track output
+	completed bool      // Lapse already counted
+	seen      time.Time // Log time of latest block
+}
+
+// cmdFilter - drops the blocks of excluded commands from the log lines. Later blocks for the
+// same pid (e.g. track output, compute end and completed) are also dropped.
+type cmdFilter struct {
+	users, cmds, programs, ips *valueFilter
+	held                       string // Block start line, held until the command following it is seen
+	holding                    bool
+	dropping                   *excludedCmd            // Command of the current block if excluded
+	excluded                   map[string]*excludedCmd // By pid
+	logTime                    time.Time               // Of latest block
+	pruned                     time.Time
+	count                      int64
+	lapse                      float64
+}
+
+func newCmdFilter(cfg *config.Config) *cmdFilter {
+	f := &cmdFilter{excluded: make(map[string]*excludedCmd)}
+	f.configure(cfg)
+	return f
+}
+
+// configure - applies the filters, e.g. on reload. Commands already excluded continue to be dropped.
+func (f *cmdFilter) configure(cfg *config.Config) {
+	f.users = newValueFilter(cfg.FilterUsers)
+	f.cmds = newValueFilter(cfg.FilterCmds)
+	f.programs = newValueFilter(cfg.FilterPrograms)
+	f.ips = newValueFilter(cfg.FilterIPs)
+}
+
+// finish - forgets an excluded command when its pid is reused or it has aged out, counting its lapse
+// from the track output if no completed line was seen (e.g. older p4d versions)
+func (f *cmdFilter) finish(pid string) {
+	if e, ok := f.excluded[pid]; ok {
+		if !e.completed {
+			f.lapse += e.lapse
+		}
+		delete(f.excluded, pid)
+	}
+}
+
+// prune - forgets the excluded commands no longer expected in the log
+func (f *cmdFilter) prune() {
+	if f.logTime.Sub(f.pruned) < filterPruneInterval {
+		return
+	}
+	f.pruned = f.logTime
+	for pid, e := range f.excluded {
+		age := f.logTime.Sub(e.seen)
+		if (e.completed && age > filterCompletedAge) || age > filterRunningAge {
+			f.finish(pid)
+		}
+	}
+}
+
+// excludeBlock - whether the block starting with the line (following the block start) is to be dropped
+func (f *cmdFilter) excludeBlock(line string) *excludedCmd {
+	if len(line) > len(p4timeformat) {
+		if t, err := time.Parse(p4timeformat, line[1:len(p4timeformat)+1]); err == nil {
+			f.logTime = t
+			f.prune()
+		}
+	}
+	e := f.matchBlock(line)
+	if e != nil {
+		e.seen = f.logTime
+	}
+	return e
+}
+
+// matchBlock - the excluded command the block is for, if any
+func (f *cmdFilter) matchBlock(line string) *excludedCmd {
+	if m := reFilterCmd.FindStringSubmatch(line); len(m) > 0 {
+		pid := m[2]
+		if e, ok := f.excluded[pid]; ok && e.header == m[0] {
+			return e
+		}
+		f.finish(pid)
+		if f.users.excludes(m[3]) || f.ips.excludes(m[5]) || f.programs.excludes(m[6]) || f.cmds.excludes(m[7]) {
+			f.excluded[pid] = &excludedCmd{header: m[0]}
+			f.count++
+			return f.excluded[pid]
+		}
+		return nil
+	}
+	if m := reFilterCompleted.FindStringSubmatch(line); len(m) > 0 {
+		e, ok := f.excluded[m[1]]
+		if !ok {
+			return nil
+		}
+		if !e.completed {
+			e.lapse, _ = strconv.ParseFloat(m[2], 64)
+			e.completed = true
+			f.lapse += e.lapse
+		}
+		return e
+	}
+	if m := reFilterPid.FindStringSubmatch(line); len(m) > 0 {
+		return f.excluded[m[1]]
+	}
+	return nil
+}
+
+// filter - sends the line to the parser unless it is part of a block of an excluded command
+func (f *cmdFilter) filter(line string, send func(line string)) {
+	if f.holding {
+		f.holding = false
+		f.dropping = f.excludeBlock(line)
+		if f.dropping == nil {
+			send(f.held)
+		}
+	}
+	if blockStart(line) {
+		f.held = line
+		f.holding = true
+		return
+	}
+	if f.dropping == nil {
+		send(line)
+		return
+	}
+	if f.dropping.completed || !strings.HasPrefix(line, filterTrackLapse) {
+		return
+	}
+	lapse, err := strconv.ParseFloat(strings.TrimSuffix(line[len(filterTrackLapse):], "s"), 64)
+	if err == nil && lapse > f.dropping.lapse {
+		f.dropping.lapse = lapse
+	}
+}
+
+// reset - clears the counts, e.g. when the log parser is restarted and the values last output
+// are used as a baseline
+func (f *cmdFilter) reset() {
+	f.count = 0
+	f.lapse = 0
+}
+
+// output - the count and lapse of the commands excluded, with the self metrics labels
+func (f *cmdFilter) output(fixed []labelPair) []byte {
+	buf := new(bytes.Buffer)
+	printMetric(buf, "p4_cmd_excluded_counter", "A count of commands excluded by the filters",
+		"counter", fixed, strconv.FormatInt(f.count, 10))
+	printMetric(buf, "p4_cmd_excluded_cumulative_seconds", "The total lapse of completed commands excluded by the filters",
+		"counter", fixed, strconv.FormatFloat(f.lapse, 'f', 3, 64))
+	return buf.Bytes()
+}
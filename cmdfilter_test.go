@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const filterTestLog = `Perforce server info:
+	2017/02/15 13:46:42 pid 81805 swarm@swarm-ws 10.62.185.98 [Swarm/2016.2] 'user-fstat -T depotFile //...'
+Perforce server info:
+	2017/02/15 13:46:42 pid 81806 bruno@bruno-ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1468155] 'user-sync //...'
+Perforce server info:
+	2017/02/15 13:46:42 pid 81805 compute end .001s 1+1us 0+0io 0+0net 0k 0pf
+Perforce server info:
+	2017/02/15 13:46:44 pid 81805 completed 2.5s 8+1us 0+1408io 0+0net 4088k 0pf
+Perforce server info:
+	2017/02/15 13:46:42 pid 81805 swarm@swarm-ws 10.62.185.98 [Swarm/2016.2] 'user-fstat -T depotFile //...'
+--- lapse 2.5s
+--- db.rev
+---   locks read/write 1/0 rows get+pos+scan put+del 0+1+1 0+0
+
+Perforce server info:
+	2017/02/15 13:46:43 pid 81806 completed 1.2s 8+1us 0+1408io 0+0net 4088k 0pf
+Perforce server info:
+	2017/02/15 13:46:45 pid 81807 svc_replica@replica-ws 10.62.185.100 [p4d/2016.2/LINUX26X86_64/1468155] 'rmt-Journal'
+--- lapse 0.5s
+Perforce server info:
+	2017/02/15 13:46:46 pid 81805 bruno@bruno-ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1468155] 'user-changes -m1'
+`
+
+func filterLines(f *cmdFilter, log string) []string {
+	linesChan := make(chan string, 100)
+	for _, line := range strings.Split(log, "\n") {
+		f.filter(line, sendTo(linesChan))
+	}
+	close(linesChan)
+	return getResult(linesChan)
+}
+
+func TestCmdFilter(t *testing.T) {
+	f := newCmdFilter(&config.Config{
+		FilterUsers: config.Filter{Exclude: []string{"^swarm$"}},
+		FilterCmds:  config.Filter{Exclude: []string{"^rmt-"}},
+	})
+	assert.Equal(t, []string{
+		"Perforce server info:",
+		"\t2017/02/15 13:46:42 pid 81806 bruno@bruno-ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1468155] 'user-sync //...'",
+		"Perforce server info:",
+		"\t2017/02/15 13:46:43 pid 81806 completed 1.2s 8+1us 0+1408io 0+0net 4088k 0pf",
+		"Perforce server info:",
+		"\t2017/02/15 13:46:46 pid 81805 bruno@bruno-ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1468155] 'user-changes -m1'",
+		"",
+	}, filterLines(f, filterTestLog))
+	// The track output after completion isn't counted again, and the lapse of the rmt-Journal
+	// (never completed) is counted from its track output when its pid is reused
+	f.filter("Perforce server info:", sendTo(make(chan string, 1)))
+	f.filter("\t2017/02/15 13:46:47 pid 81807 bruno@bruno-ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1468155] 'user-info'", sendTo(make(chan string, 2)))
+	assert.Equal(t, `# HELP p4_cmd_excluded_counter A count of commands excluded by the filters
+# TYPE p4_cmd_excluded_counter counter
+p4_cmd_excluded_counter{serverid="myserverid"} 2
+# HELP p4_cmd_excluded_cumulative_seconds The total lapse of completed commands excluded by the filters
+# TYPE p4_cmd_excluded_cumulative_seconds counter
+p4_cmd_excluded_cumulative_seconds{serverid="myserverid"} 3.000
+`, string(f.output([]labelPair{{"serverid", "myserverid"}})))
+	f.reset()
+	assert.Contains(t, string(f.output(nil)), "p4_cmd_excluded_counter{} 0\n")
+
+	// Include only p4 command line clients and IPs from a subnet
+	f = newCmdFilter(&config.Config{
+		FilterPrograms: config.Filter{Include: []string{"^p4/"}},
+		FilterIPs:      config.Filter{Include: []string{`^10\.62\.185\.9`}},
+	})
+	lines := filterLines(f, filterTestLog)
+	assert.Equal(t, 7, len(lines))
+	assert.NotContains(t, strings.Join(lines, "\n"), "swarm")
+	assert.NotContains(t, strings.Join(lines, "\n"), "rmt-Journal")
+	assert.Equal(t, int64(2), f.count)
+}
+
+func TestCmdFilterPrune(t *testing.T) {
+	f := newCmdFilter(&config.Config{FilterUsers: config.Filter{Exclude: []string{"^swarm$"}}})
+	start := time.Date(2017, 2, 15, 13, 46, 42, 0, time.UTC)
+	block := func(at time.Duration, text string) string {
+		return "Perforce server info:\n\t" + start.Add(at).Format(p4timeformat) + " " + text + "\n"
+	}
+	var log strings.Builder
+	for pid := 1; pid <= 1000; pid++ {
+		at := time.Duration(pid) * time.Second
+		log.WriteString(block(at, fmt.Sprintf("pid %d swarm@ws 10.0.0.1 [Swarm/2016.2] 'user-fstat'", pid)))
+		log.WriteString(block(at, fmt.Sprintf("pid %d completed 1s", pid)))
+	}
+	log.WriteString(block(1001*time.Second, "pid 2000 swarm@ws 10.0.0.1 [Swarm/2016.2] 'user-sync'"))
+	log.WriteString("--- lapse 4s\n")
+	log.WriteString(block(1010*time.Second, "pid 2001 bruno@ws 10.0.0.2 [p4/2016.2] 'user-info'"))
+	assert.Equal(t, 3, len(filterLines(f, log.String())))
+	// Only those completed within the last minute, and the command still running
+	assert.Equal(t, int64(1001), f.count)
+	assert.Equal(t, 1000.0, f.lapse)
+	assert.Less(t, len(f.excluded), 200)
+	assert.Contains(t, f.excluded, "2000")
+
+	// Commands never completed are eventually forgotten, counting the lapse from their track output
+	filterLines(f, block(26*time.Hour, "pid 2002 bruno@ws 10.0.0.2 [p4/2016.2] 'user-info'"))
+	assert.Empty(t, f.excluded)
+	assert.Equal(t, 1004.0, f.lapse)
+}
+
+func TestRunLogTailerCmdFilter(t *testing.T) {
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	cfg := &config.Config{
+		LogPath:           logPath,
+		MetricsOutput:     dir + "/cmds.prom",
+		ServerID:          "myserverid",
+		UpdateInterval:    time.Hour, // So metrics are only written on shutdown
+		StateSaveInterval: time.Hour,
+		ShutdownTimeout:   5 * time.Second,
+		OutputCmdsByUser:  true,
+		FilterUsers:       config.Filter{Exclude: []string{"^swarm$"}},
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, nil, false)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(filterTestLog + "\n")
+	f.Close()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4_cmd_user_counter{serverid="myserverid",user="bruno"}`)
+	assert.NotContains(t, string(buf), `user="swarm"`)
+	assert.NotContains(t, string(buf), `cmd="user-fstat"`)
+	assert.Contains(t, string(buf), `p4_cmd_excluded_counter{serverid="myserverid"} 1`)
+	assert.Contains(t, string(buf), `p4_cmd_excluded_cumulative_seconds{serverid="myserverid"} 2.500`)
+}
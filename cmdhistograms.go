@@ -0,0 +1,134 @@
+package main
+
+// Histograms of command duration, lapse and lock wait time by cmd, from the commands parsed from the log.
+// These give latency percentiles, e.g. p95 sync time, where p4_cmd_cumulative_seconds only gives averages.
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+
+	"github.com/perforce/p4prometheus/config"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// histogram - cumulative bucket counts as output in the Prometheus text format
+type histogram struct {
+	buckets []float64 // Upper bounds, excluding +Inf
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write - the _bucket, _sum and _count samples, with the le label after the others
+func (h *histogram) write(buf *bytes.Buffer, name string, labels []labelPair) {
+	bucketLabels := func(le string) []labelPair {
+		return append(append([]labelPair{}, labels...), labelPair{"le", le})
+	}
+	for i, le := range h.buckets {
+		printSample(buf, name+"_bucket", bucketLabels(strconv.FormatFloat(le, 'f', -1, 64)), strconv.FormatUint(h.counts[i], 10))
+	}
+	printSample(buf, name+"_bucket", bucketLabels("+Inf"), strconv.FormatUint(h.count, 10))
+	printSample(buf, name+"_sum", labels, strconv.FormatFloat(h.sum, 'f', 3, 64))
+	printSample(buf, name+"_count", labels, strconv.FormatUint(h.count, 10))
+}
+
+// equalBuckets - whether histograms with the bucket upper bounds are compatible
+func equalBuckets(b1, b2 []float64) bool {
+	if len(b1) != len(b2) {
+		return false
+	}
+	for i := range b1 {
+		if b1[i] != b2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cmdHistograms - histograms by cmd of:
+//   - duration: end time - start time from the log entries
+//   - lapse: completed lapse as reported by p4d
+//   - lock wait: total read and write lock wait across all tables, for commands with track info
+type cmdHistograms struct {
+	buckets, lockWaitBuckets []float64
+	duration, lapse          map[string]*histogram
+	lockWait                 map[string]*histogram
+}
+
+func newCmdHistograms(cfg *config.Config) *cmdHistograms {
+	return &cmdHistograms{
+		buckets:         cfg.CmdHistogramBuckets,
+		lockWaitBuckets: cfg.CmdLockWaitBuckets,
+		duration:        make(map[string]*histogram),
+		lapse:           make(map[string]*histogram),
+		lockWait:        make(map[string]*histogram),
+	}
+}
+
+func (h *cmdHistograms) get(m map[string]*histogram, cmd string, buckets []float64) *histogram {
+	if _, ok := m[cmd]; !ok {
+		m[cmd] = newHistogram(buckets)
+	}
+	return m[cmd]
+}
+
+// add - observes a command from the parser
+func (h *cmdHistograms) add(cmd p4dlog.Command) {
+	if !cmd.StartTime.IsZero() && !cmd.EndTime.IsZero() {
+		d := cmd.EndTime.Sub(cmd.StartTime).Seconds()
+		if d < 0 {
+			d = 0
+		}
+		h.get(h.duration, cmd.Cmd, h.buckets).observe(d)
+	}
+	h.get(h.lapse, cmd.Cmd, h.buckets).observe(float64(cmd.CompletedLapse))
+	if len(cmd.Tables) > 0 {
+		var wait int64 // milliseconds
+		for _, t := range cmd.Tables {
+			wait += t.TotalReadWait + t.TotalWriteWait
+		}
+		h.get(h.lockWait, cmd.Cmd, h.lockWaitBuckets).observe(float64(wait) / 1000)
+	}
+}
+
+// output - the histograms with the self metrics labels, sorted by cmd
+func (h *cmdHistograms) output(fixed []labelPair) []byte {
+	buf := new(bytes.Buffer)
+	for _, f := range []struct {
+		name, help string
+		values     map[string]*histogram
+	}{
+		{"p4_cmd_duration_seconds", "Time between start and end of command by cmd", h.duration},
+		{"p4_cmd_lapse_seconds", "Completed lapse time of command by cmd", h.lapse},
+		{"p4_cmd_lock_wait_seconds", "Total time command waited for table locks by cmd", h.lockWait},
+	} {
+		if len(f.values) == 0 {
+			continue
+		}
+		cmds := make([]string, 0, len(f.values))
+		for cmd := range f.values {
+			cmds = append(cmds, cmd)
+		}
+		sort.Strings(cmds)
+		printHeader(buf, f.name, f.help, "histogram")
+		for _, cmd := range cmds {
+			f.values[cmd].write(buf, f.name, append(append([]labelPair{}, fixed...), labelPair{"cmd", cmd}))
+		}
+	}
+	return buf.Bytes()
+}
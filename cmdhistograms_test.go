@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCmdHistograms(t *testing.T) {
+	h := newCmdHistograms(&config.Config{CmdHistogramBuckets: []float64{0.1, 1, 10}, CmdLockWaitBuckets: []float64{0.5}})
+	start := time.Unix(1643245000, 0)
+	h.add(p4dlog.Command{Cmd: "user-sync", StartTime: start, EndTime: start.Add(2 * time.Second), CompletedLapse: 2.5,
+		Tables: map[string]*p4dlog.Table{
+			"db.rev":  {TableName: "rev", TotalReadWait: 200},
+			"db.have": {TableName: "have", TotalReadWait: 100, TotalWriteWait: 500},
+		}})
+	h.add(p4dlog.Command{Cmd: "user-sync", StartTime: start, EndTime: start, CompletedLapse: 0.05})
+	h.add(p4dlog.Command{Cmd: "user-info", CompletedLapse: 0.01})
+
+	assert.Equal(t, `# HELP p4_cmd_duration_seconds Time between start and end of command by cmd
+# TYPE p4_cmd_duration_seconds histogram
+p4_cmd_duration_seconds_bucket{serverid="myserverid",cmd="user-sync",le="0.1"} 1
+p4_cmd_duration_seconds_bucket{serverid="myserverid",cmd="user-sync",le="1"} 1
+p4_cmd_duration_seconds_bucket{serverid="myserverid",cmd="user-sync",le="10"} 2
+p4_cmd_duration_seconds_bucket{serverid="myserverid",cmd="user-sync",le="+Inf"} 2
+p4_cmd_duration_seconds_sum{serverid="myserverid",cmd="user-sync"} 2.000
+p4_cmd_duration_seconds_count{serverid="myserverid",cmd="user-sync"} 2
+# HELP p4_cmd_lapse_seconds Completed lapse time of command by cmd
+# TYPE p4_cmd_lapse_seconds histogram
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-info",le="0.1"} 1
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-info",le="1"} 1
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-info",le="10"} 1
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-info",le="+Inf"} 1
+p4_cmd_lapse_seconds_sum{serverid="myserverid",cmd="user-info"} 0.010
+p4_cmd_lapse_seconds_count{serverid="myserverid",cmd="user-info"} 1
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-sync",le="0.1"} 1
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-sync",le="1"} 1
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-sync",le="10"} 2
+p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-sync",le="+Inf"} 2
+p4_cmd_lapse_seconds_sum{serverid="myserverid",cmd="user-sync"} 2.550
+p4_cmd_lapse_seconds_count{serverid="myserverid",cmd="user-sync"} 2
+# HELP p4_cmd_lock_wait_seconds Total time command waited for table locks by cmd
+# TYPE p4_cmd_lock_wait_seconds histogram
+p4_cmd_lock_wait_seconds_bucket{serverid="myserverid",cmd="user-sync",le="0.5"} 0
+p4_cmd_lock_wait_seconds_bucket{serverid="myserverid",cmd="user-sync",le="+Inf"} 1
+p4_cmd_lock_wait_seconds_sum{serverid="myserverid",cmd="user-sync"} 0.800
+p4_cmd_lock_wait_seconds_count{serverid="myserverid",cmd="user-sync"} 1
+`, string(h.output([]labelPair{{"serverid", "myserverid"}, {"sdpinst", ""}})))
+
+	assert.Equal(t, "", string(newCmdHistograms(&config.Config{}).output(nil)))
+}
+
+func TestRunLogTailerCmdHistograms(t *testing.T) {
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	cfg := &config.Config{
+		LogPath:             logPath,
+		MetricsOutput:       dir + "/cmds.prom",
+		ServerID:            "myserverid",
+		UpdateInterval:      time.Hour, // So metrics are only written on shutdown
+		StateSaveInterval:   time.Hour,
+		ShutdownTimeout:     5 * time.Second,
+		CmdHistogramBuckets: config.DefaultCmdHistogramBuckets,
+		CmdLockWaitBuckets:  config.DefaultCmdLockWaitBuckets,
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	reloadChan := make(chan *config.Config, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, reloadChan, false)
+	}()
+	// Enabled on reload, restarting the parser
+	newCfg := *cfg
+	newCfg.CmdHistograms = true
+	reloadChan <- &newCfg
+	time.Sleep(200 * time.Millisecond)
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`)
+	f.Close()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4_cmd_lapse_seconds_bucket{serverid="myserverid",cmd="user-sync",le="0.05"} 1`)
+	assert.Contains(t, string(buf), `p4_cmd_lapse_seconds_count{serverid="myserverid",cmd="user-sync"} 1`)
+}
+
+func TestRunLogTailerCmdHistogramsCatchUp(t *testing.T) {
+	// More commands than the parser's channels hold, re-read on startup before lines are tailed.
+	// Takes several seconds as the lines are sent at parser_max_blocks_per_second.
+	const numCmds = 60000
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	var log strings.Builder
+	start := time.Date(2015, 9, 2, 15, 23, 9, 0, time.UTC)
+	for pid := 1; pid <= numCmds; pid++ {
+		ts := start.Add(time.Duration(pid) * time.Second).Format(p4timeformat)
+		fmt.Fprintf(&log, `Perforce server info:
+	%s pid %d robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	%s pid %d completed .031s
+`, ts, pid, ts, pid)
+	}
+	assert.NoError(t, os.WriteFile(logPath, []byte(log.String()), 0644))
+	stateFile := dir + "/state.json"
+	// Saved for a previous log, so all of the current log is processed
+	assert.NoError(t, (&savedState{LogPath: logPath, Inode: 0, SavedAt: time.Now()}).save(stateFile))
+	cfg := &config.Config{
+		LogPath:               logPath,
+		MetricsOutput:         dir + "/cmds.prom",
+		ServerID:              "myserverid",
+		UpdateInterval:        time.Hour, // So metrics are only written on shutdown
+		StateFile:             stateFile,
+		StateSaveInterval:     time.Hour,
+		ShutdownTimeout:       30 * time.Second,
+		CmdHistograms:         true,
+		ParserMaxBlocksPerSec: config.DefaultParserMaxBlocksPerSec,
+		CmdHistogramBuckets:   config.DefaultCmdHistogramBuckets,
+		CmdLockWaitBuckets:    config.DefaultCmdLockWaitBuckets,
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, nil, false)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(60 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), fmt.Sprintf(`p4_cmd_counter{serverid="myserverid",cmd="user-sync"} %d`, numCmds))
+	assert.Contains(t, string(buf), fmt.Sprintf(`p4_cmd_lapse_seconds_count{serverid="myserverid",cmd="user-sync"} %d`, numCmds))
+	assert.Regexp(t, `p4prom_parser_paced_seconds\{serverid="myserverid"\} [1-9][0-9]*\.`, string(buf))
+}
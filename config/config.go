@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
@@ -11,19 +13,176 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
+// Instance - settings for one of several p4d logs processed by a single p4prometheus
+type Instance struct {
+	LogPath       string `yaml:"log_path"`
+	MetricsOutput string `yaml:"metrics_output"`
+	ServerID      string `yaml:"server_id"`
+	SDPInstance   string `yaml:"sdp_instance"`
+	StateFile     string `yaml:"state_file"`
+	ErrorsLogPath string `yaml:"errors_log_path"`
+	SlowCmdLog    string `yaml:"slow_cmd_log"`
+}
+
+// Supported output types
+const (
+	OutputTextfile    = "textfile"
+	OutputPushgateway = "pushgateway"
+	OutputRemoteWrite = "remote_write"
+	OutputInfluxDB    = "influxdb"
+)
+
+// Output - a destination for metrics in addition to metrics_output. Several may be combined.
+type Output struct {
+	Type     string        `yaml:"type"`     // One of the Output* values
+	Name     string        `yaml:"name"`     // Used in logs and self metrics - defaults to type, or path for textfile
+	Path     string        `yaml:"path"`     // textfile
+	URL      string        `yaml:"url"`      // Other types
+	Job      string        `yaml:"job"`      // pushgateway - defaults to p4prometheus
+	Username string        `yaml:"username"` // For basic auth
+	Password string        `yaml:"password"`
+	Token    string        `yaml:"token"` // Bearer token (InfluxDB API token for influxdb)
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Collectors available to the monitor command - all are run by default
+var MonitorCollectors = []string{"uptime", "license", "filesys", "versions", "ssl", "change", "processes",
+	"commands", "checkpoint", "replication", "errors", "pull", "realtime", "locks"}
+
+// Filesystems with a filesys.<name>.min configurable, whose free space is checked by the filesys collector
+var MonitorFilesys = []string{"depot", "P4ROOT", "P4JOURNAL", "P4LOG", "TEMP"}
+
+// DefaultParserMaxBlocksPerSec - the log parser outputs the commands completed each second (of wall clock
+// time) together, and deadlocks if there are more than its channels hold (10000), e.g. when catching up on
+// a large part of the log. Limiting the blocks sent to it (at least one per command) prevents that.
+const DefaultParserMaxBlocksPerSec = 8000
+
+// DefaultMonitorTimeout - for each command run by the monitor command, unless its interval is shorter
+const DefaultMonitorTimeout = time.Minute
+
+// Monitor - settings for the monitor command, which runs p4 commands to collect metrics not
+// available from the log, writing a file per collector for node_exporter's textfile collector.
+// P4PORT etc default to the SDP environment if sdp_instance is set, or the environment otherwise.
+type Monitor struct {
+	P4Port     string        `yaml:"p4port"`
+	P4User     string        `yaml:"p4user"`
+	P4Tickets  string        `yaml:"p4tickets"`
+	P4Bin      string        `yaml:"p4bin"`
+	P4DBin     string        `yaml:"p4dbin"`
+	MetricsDir string        `yaml:"metrics_dir"`
+	Interval   time.Duration `yaml:"interval"`   // 0 to run once, e.g. from cron
+	Timeout    time.Duration `yaml:"timeout"`    // For each command run, e.g. p4 or lslocks - see CmdTimeout
+	Collectors []string      `yaml:"collectors"` // Defaults to all of MonitorCollectors
+	SSLPorts   []string      `yaml:"ssl_ports"`  // P4PORT values to check certificates for - defaults to p4port if ssl
+	// How often to run p4 license -u, and the period of user counts used to forecast reaching the user limit
+	LicenseRefresh time.Duration `yaml:"license_refresh"`
+	LicenseHistory time.Duration `yaml:"license_history"`
+	// Paths to check free space of by filesystem (one of MonitorFilesys) - defaults to the SDP/p4d values
+	FilesysPaths map[string]string `yaml:"filesys_paths"`
+	TopCommands  int               `yaml:"top_commands"` // Number of longest running commands to output, 0 for none
+}
+
 // Config for p4prometheus
 type Config struct {
-	LogPath               string        `yaml:"log_path"`
-	MetricsOutput         string        `yaml:"metrics_output"`
-	ServerID              string        `yaml:"server_id"`
-	SDPInstance           string        `yaml:"sdp_instance"`
-	UpdateInterval        time.Duration `yaml:"update_interval"`
-	OutputCmdsByUser      bool          `yaml:"output_cmds_by_user"`
-	OutputCmdsByUserRegex string        `yaml:"output_cmds_by_user_regex"`
-	OutputCmdsByIP        bool          `yaml:"output_cmds_by_ip"`
-	CaseSensitiveServer   bool          `yaml:"case_senstive_server"`
+	LogPath               string            `yaml:"log_path"`
+	MetricsOutput         string            `yaml:"metrics_output"`
+	ServerID              string            `yaml:"server_id"`
+	SDPInstance           string            `yaml:"sdp_instance"`
+	UpdateInterval        time.Duration     `yaml:"update_interval"`
+	OutputCmdsByUser      bool              `yaml:"output_cmds_by_user"`
+	OutputCmdsByUserRegex string            `yaml:"output_cmds_by_user_regex"`
+	OutputCmdsByIP        bool              `yaml:"output_cmds_by_ip"`
+	CaseSensitiveServer   bool              `yaml:"case_senstive_server"`
+	ListenAddress         string            `yaml:"listen_address"`
+	TLSCertFile           string            `yaml:"tls_cert_file"`
+	TLSKeyFile            string            `yaml:"tls_key_file"`
+	BasicAuthUsers        map[string]string `yaml:"basic_auth_users"`
+	Instances             []Instance        `yaml:"instances"`
+	StateFile             string            `yaml:"state_file"`
+	StateSaveInterval     time.Duration     `yaml:"state_save_interval"`
+	ShutdownTimeout       time.Duration     `yaml:"shutdown_timeout"`
+	ParserMaxBlocksPerSec int               `yaml:"parser_max_blocks_per_second"` // Limit on log blocks sent to the parser, 0 for none
+	Outputs               []Output          `yaml:"outputs"`
+	UserLabelLimit        int               `yaml:"user_label_limit"`
+	IPLabelLimit          int               `yaml:"ip_label_limit"`
+	LabelLimitRankBy      string            `yaml:"label_limit_rank_by"`
+	AnonymiseUsers        string            `yaml:"anonymise_users"`
+	AnonymiseIPs          string            `yaml:"anonymise_ips"`
+	AnonymiseKey          string            `yaml:"anonymise_key"`
+	IPv4SubnetPrefix      int               `yaml:"ipv4_subnet_prefix"`
+	IPv6SubnetPrefix      int               `yaml:"ipv6_subnet_prefix"`
+	Monitor               Monitor           `yaml:"monitor"`
+	ErrorsLogPath         string            `yaml:"errors_log_path"` // Structured error log (errors.csv) to tail for p4_error_count
+	CmdHistograms         bool              `yaml:"cmd_histograms"`  // Output histograms of command duration, lapse and lock wait by cmd
+	CmdHistogramBuckets   []float64         `yaml:"cmd_histogram_buckets"`
+	CmdLockWaitBuckets    []float64         `yaml:"cmd_lock_wait_buckets"` // Also used for table lock metrics
+	TableLockMetrics      bool              `yaml:"table_lock_metrics"`    // Output lock wait/held histograms by table
+	TableLockTopCmds      int               `yaml:"table_lock_top_cmds"`   // Commands holding locks longest per table, 0 for none
+	SlowCmdLog            string            `yaml:"slow_cmd_log"`          // JSON lines file of commands slower than their threshold
+	// Lapse above which commands are written to SlowCmdLog, by cmd (e.g. user-sync), or "default" for other cmds
+	SlowCmdThresholds map[string]time.Duration `yaml:"slow_cmd_thresholds"`
+	SlowCmdLogMaxSize int                      `yaml:"slow_cmd_log_max_size"` // MB before rotation
+	SlowCmdLogBackups int                      `yaml:"slow_cmd_log_backups"`  // Rotated files to keep
+	// Commands excluded from the metrics by user, cmd (e.g. rmt-Journal), program (e.g. p4/2023.1/...) and IP
+	FilterUsers    Filter `yaml:"filter_users"`
+	FilterCmds     Filter `yaml:"filter_cmds"`
+	FilterPrograms Filter `yaml:"filter_programs"`
+	FilterIPs      Filter `yaml:"filter_ips"`
+	// Metrics counting (or taking values from) log lines matching a regex
+	CustomMetrics []CustomMetric `yaml:"custom_metrics"`
+}
+
+// Supported CustomMetric types
+const (
+	MetricCounter = "counter"
+	MetricGauge   = "gauge"
+)
+
+// CustomValueGroup - the named group of a CustomMetric regex giving the value, rather than a label
+const CustomValueGroup = "value"
+
+// CustomMetric - a metric from log lines matching Regex. Named groups are output as labels, except
+// for CustomValueGroup which is the value (added for a counter, which otherwise counts the lines).
+type CustomMetric struct {
+	Name  string `yaml:"name"`
+	Help  string `yaml:"help"`
+	Type  string `yaml:"type"` // One of MetricCounter or MetricGauge
+	Regex string `yaml:"regex"`
+}
+
+// Filter - regexes (unanchored as for output_cmds_by_user_regex) for values to include or exclude.
+// A value is excluded if it matches any of Exclude, or if Include is set and it matches none of it.
+type Filter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Active - whether any values are excluded by the filter
+func (f Filter) Active() bool {
+	return len(f.Include) > 0 || len(f.Exclude) > 0
 }
 
+// SlowCmdDefault - key of SlowCmdThresholds applying to cmds not otherwise listed
+const SlowCmdDefault = "default"
+
+// Default upper bounds (seconds) of the buckets for CmdHistograms
+var (
+	DefaultCmdHistogramBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+	DefaultCmdLockWaitBuckets  = []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+)
+
+// Values for AnonymiseUsers/AnonymiseIPs
+const (
+	AnonymiseHash   = "hash"
+	AnonymiseSubnet = "subnet" // IPs only
+)
+
+// Values for LabelLimitRankBy
+const (
+	RankByCount   = "count"
+	RankBySeconds = "seconds"
+)
+
 // Unmarshal the config
 func Unmarshal(config []byte) (*Config, error) {
 	// Default values specified here
@@ -32,13 +191,62 @@ func Unmarshal(config []byte) (*Config, error) {
 		caseSensitive = false
 	}
 	cfg := &Config{
-		UpdateInterval:      15 * time.Second,
-		OutputCmdsByUser:    true,
-		CaseSensitiveServer: caseSensitive}
+		UpdateInterval:        15 * time.Second,
+		OutputCmdsByUser:      true,
+		CaseSensitiveServer:   caseSensitive,
+		StateSaveInterval:     time.Minute,
+		ShutdownTimeout:       10 * time.Second,
+		ParserMaxBlocksPerSec: DefaultParserMaxBlocksPerSec,
+		LabelLimitRankBy:      RankByCount,
+		IPv4SubnetPrefix:      24,
+		IPv6SubnetPrefix:      64,
+		Monitor: Monitor{
+			P4Bin:          "p4",
+			MetricsDir:     "/p4/metrics",
+			LicenseRefresh: time.Hour,
+			LicenseHistory: 30 * 24 * time.Hour,
+			TopCommands:    10,
+		},
+		SlowCmdLogMaxSize: 100,
+		SlowCmdLogBackups: 5,
+		TableLockTopCmds:  5,
+	}
 	err := yaml.Unmarshal(config, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid configuration: %v. make sure to use 'single quotes' around strings with special characters (like match patterns or label templates), and make sure to use '-' only for lists (metrics) but not for maps (labels)", err.Error())
 	}
+	for i := range cfg.Outputs {
+		o := &cfg.Outputs[i]
+		if o.Name == "" {
+			o.Name = o.Type
+			if o.Type == OutputTextfile {
+				o.Name = o.Path
+			}
+		}
+		if o.Job == "" {
+			o.Job = "p4prometheus"
+		}
+		if o.Timeout == 0 {
+			o.Timeout = 10 * time.Second
+		}
+	}
+	for i := range cfg.CustomMetrics {
+		if cfg.CustomMetrics[i].Help == "" {
+			cfg.CustomMetrics[i].Help = "Log lines matching a custom_metrics regex"
+		}
+	}
+	if len(cfg.Monitor.Collectors) == 0 {
+		cfg.Monitor.Collectors = MonitorCollectors
+	}
+	if len(cfg.CmdHistogramBuckets) == 0 {
+		cfg.CmdHistogramBuckets = DefaultCmdHistogramBuckets
+	}
+	if len(cfg.CmdLockWaitBuckets) == 0 {
+		cfg.CmdLockWaitBuckets = DefaultCmdLockWaitBuckets
+	}
+	if len(cfg.SlowCmdThresholds) == 0 {
+		cfg.SlowCmdThresholds = map[string]time.Duration{SlowCmdDefault: 30 * time.Second}
+	}
 	err = cfg.validate()
 	if err != nil {
 		return nil, err
@@ -65,21 +273,348 @@ func LoadConfigString(content []byte) (*Config, error) {
 	return cfg, err
 }
 
-func (c *Config) validate() error {
-	if c.LogPath == "" {
+// InstanceConfigs - returns a config per p4d log to be processed. If no instances are specified
+// this is just a copy of the top level config, otherwise a copy of it with the instance specific values set.
+func (c *Config) InstanceConfigs() []*Config {
+	if len(c.Instances) == 0 {
+		ic := *c
+		return []*Config{&ic}
+	}
+	result := make([]*Config, 0, len(c.Instances))
+	for _, inst := range c.Instances {
+		ic := *c
+		ic.Instances = nil
+		ic.LogPath = inst.LogPath
+		ic.MetricsOutput = inst.MetricsOutput
+		ic.ServerID = inst.ServerID
+		ic.SDPInstance = inst.SDPInstance
+		ic.StateFile = inst.StateFile
+		ic.ErrorsLogPath = inst.ErrorsLogPath
+		ic.SlowCmdLog = inst.SlowCmdLog
+		result = append(result, &ic)
+	}
+	return result
+}
+
+// Diff - returns a description of each value which differs between the configs, e.g. when reloading
+func (c *Config) Diff(other *Config) []string {
+	result := make([]string, 0)
+	v1 := reflect.ValueOf(*c)
+	v2 := reflect.ValueOf(*other)
+	t := v1.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f1 := v1.Field(i).Interface()
+		f2 := v2.Field(i).Interface()
+		if reflect.DeepEqual(f1, f2) {
+			continue
+		}
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		if name == "basic_auth_users" || name == "outputs" || name == "anonymise_key" {
+			// Don't log password hashes or credentials
+			result = append(result, fmt.Sprintf("%s: changed", name))
+			continue
+		}
+		result = append(result, fmt.Sprintf("%s: %v -> %v", name, f1, f2))
+	}
+	return result
+}
+
+func (c *Config) validateLog(logPath, metricsOutput string) error {
+	if logPath == "" {
 		return fmt.Errorf("Invalid log_path: please specify name of p4d server log")
 	}
-	if c.MetricsOutput == "" {
+	if metricsOutput == "" && c.ListenAddress == "" && len(c.Outputs) == 0 {
 		return fmt.Errorf("Invalid metrics_output: please specify name of Prometheus metric file to write, e.g. /hxlogs/metrics/p4_cmds.prom")
 	}
-	if !strings.HasSuffix(c.MetricsOutput, ".prom") {
+	if metricsOutput != "" && !strings.HasSuffix(metricsOutput, ".prom") {
 		return fmt.Errorf("Invalid metrics_output: Prometheus metric file must end in '.prom'")
 	}
+	return nil
+}
+
+func (c *Config) validateOutputs() error {
+	names := make(map[string]bool)
+	for i, o := range c.Outputs {
+		switch o.Type {
+		case OutputTextfile:
+			if !strings.HasSuffix(o.Path, ".prom") {
+				return fmt.Errorf("Invalid outputs[%d]: please specify path of Prometheus metric file ending in '.prom'", i)
+			}
+			if len(c.Instances) > 0 {
+				return fmt.Errorf("Invalid outputs[%d]: path can't be used with instances - please specify metrics_output for each of instances", i)
+			}
+		case OutputPushgateway, OutputRemoteWrite, OutputInfluxDB:
+			u, err := url.Parse(o.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("Invalid outputs[%d]: please specify url as http(s)://host:port/path", i)
+			}
+		default:
+			return fmt.Errorf("Invalid outputs[%d]: type must be one of %s, %s, %s or %s", i,
+				OutputTextfile, OutputPushgateway, OutputRemoteWrite, OutputInfluxDB)
+		}
+		if names[o.Name] {
+			return fmt.Errorf("Invalid outputs[%d]: duplicate name '%s' - please specify a unique name", i, o.Name)
+		}
+		names[o.Name] = true
+		if o.Timeout < 0 {
+			return fmt.Errorf("Invalid outputs[%d]: timeout must be greater than 0", i)
+		}
+	}
+	return nil
+}
+
+// validateBuckets - histogram bucket upper bounds must be positive and increasing
+func validateBuckets(name string, buckets []float64) error {
+	for i, b := range buckets {
+		if b <= 0 || (i > 0 && b <= buckets[i-1]) {
+			return fmt.Errorf("Invalid %s: values must be greater than 0 and in increasing order", name)
+		}
+	}
+	return nil
+}
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+func (c *Config) validateCustomMetrics() error {
+	names := make(map[string]bool)
+	for i, m := range c.CustomMetrics {
+		if !metricNameRE.MatchString(m.Name) {
+			return fmt.Errorf("Invalid custom_metrics[%d]: please specify name as a valid metric name, e.g. p4_password_invalid", i)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("Invalid custom_metrics[%d]: duplicate name '%s'", i, m.Name)
+		}
+		names[m.Name] = true
+		if m.Type != MetricCounter && m.Type != MetricGauge {
+			return fmt.Errorf("Invalid custom_metrics[%d]: type must be %s or %s", i, MetricCounter, MetricGauge)
+		}
+		re, err := regexp.Compile(m.Regex)
+		if err != nil || m.Regex == "" {
+			return fmt.Errorf("Invalid custom_metrics[%d]: failed to parse '%s' as a regex", i, m.Regex)
+		}
+		hasValue := false
+		for _, group := range re.SubexpNames() {
+			if group == CustomValueGroup {
+				hasValue = true
+			} else if group == "serverid" || group == "sdpinst" {
+				return fmt.Errorf("Invalid custom_metrics[%d]: group name '%s' is reserved", i, group)
+			} else if group != "" && !labelNameRE.MatchString(group) {
+				return fmt.Errorf("Invalid custom_metrics[%d]: group name '%s' is not a valid label name", i, group)
+			}
+		}
+		if m.Type == MetricGauge && !hasValue {
+			return fmt.Errorf("Invalid custom_metrics[%d]: please specify a (?P<%s>...) group in the regex for a %s",
+				i, CustomValueGroup, MetricGauge)
+		}
+	}
+	return nil
+}
+
+// validateFilter - include/exclude values must be valid regexes
+func validateFilter(name string, f Filter) error {
+	for _, re := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := regexp.Compile(re); err != nil {
+			return fmt.Errorf("Invalid %s: failed to parse '%s' as a regex", name, re)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateAnonymise() error {
+	if c.AnonymiseUsers != "" && c.AnonymiseUsers != AnonymiseHash {
+		return fmt.Errorf("Invalid anonymise_users: must be %s or blank", AnonymiseHash)
+	}
+	if c.AnonymiseIPs != "" && c.AnonymiseIPs != AnonymiseHash && c.AnonymiseIPs != AnonymiseSubnet {
+		return fmt.Errorf("Invalid anonymise_ips: must be %s, %s or blank", AnonymiseHash, AnonymiseSubnet)
+	}
+	if (c.AnonymiseUsers == AnonymiseHash || c.AnonymiseIPs == AnonymiseHash) && c.AnonymiseKey == "" {
+		return fmt.Errorf("Invalid anonymise_key: please specify a secret key for hashing")
+	}
+	if c.IPv4SubnetPrefix < 0 || c.IPv4SubnetPrefix > 32 {
+		return fmt.Errorf("Invalid ipv4_subnet_prefix: must be between 0 and 32")
+	}
+	if c.IPv6SubnetPrefix < 0 || c.IPv6SubnetPrefix > 128 {
+		return fmt.Errorf("Invalid ipv6_subnet_prefix: must be between 0 and 128")
+	}
+	return nil
+}
+
+// CmdTimeout - the configured timeout for commands run by the monitor, else DefaultMonitorTimeout
+// or half the interval if that is shorter, so that a hung command can't stop further runs
+func (m Monitor) CmdTimeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	if m.Interval > 0 && m.Interval/2 < DefaultMonitorTimeout {
+		return m.Interval / 2
+	}
+	return DefaultMonitorTimeout
+}
+
+func (c *Config) validateMonitor() error {
+	if c.Monitor.Interval < 0 {
+		return fmt.Errorf("Invalid monitor interval: must be 0 (run once) or greater")
+	}
+	if c.Monitor.Timeout < 0 {
+		return fmt.Errorf("Invalid monitor timeout: must be 0 (default) or greater")
+	}
+	for _, name := range c.Monitor.Collectors {
+		found := false
+		for _, valid := range MonitorCollectors {
+			if name == valid {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Invalid monitor collector '%s': must be one of %s", name, strings.Join(MonitorCollectors, ", "))
+		}
+	}
+	if c.Monitor.LicenseRefresh <= 0 {
+		return fmt.Errorf("Invalid monitor license_refresh: must be greater than 0")
+	}
+	if c.Monitor.LicenseHistory < c.Monitor.LicenseRefresh {
+		return fmt.Errorf("Invalid monitor license_history: must be at least license_refresh")
+	}
+	if c.Monitor.TopCommands < 0 {
+		return fmt.Errorf("Invalid monitor top_commands: must be 0 or greater")
+	}
+	for name := range c.Monitor.FilesysPaths {
+		found := false
+		for _, valid := range MonitorFilesys {
+			if name == valid {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Invalid monitor filesys_paths '%s': must be one of %s", name, strings.Join(MonitorFilesys, ", "))
+		}
+	}
+	for _, port := range c.Monitor.SSLPorts {
+		if !strings.HasPrefix(port, "ssl") {
+			return fmt.Errorf("Invalid monitor ssl_ports value '%s': must start with ssl, e.g. ssl:perforce:1666", port)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Instances) == 0 {
+		if err := c.validateLog(c.LogPath, c.MetricsOutput); err != nil {
+			return err
+		}
+	}
+	logPaths := make(map[string]bool)
+	outputs := make(map[string]bool)
+	stateFiles := make(map[string]bool)
+	for i, inst := range c.Instances {
+		if err := c.validateLog(inst.LogPath, inst.MetricsOutput); err != nil {
+			return fmt.Errorf("instances[%d]: %v", i, err)
+		}
+		if logPaths[inst.LogPath] {
+			return fmt.Errorf("instances[%d]: duplicate log_path '%s'", i, inst.LogPath)
+		}
+		logPaths[inst.LogPath] = true
+		if inst.MetricsOutput != "" {
+			if outputs[inst.MetricsOutput] {
+				return fmt.Errorf("instances[%d]: duplicate metrics_output '%s'", i, inst.MetricsOutput)
+			}
+			outputs[inst.MetricsOutput] = true
+		}
+		if inst.StateFile != "" {
+			if stateFiles[inst.StateFile] {
+				return fmt.Errorf("instances[%d]: duplicate state_file '%s'", i, inst.StateFile)
+			}
+			stateFiles[inst.StateFile] = true
+		}
+	}
+	if c.LogPath != "" && len(c.Instances) > 0 {
+		return fmt.Errorf("Invalid log_path: please specify log_path for each of instances")
+	}
+	if c.MetricsOutput != "" && len(c.Instances) > 0 {
+		return fmt.Errorf("Invalid metrics_output: please specify metrics_output for each of instances")
+	}
+	if c.StateFile != "" && len(c.Instances) > 0 {
+		return fmt.Errorf("Invalid state_file: please specify state_file for each of instances")
+	}
+	if c.ErrorsLogPath != "" && len(c.Instances) > 0 {
+		return fmt.Errorf("Invalid errors_log_path: please specify errors_log_path for each of instances")
+	}
+	if c.SlowCmdLog != "" && len(c.Instances) > 0 {
+		return fmt.Errorf("Invalid slow_cmd_log: please specify slow_cmd_log for each of instances")
+	}
+	for cmd, threshold := range c.SlowCmdThresholds {
+		if threshold < 0 {
+			return fmt.Errorf("Invalid slow_cmd_thresholds: value for '%s' must be 0 or greater", cmd)
+		}
+	}
+	if c.SlowCmdLogMaxSize <= 0 {
+		return fmt.Errorf("Invalid slow_cmd_log_max_size: must be greater than 0")
+	}
+	if c.SlowCmdLogBackups < 0 {
+		return fmt.Errorf("Invalid slow_cmd_log_backups: must be 0 or greater")
+	}
+	if c.TableLockTopCmds < 0 {
+		return fmt.Errorf("Invalid table_lock_top_cmds: must be 0 or greater")
+	}
+	if c.StateSaveInterval <= 0 {
+		return fmt.Errorf("Invalid state_save_interval: must be greater than 0")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("Invalid shutdown_timeout: must be greater than 0")
+	}
+	if c.ParserMaxBlocksPerSec < 0 {
+		return fmt.Errorf("Invalid parser_max_blocks_per_second: must be 0 (no limit) or greater")
+	}
+	if err := c.validateOutputs(); err != nil {
+		return err
+	}
+	if c.UserLabelLimit < 0 || c.IPLabelLimit < 0 {
+		return fmt.Errorf("Invalid user_label_limit/ip_label_limit: must be 0 (no limit) or greater")
+	}
+	if c.LabelLimitRankBy != RankByCount && c.LabelLimitRankBy != RankBySeconds {
+		return fmt.Errorf("Invalid label_limit_rank_by: must be %s or %s", RankByCount, RankBySeconds)
+	}
+	if err := c.validateAnonymise(); err != nil {
+		return err
+	}
+	if err := c.validateMonitor(); err != nil {
+		return err
+	}
+	if err := validateBuckets("cmd_histogram_buckets", c.CmdHistogramBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("cmd_lock_wait_buckets", c.CmdLockWaitBuckets); err != nil {
+		return err
+	}
+	if err := validateFilter("filter_users", c.FilterUsers); err != nil {
+		return err
+	}
+	if err := validateFilter("filter_cmds", c.FilterCmds); err != nil {
+		return err
+	}
+	if err := validateFilter("filter_programs", c.FilterPrograms); err != nil {
+		return err
+	}
+	if err := validateFilter("filter_ips", c.FilterIPs); err != nil {
+		return err
+	}
+	if err := c.validateCustomMetrics(); err != nil {
+		return err
+	}
 	// Validate regex
 	if c.OutputCmdsByUserRegex != "" {
 		if _, err := regexp.Compile(c.OutputCmdsByUserRegex); err != nil {
 			return fmt.Errorf("Failed to parse '%s' as a regex", c.OutputCmdsByUserRegex)
 		}
 	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("Invalid TLS config: please specify both tls_cert_file and tls_key_file")
+	}
 	return nil
 }
@@ -55,6 +55,12 @@ func checkValueBool(t *testing.T, fieldname string, val bool, expected bool) {
 	}
 }
 
+func checkValueInt(t *testing.T, fieldname string, val int, expected int) {
+	if val != expected {
+		t.Fatalf("Error parsing %s, expected %v got %v", fieldname, expected, val)
+	}
+}
+
 func TestValidConfig(t *testing.T) {
 	cfg := loadOrFail(t, defaultConfig)
 	checkValue(t, "LogPath", cfg.LogPath, "/p4/1/logs/log")
@@ -89,6 +95,8 @@ func TestWrongValues(t *testing.T) {
 metrics_output:				/hxlogs/metrics/cmds.prom
 `
 	ensureFail(t, start+`update_interval: 	'not duration'`, "duration")
+	ensureFail(t, start+`shutdown_timeout: 	0s`, "shutdown timeout")
+	ensureFail(t, start+`parser_max_blocks_per_second: 	-1`, "negative parser limit")
 }
 
 func TestDefaultInterval(t *testing.T) {
@@ -104,6 +112,10 @@ sdp_instance: 		1
 	if !cfg.OutputCmdsByUser {
 		t.Errorf("Failed default output_cmds_by_user")
 	}
+	if cfg.ShutdownTimeout != 10*time.Second {
+		t.Errorf("Failed default shutdown_timeout: %v", cfg.ShutdownTimeout)
+	}
+	checkValueInt(t, "ParserMaxBlocksPerSec", cfg.ParserMaxBlocksPerSec, DefaultParserMaxBlocksPerSec)
 	if runtime.GOOS == "windows" {
 		if cfg.CaseSensitiveServer {
 			t.Errorf("Failed default case_sensitive_server on Windows")
@@ -129,6 +141,596 @@ output_cmds_by_user_regex: 	"[.*"
 	}
 }
 
+func TestListenAddress(t *testing.T) {
+	// metrics_output not required if listening
+	cfg := loadOrFail(t, `
+log_path:			/p4/1/logs/log
+server_id:			myserverid
+listen_address:		":9810"
+basic_auth_users:
+  prometheus: $2y$10$nbaHsG/d/LbkBUu4uRLAcuRbhKR/6dti4Wf4/iIDzlGQjspoJe3L2
+`)
+	checkValue(t, "ListenAddress", cfg.ListenAddress, ":9810")
+	checkValue(t, "MetricsOutput", cfg.MetricsOutput, "")
+	if len(cfg.BasicAuthUsers) != 1 {
+		t.Errorf("Failed to parse basic_auth_users: %v", cfg.BasicAuthUsers)
+	}
+	ensureFail(t, `
+log_path:			/p4/1/logs/log
+server_id:			myserverid
+`, "no output")
+	ensureFail(t, `
+log_path:			/p4/1/logs/log
+listen_address:		":9810"
+tls_cert_file:		/p4/common/config/cert.pem
+`, "tls key missing")
+}
+
+func TestInstances(t *testing.T) {
+	cfg := loadOrFail(t, `
+update_interval: 	20s
+output_cmds_by_user: false
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+    sdp_instance:	1
+  - log_path:		/p4/2/logs/log
+    metrics_output:	/hxlogs/metrics/cmds2.prom
+    server_id:		edge
+`)
+	icfgs := cfg.InstanceConfigs()
+	if len(icfgs) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(icfgs))
+	}
+	checkValue(t, "LogPath", icfgs[0].LogPath, "/p4/1/logs/log")
+	checkValue(t, "MetricsOutput", icfgs[0].MetricsOutput, "/hxlogs/metrics/cmds1.prom")
+	checkValue(t, "SDPInstance", icfgs[0].SDPInstance, "1")
+	checkValue(t, "LogPath", icfgs[1].LogPath, "/p4/2/logs/log")
+	checkValue(t, "ServerID", icfgs[1].ServerID, "edge")
+	checkValue(t, "SDPInstance", icfgs[1].SDPInstance, "")
+	checkValueDuration(t, "UpdateInterval", icfgs[1].UpdateInterval, 20*time.Second)
+	checkValueBool(t, "OutputCmdsByUser", icfgs[1].OutputCmdsByUser, false)
+
+	// Single instance is a copy of the top level config
+	cfg = loadOrFail(t, defaultConfig)
+	icfgs = cfg.InstanceConfigs()
+	if len(icfgs) != 1 || icfgs[0] == cfg || len(icfgs[0].Diff(cfg)) != 0 {
+		t.Fatalf("Expected copy of top level config as only instance")
+	}
+
+	ensureFail(t, `
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+  - metrics_output:	/hxlogs/metrics/cmds2.prom
+`, "missing log_path")
+	ensureFail(t, `
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds.prom
+  - log_path:		/p4/2/logs/log
+    metrics_output:	/hxlogs/metrics/cmds.prom
+`, "duplicate metrics_output")
+	ensureFail(t, `
+log_path:		/p4/1/logs/log
+instances:
+  - log_path:		/p4/2/logs/log
+    metrics_output:	/hxlogs/metrics/cmds2.prom
+`, "top level log_path with instances")
+	ensureFail(t, `
+metrics_output:	/hxlogs/metrics/cmds.prom
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+`, "top level metrics_output with instances")
+}
+
+func TestStateFile(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig+`
+state_file:		/p4/1/logs/p4prometheus.state
+`)
+	checkValue(t, "StateFile", cfg.StateFile, "/p4/1/logs/p4prometheus.state")
+	checkValueDuration(t, "StateSaveInterval", cfg.StateSaveInterval, time.Minute)
+
+	cfg = loadOrFail(t, `
+state_save_interval:	5m
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+    state_file:		/p4/1/logs/p4prometheus.state
+  - log_path:		/p4/2/logs/log
+    metrics_output:	/hxlogs/metrics/cmds2.prom
+`)
+	icfgs := cfg.InstanceConfigs()
+	checkValue(t, "StateFile", icfgs[0].StateFile, "/p4/1/logs/p4prometheus.state")
+	checkValue(t, "StateFile", icfgs[1].StateFile, "")
+	checkValueDuration(t, "StateSaveInterval", icfgs[1].StateSaveInterval, 5*time.Minute)
+
+	ensureFail(t, `
+state_file:		/p4/1/logs/p4prometheus.state
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+`, "top level state_file with instances")
+}
+
+func TestErrorsLogPath(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig+`
+errors_log_path:	/p4/1/logs/errors.csv
+`)
+	checkValue(t, "ErrorsLogPath", cfg.ErrorsLogPath, "/p4/1/logs/errors.csv")
+
+	cfg = loadOrFail(t, `
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+    errors_log_path:	/p4/1/logs/errors.csv
+  - log_path:		/p4/2/logs/log
+    metrics_output:	/hxlogs/metrics/cmds2.prom
+`)
+	icfgs := cfg.InstanceConfigs()
+	checkValue(t, "ErrorsLogPath", icfgs[0].ErrorsLogPath, "/p4/1/logs/errors.csv")
+	checkValue(t, "ErrorsLogPath", icfgs[1].ErrorsLogPath, "")
+
+	ensureFail(t, `
+errors_log_path:	/p4/1/logs/errors.csv
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+`, "top level errors_log_path with instances")
+}
+
+func TestTableLockMetrics(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	checkValueBool(t, "TableLockMetrics", cfg.TableLockMetrics, false)
+	checkValueInt(t, "TableLockTopCmds", cfg.TableLockTopCmds, 5)
+	cfg = loadOrFail(t, defaultConfig+`
+table_lock_metrics:	true
+table_lock_top_cmds:	0
+`)
+	checkValueBool(t, "TableLockMetrics", cfg.TableLockMetrics, true)
+	checkValueInt(t, "TableLockTopCmds", cfg.TableLockTopCmds, 0)
+	ensureFail(t, defaultConfig+`
+table_lock_top_cmds:	-1
+`, "negative table_lock_top_cmds")
+}
+
+func TestSlowCmdLog(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	checkValue(t, "SlowCmdLog", cfg.SlowCmdLog, "")
+	checkValueDuration(t, "SlowCmdThresholds", cfg.SlowCmdThresholds[SlowCmdDefault], 30*time.Second)
+	checkValueInt(t, "SlowCmdLogMaxSize", cfg.SlowCmdLogMaxSize, 100)
+	checkValueInt(t, "SlowCmdLogBackups", cfg.SlowCmdLogBackups, 5)
+
+	cfg = loadOrFail(t, defaultConfig+`
+slow_cmd_log:	/p4/1/logs/slow_cmds.json
+slow_cmd_thresholds:
+  user-sync:	2m
+  user-submit:	10s
+slow_cmd_log_max_size:	10
+slow_cmd_log_backups:	0
+`)
+	checkValue(t, "SlowCmdLog", cfg.SlowCmdLog, "/p4/1/logs/slow_cmds.json")
+	checkValueDuration(t, "SlowCmdThresholds", cfg.SlowCmdThresholds["user-sync"], 2*time.Minute)
+	checkValueDuration(t, "SlowCmdThresholds", cfg.SlowCmdThresholds["user-submit"], 10*time.Second)
+	if _, ok := cfg.SlowCmdThresholds[SlowCmdDefault]; ok {
+		t.Fatalf("Unexpected default slow_cmd_thresholds: %v", cfg.SlowCmdThresholds)
+	}
+	checkValueInt(t, "SlowCmdLogMaxSize", cfg.SlowCmdLogMaxSize, 10)
+	checkValueInt(t, "SlowCmdLogBackups", cfg.SlowCmdLogBackups, 0)
+
+	cfg = loadOrFail(t, `
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+    slow_cmd_log:	/p4/1/logs/slow_cmds.json
+  - log_path:		/p4/2/logs/log
+    metrics_output:	/hxlogs/metrics/cmds2.prom
+`)
+	icfgs := cfg.InstanceConfigs()
+	checkValue(t, "SlowCmdLog", icfgs[0].SlowCmdLog, "/p4/1/logs/slow_cmds.json")
+	checkValue(t, "SlowCmdLog", icfgs[1].SlowCmdLog, "")
+
+	ensureFail(t, `
+slow_cmd_log:	/p4/1/logs/slow_cmds.json
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+`, "top level slow_cmd_log with instances")
+	ensureFail(t, defaultConfig+`
+slow_cmd_thresholds:
+  user-sync:	-1s
+`, "negative threshold")
+	ensureFail(t, defaultConfig+`
+slow_cmd_log_max_size:	0
+`, "zero max size")
+	ensureFail(t, defaultConfig+`
+slow_cmd_log_backups:	-1
+`, "negative backups")
+}
+
+func TestFilters(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	checkValueBool(t, "FilterUsers", cfg.FilterUsers.Active(), false)
+	checkValueBool(t, "FilterCmds", cfg.FilterCmds.Active(), false)
+	cfg = loadOrFail(t, defaultConfig+`
+filter_users:
+  exclude:
+    - '^swarm$'
+    - '^build_'
+filter_cmds:
+  exclude:	['^rmt-']
+filter_programs:
+  include:	['^p4/', '^P4V/']
+filter_ips:
+  exclude:	['^10\.1\.']
+`)
+	checkValueBool(t, "FilterUsers", cfg.FilterUsers.Active(), true)
+	checkValueInt(t, "FilterUsers", len(cfg.FilterUsers.Exclude), 2)
+	checkValue(t, "FilterUsers", cfg.FilterUsers.Exclude[1], "^build_")
+	checkValue(t, "FilterCmds", cfg.FilterCmds.Exclude[0], "^rmt-")
+	checkValueInt(t, "FilterPrograms", len(cfg.FilterPrograms.Include), 2)
+	checkValue(t, "FilterIPs", cfg.FilterIPs.Exclude[0], `^10\.1\.`)
+	ensureFail(t, defaultConfig+`
+filter_users:
+  exclude:	['[swarm']
+`, "invalid filter_users regex")
+	ensureFail(t, defaultConfig+`
+filter_programs:
+  include:	['(p4']
+`, "invalid filter_programs regex")
+}
+
+func TestCustomMetrics(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	checkValueInt(t, "CustomMetrics", len(cfg.CustomMetrics), 0)
+	cfg = loadOrFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_password_invalid
+    help:	Count of invalid password errors by user
+    type:	counter
+    regex:	'pid \d+ (?P<user>[^ @]+)@.* Perforce password \(P4PASSWD\) invalid'
+  - name:	p4_trigger_lapse_seconds
+    type:	gauge
+    regex:	'trigger (?P<trigger>\S+).* lapse (?P<value>[0-9.]+)s'
+`)
+	checkValueInt(t, "CustomMetrics", len(cfg.CustomMetrics), 2)
+	checkValue(t, "Name", cfg.CustomMetrics[0].Name, "p4_password_invalid")
+	checkValue(t, "Help", cfg.CustomMetrics[0].Help, "Count of invalid password errors by user")
+	checkValue(t, "Type", cfg.CustomMetrics[0].Type, MetricCounter)
+	checkValue(t, "Help", cfg.CustomMetrics[1].Help, "Log lines matching a custom_metrics regex")
+	checkValue(t, "Type", cfg.CustomMetrics[1].Type, MetricGauge)
+
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4-bad-name
+    type:	counter
+    regex:	'too long'
+`, "invalid metric name")
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_too_long
+    type:	counter
+    regex:	'too long'
+  - name:	p4_too_long
+    type:	counter
+    regex:	'took too long'
+`, "duplicate name")
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_too_long
+    type:	histogram
+    regex:	'too long'
+`, "invalid type")
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_too_long
+    type:	counter
+    regex:	'[too long'
+`, "invalid regex")
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_too_long
+    type:	counter
+`, "missing regex")
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_too_long
+    type:	counter
+    regex:	'(?P<serverid>\S+) too long'
+`, "reserved label")
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_too_long
+    type:	counter
+    regex:	'(?P<1st>\S+) too long'
+`, "invalid label name")
+	ensureFail(t, defaultConfig+`
+custom_metrics:
+  - name:	p4_too_long
+    type:	gauge
+    regex:	'too long'
+`, "gauge without value")
+}
+
+func TestOutputs(t *testing.T) {
+	cfg := loadOrFail(t, `
+log_path:		/p4/1/logs/log
+server_id:		myserverid
+outputs:
+  - type:		pushgateway
+    url:		http://pushgateway:9091
+  - type:		remote_write
+    url:		https://prometheus:9090/api/v1/write
+    username:	p4
+    password:	secret
+    timeout:	30s
+  - type:		influxdb
+    url:		http://influxdb:8086/api/v2/write?org=perforce&bucket=p4
+    token:		mytoken
+  - type:		textfile
+    path:		/hxlogs/metrics/cmds.prom
+`)
+	if len(cfg.Outputs) != 4 {
+		t.Fatalf("Expected 4 outputs, got %d", len(cfg.Outputs))
+	}
+	checkValue(t, "Name", cfg.Outputs[0].Name, "pushgateway")
+	checkValue(t, "Job", cfg.Outputs[0].Job, "p4prometheus")
+	checkValueDuration(t, "Timeout", cfg.Outputs[0].Timeout, 10*time.Second)
+	checkValue(t, "Username", cfg.Outputs[1].Username, "p4")
+	checkValueDuration(t, "Timeout", cfg.Outputs[1].Timeout, 30*time.Second)
+	checkValue(t, "Token", cfg.Outputs[2].Token, "mytoken")
+	checkValue(t, "Name", cfg.Outputs[3].Name, "/hxlogs/metrics/cmds.prom")
+
+	ensureFail(t, defaultConfig+`
+outputs:
+  - type:		graphite
+    url:		http://graphite:2003
+`, "unknown output type")
+	ensureFail(t, defaultConfig+`
+outputs:
+  - type:		pushgateway
+`, "missing url")
+	ensureFail(t, defaultConfig+`
+outputs:
+  - type:		remote_write
+    url:		prometheus:9090/api/v1/write
+`, "url without scheme")
+	ensureFail(t, defaultConfig+`
+outputs:
+  - type:		textfile
+`, "textfile without path")
+	ensureFail(t, defaultConfig+`
+outputs:
+  - type:		pushgateway
+    url:		http://pushgateway1:9091
+  - type:		pushgateway
+    url:		http://pushgateway2:9091
+`, "duplicate output names")
+	ensureFail(t, `
+outputs:
+  - type:		textfile
+    path:		/hxlogs/metrics/cmds.prom
+instances:
+  - log_path:		/p4/1/logs/log
+    metrics_output:	/hxlogs/metrics/cmds1.prom
+`, "textfile path with instances")
+	loadOrFail(t, defaultConfig+`
+outputs:
+  - type:		pushgateway
+    url:		http://pushgateway1:9091
+  - type:		pushgateway
+    name:		backup
+    url:		http://pushgateway2:9091
+`)
+}
+
+func TestLabelLimits(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	if cfg.UserLabelLimit != 0 || cfg.IPLabelLimit != 0 {
+		t.Fatalf("Expected no label limits by default")
+	}
+	checkValue(t, "LabelLimitRankBy", cfg.LabelLimitRankBy, RankByCount)
+	cfg = loadOrFail(t, defaultConfig+`
+user_label_limit:		100
+ip_label_limit:			50
+label_limit_rank_by:	seconds
+`)
+	if cfg.UserLabelLimit != 100 || cfg.IPLabelLimit != 50 {
+		t.Fatalf("Error parsing label limits: %d %d", cfg.UserLabelLimit, cfg.IPLabelLimit)
+	}
+	checkValue(t, "LabelLimitRankBy", cfg.LabelLimitRankBy, RankBySeconds)
+	ensureFail(t, defaultConfig+`
+user_label_limit:		-1
+`, "negative label limit")
+	ensureFail(t, defaultConfig+`
+label_limit_rank_by:	bytes
+`, "invalid rank by")
+}
+
+func TestAnonymise(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	checkValue(t, "AnonymiseUsers", cfg.AnonymiseUsers, "")
+	if cfg.IPv4SubnetPrefix != 24 || cfg.IPv6SubnetPrefix != 64 {
+		t.Fatalf("Unexpected default subnet prefixes: %d %d", cfg.IPv4SubnetPrefix, cfg.IPv6SubnetPrefix)
+	}
+	cfg = loadOrFail(t, defaultConfig+`
+anonymise_users:	hash
+anonymise_ips:		subnet
+anonymise_key:		secret
+ipv4_subnet_prefix:	16
+`)
+	checkValue(t, "AnonymiseUsers", cfg.AnonymiseUsers, AnonymiseHash)
+	checkValue(t, "AnonymiseIPs", cfg.AnonymiseIPs, AnonymiseSubnet)
+	if cfg.IPv4SubnetPrefix != 16 {
+		t.Fatalf("Error parsing ipv4_subnet_prefix: %d", cfg.IPv4SubnetPrefix)
+	}
+	loadOrFail(t, defaultConfig+`
+anonymise_ips:		subnet
+`)
+	ensureFail(t, defaultConfig+`
+anonymise_users:	hash
+`, "hash without key")
+	ensureFail(t, defaultConfig+`
+anonymise_users:	subnet
+anonymise_key:		secret
+`, "subnet for users")
+	ensureFail(t, defaultConfig+`
+anonymise_ips:		subnet
+ipv4_subnet_prefix:	33
+`, "invalid prefix")
+}
+
+func TestCmdHistograms(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	checkValueBool(t, "CmdHistograms", cfg.CmdHistograms, false)
+	if len(cfg.CmdHistogramBuckets) != len(DefaultCmdHistogramBuckets) || len(cfg.CmdLockWaitBuckets) != len(DefaultCmdLockWaitBuckets) {
+		t.Fatalf("Unexpected default buckets: %v %v", cfg.CmdHistogramBuckets, cfg.CmdLockWaitBuckets)
+	}
+	cfg = loadOrFail(t, defaultConfig+`
+cmd_histograms:	true
+cmd_histogram_buckets:	[0.5, 1, 10]
+cmd_lock_wait_buckets:	[0.1, 1]
+`)
+	checkValueBool(t, "CmdHistograms", cfg.CmdHistograms, true)
+	if len(cfg.CmdHistogramBuckets) != 3 || cfg.CmdHistogramBuckets[0] != 0.5 || len(cfg.CmdLockWaitBuckets) != 2 {
+		t.Fatalf("Error parsing buckets: %v %v", cfg.CmdHistogramBuckets, cfg.CmdLockWaitBuckets)
+	}
+	ensureFail(t, defaultConfig+`
+cmd_histogram_buckets:	[1, 0.5]
+`, "decreasing buckets")
+	ensureFail(t, defaultConfig+`
+cmd_lock_wait_buckets:	[0, 1]
+`, "zero bucket")
+}
+
+func TestMonitor(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	checkValue(t, "P4Bin", cfg.Monitor.P4Bin, "p4")
+	checkValue(t, "MetricsDir", cfg.Monitor.MetricsDir, "/p4/metrics")
+	checkValueDuration(t, "LicenseRefresh", cfg.Monitor.LicenseRefresh, time.Hour)
+	checkValueDuration(t, "LicenseHistory", cfg.Monitor.LicenseHistory, 30*24*time.Hour)
+	checkValueInt(t, "TopCommands", cfg.Monitor.TopCommands, 10)
+	if len(cfg.Monitor.Collectors) != len(MonitorCollectors) || cfg.Monitor.Interval != 0 {
+		t.Fatalf("Unexpected monitor defaults: %v", cfg.Monitor)
+	}
+	cfg = loadOrFail(t, defaultConfig+`
+monitor:
+  p4port:	ssl:perforce:1666
+  p4user:	perforce
+  metrics_dir:	/hxlogs/metrics
+  interval:	1m
+  collectors:
+  - uptime
+  - license
+`)
+	checkValue(t, "P4Port", cfg.Monitor.P4Port, "ssl:perforce:1666")
+	checkValue(t, "P4User", cfg.Monitor.P4User, "perforce")
+	checkValue(t, "MetricsDir", cfg.Monitor.MetricsDir, "/hxlogs/metrics")
+	if cfg.Monitor.Interval != time.Minute {
+		t.Fatalf("Error parsing monitor interval: %v", cfg.Monitor.Interval)
+	}
+	if len(cfg.Monitor.Collectors) != 2 || cfg.Monitor.Collectors[1] != "license" {
+		t.Fatalf("Error parsing monitor collectors: %v", cfg.Monitor.Collectors)
+	}
+	ensureFail(t, defaultConfig+`
+monitor:
+  collectors:
+  - unknown
+`, "unknown collector")
+	cfg = loadOrFail(t, defaultConfig+`
+monitor:
+  ssl_ports:
+  - ssl:perforce:1666
+  - ssl64:[::1]:1667
+`)
+	if len(cfg.Monitor.SSLPorts) != 2 || cfg.Monitor.SSLPorts[1] != "ssl64:[::1]:1667" {
+		t.Fatalf("Error parsing monitor ssl_ports: %v", cfg.Monitor.SSLPorts)
+	}
+	ensureFail(t, defaultConfig+`
+monitor:
+  ssl_ports:
+  - perforce:1666
+`, "non ssl port")
+	cfg = loadOrFail(t, defaultConfig+`
+monitor:
+  license_refresh:	4h
+  license_history:	2160h
+`)
+	checkValueDuration(t, "LicenseRefresh", cfg.Monitor.LicenseRefresh, 4*time.Hour)
+	checkValueDuration(t, "LicenseHistory", cfg.Monitor.LicenseHistory, 90*24*time.Hour)
+	ensureFail(t, defaultConfig+`
+monitor:
+  license_refresh:	0s
+`, "zero license_refresh")
+	ensureFail(t, defaultConfig+`
+monitor:
+  license_history:	30m
+`, "license_history less than license_refresh")
+	cfg = loadOrFail(t, defaultConfig+`
+monitor:
+  filesys_paths:
+    depot:	/hxdepots/p4/1/depots
+    P4JOURNAL:	/hxlogs/p4/1/logs/journal
+`)
+	checkValue(t, "FilesysPaths", cfg.Monitor.FilesysPaths["depot"], "/hxdepots/p4/1/depots")
+	checkValue(t, "FilesysPaths", cfg.Monitor.FilesysPaths["P4JOURNAL"], "/hxlogs/p4/1/logs/journal")
+	ensureFail(t, defaultConfig+`
+monitor:
+  filesys_paths:
+    p4root:	/p4/1/root
+`, "unknown filesys")
+	cfg = loadOrFail(t, defaultConfig+`
+monitor:
+  top_commands:	0
+`)
+	checkValueInt(t, "TopCommands", cfg.Monitor.TopCommands, 0)
+	ensureFail(t, defaultConfig+`
+monitor:
+  top_commands:	-1
+`, "negative top_commands")
+	ensureFail(t, defaultConfig+`
+monitor:
+  interval:	-1s
+`, "negative interval")
+	ensureFail(t, defaultConfig+`
+monitor:
+  timeout:	-1s
+`, "negative timeout")
+}
+
+func TestMonitorCmdTimeout(t *testing.T) {
+	checkValueDuration(t, "CmdTimeout", Monitor{}.CmdTimeout(), DefaultMonitorTimeout)
+	checkValueDuration(t, "CmdTimeout", Monitor{Interval: time.Hour}.CmdTimeout(), DefaultMonitorTimeout)
+	checkValueDuration(t, "CmdTimeout", Monitor{Interval: 30 * time.Second}.CmdTimeout(), 15*time.Second)
+	checkValueDuration(t, "CmdTimeout", Monitor{Interval: 30 * time.Second, Timeout: 5 * time.Minute}.CmdTimeout(), 5*time.Minute)
+	cfg := loadOrFail(t, defaultConfig+`
+monitor:
+  timeout:	20s
+`)
+	checkValueDuration(t, "Timeout", cfg.Monitor.Timeout, 20*time.Second)
+}
+
+func TestDiff(t *testing.T) {
+	cfg1 := loadOrFail(t, defaultConfig)
+	cfg2 := loadOrFail(t, defaultConfig)
+	if diff := cfg1.Diff(cfg2); len(diff) != 0 {
+		t.Errorf("Unexpected diff: %v", diff)
+	}
+	cfg2.UpdateInterval = 30 * time.Second
+	cfg2.OutputCmdsByUserRegex = "swarm"
+	cfg2.BasicAuthUsers = map[string]string{"user": "hash"}
+	cfg2.Outputs = []Output{{Type: OutputInfluxDB, URL: "http://influxdb:8086/write", Token: "secret"}}
+	diff := cfg1.Diff(cfg2)
+	if len(diff) != 4 {
+		t.Fatalf("Unexpected diff: %v", diff)
+	}
+	checkValue(t, "diff", diff[0], "update_interval: 15s -> 30s")
+	checkValue(t, "diff", diff[1], "output_cmds_by_user_regex: .* -> swarm")
+	checkValue(t, "diff", diff[2], "basic_auth_users: changed")
+	checkValue(t, "diff", diff[3], "outputs: changed")
+}
+
 func ensureFail(t *testing.T, cfgString string, desc string) {
 	_, err := Unmarshal([]byte(cfgString))
 	if err == nil {
@@ -0,0 +1,134 @@
+package main
+
+// User defined metrics from log lines matching a regex (custom_metrics), for events which the parser
+// has no metric for, e.g. "Operation took too long" or "Perforce password (P4PASSWD) invalid".
+// Every line read is matched, whether or not it is part of an excluded command.
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/perforce/p4prometheus/config"
+)
+
+// customSeries - a value of a custom metric, by the values of the named groups
+type customSeries struct {
+	labels []labelPair
+	value  float64
+}
+
+// customMetric - a custom_metrics entry with its compiled regex and values
+type customMetric struct {
+	config.CustomMetric
+	re         *regexp.Regexp
+	valueIndex int // Submatch index of the value group, or -1
+	series     map[string]*customSeries
+}
+
+func newCustomMetric(cm config.CustomMetric) *customMetric {
+	re := regexp.MustCompile(cm.Regex)
+	return &customMetric{CustomMetric: cm, re: re, valueIndex: re.SubexpIndex(config.CustomValueGroup),
+		series: make(map[string]*customSeries)}
+}
+
+func (m *customMetric) add(line string) {
+	match := m.re.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	value := 1.0
+	if m.valueIndex >= 0 {
+		var err error
+		if value, err = strconv.ParseFloat(match[m.valueIndex], 64); err != nil {
+			return
+		}
+	}
+	labels := make([]labelPair, 0, len(match))
+	for i, name := range m.re.SubexpNames() {
+		if name != "" && i != m.valueIndex {
+			labels = append(labels, labelPair{name, match[i]})
+		}
+	}
+	key := formatLabels(labels)
+	s, ok := m.series[key]
+	if !ok {
+		s = &customSeries{labels: labels}
+		m.series[key] = s
+	}
+	if m.Type == config.MetricGauge {
+		s.value = value
+	} else {
+		s.value += value
+	}
+}
+
+// customMetrics - the custom metrics in the order configured
+type customMetrics struct {
+	metrics []*customMetric
+}
+
+func newCustomMetrics(cfg *config.Config) *customMetrics {
+	c := &customMetrics{}
+	c.configure(cfg)
+	return c
+}
+
+// configure - applies the definitions, e.g. on reload. Values are kept for metrics whose type
+// and regex are unchanged so that counters don't go backwards.
+func (c *customMetrics) configure(cfg *config.Config) {
+	existing := make(map[string]*customMetric)
+	for _, m := range c.metrics {
+		existing[m.Name] = m
+	}
+	c.metrics = make([]*customMetric, 0, len(cfg.CustomMetrics))
+	for _, cm := range cfg.CustomMetrics {
+		if m, ok := existing[cm.Name]; ok && m.Type == cm.Type && m.Regex == cm.Regex {
+			m.CustomMetric = cm
+			c.metrics = append(c.metrics, m)
+		} else {
+			c.metrics = append(c.metrics, newCustomMetric(cm))
+		}
+	}
+}
+
+// add - matches a log line against each of the metrics
+func (c *customMetrics) add(line string) {
+	for _, m := range c.metrics {
+		m.add(line)
+	}
+}
+
+// reset - clears the counters (but not gauges), e.g. when the log parser is restarted and the
+// values last output are used as a baseline
+func (c *customMetrics) reset() {
+	for _, m := range c.metrics {
+		if m.Type == config.MetricCounter {
+			m.series = make(map[string]*customSeries)
+		}
+	}
+}
+
+// output - the custom metrics with the self metrics labels. Metrics with no values are omitted.
+func (c *customMetrics) output(fixed []labelPair) []byte {
+	buf := new(bytes.Buffer)
+	for _, m := range c.metrics {
+		if len(m.series) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		printHeader(buf, m.Name, strings.ReplaceAll(m.Help, "\n", " "), m.Type)
+		for _, k := range keys {
+			s := m.series[k]
+			printSample(buf, m.Name, append(append([]labelPair{}, fixed...), s.labels...),
+				strconv.FormatFloat(s.value, 'f', -1, 64))
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var customTestMetrics = []config.CustomMetric{
+	{Name: "p4_password_invalid", Help: "Invalid password errors", Type: config.MetricCounter,
+		Regex: `pid \d+ (?P<user>[^ @]+)@\S+ .*Perforce password \(P4PASSWD\) invalid`},
+	{Name: "p4_too_long_seconds", Help: "Operations which took too long", Type: config.MetricCounter,
+		Regex: `Operation took too long \((?P<value>[0-9.]+)s\)`},
+	{Name: "p4_trigger_lapse_seconds", Help: "Lapse of the last trigger run", Type: config.MetricGauge,
+		Regex: `trigger (?P<trigger>\S+) lapse (?P<value>[0-9.]+)s`},
+	{Name: "p4_unmatched", Help: "Never matched", Type: config.MetricCounter, Regex: `no such line`},
+}
+
+func TestCustomMetrics(t *testing.T) {
+	c := newCustomMetrics(&config.Config{CustomMetrics: customTestMetrics})
+	for _, line := range []string{
+		"\t2023/01/02 15:04:05 pid 1 fred@ws 10.0.0.1 [p4] 'user-login' Perforce password (P4PASSWD) invalid or unset.",
+		"\t2023/01/02 15:04:06 pid 2 fred@ws 10.0.0.1 [p4] 'user-login' Perforce password (P4PASSWD) invalid or unset.",
+		"\t2023/01/02 15:04:07 pid 3 bob@ws 10.0.0.2 [p4] 'user-login' Perforce password (P4PASSWD) invalid or unset.",
+		"Operation took too long (1.5s)",
+		"Operation took too long (2.25s)",
+		"trigger swarm.changesave lapse 0.5s",
+		"trigger swarm.changesave lapse 0.25s",
+		"trigger check lapse 3s",
+		"trigger check lapse bad",
+	} {
+		c.add(line)
+	}
+	fixed := []labelPair{{"serverid", "myserverid"}}
+	assert.Equal(t, `# HELP p4_password_invalid Invalid password errors
+# TYPE p4_password_invalid counter
+p4_password_invalid{serverid="myserverid",user="bob"} 1
+p4_password_invalid{serverid="myserverid",user="fred"} 2
+# HELP p4_too_long_seconds Operations which took too long
+# TYPE p4_too_long_seconds counter
+p4_too_long_seconds{serverid="myserverid"} 3.75
+# HELP p4_trigger_lapse_seconds Lapse of the last trigger run
+# TYPE p4_trigger_lapse_seconds gauge
+p4_trigger_lapse_seconds{serverid="myserverid",trigger="check"} 3
+p4_trigger_lapse_seconds{serverid="myserverid",trigger="swarm.changesave"} 0.25
+`, string(c.output(fixed)))
+
+	// Values are kept on reload unless the definition changes
+	metrics := append([]config.CustomMetric{}, customTestMetrics[:3]...)
+	metrics[1].Regex = `took too long \((?P<value>[0-9.]+)s\)`
+	metrics[2].Help = "Trigger lapse"
+	c.configure(&config.Config{CustomMetrics: metrics})
+	out := string(c.output(fixed))
+	assert.Contains(t, out, `p4_password_invalid{serverid="myserverid",user="fred"} 2`)
+	assert.NotContains(t, out, "p4_too_long_seconds")
+	assert.Contains(t, out, "# HELP p4_trigger_lapse_seconds Trigger lapse\n")
+
+	// Only counters are reset on rebase
+	c.reset()
+	out = string(c.output(fixed))
+	assert.NotContains(t, out, "p4_password_invalid")
+	assert.Contains(t, out, `p4_trigger_lapse_seconds{serverid="myserverid",trigger="check"} 3`)
+}
+
+func TestRunLogTailerCustomMetrics(t *testing.T) {
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	cfg := &config.Config{
+		LogPath:           logPath,
+		MetricsOutput:     dir + "/cmds.prom",
+		ServerID:          "myserverid",
+		UpdateInterval:    time.Hour, // So metrics are only written on shutdown
+		StateSaveInterval: time.Hour,
+		ShutdownTimeout:   5 * time.Second,
+		CustomMetrics:     customTestMetrics,
+		FilterUsers:       config.Filter{Exclude: []string{"^bruno$"}},
+		AnonymiseUsers:    config.AnonymiseHash,
+		AnonymiseKey:      "secret",
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, nil, false)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	// Lines of excluded commands are still matched
+	f.WriteString(`Perforce server error:
+	Date 2017/02/15 13:46:42:
+	Pid 81805
+	Connection from 10.62.185.98:52144 broken.
+Perforce server info:
+	2017/02/15 13:46:42 pid 81805 bruno@bruno-ws 10.62.185.98 [p4/2016.2/LINUX26X86_64/1468155] 'user-login' Perforce password (P4PASSWD) invalid or unset.
+
+`)
+	f.Close()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	user := newAnonymiser(cfg).user("bruno")
+	assert.Contains(t, string(buf), `p4_password_invalid{serverid="myserverid",user="`+user+`"} 1`)
+	assert.NotContains(t, string(buf), "p4_unmatched")
+	assert.Contains(t, string(buf), `p4_cmd_excluded_counter{serverid="myserverid"} 1`)
+}
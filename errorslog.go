@@ -0,0 +1,168 @@
+package main
+
+// Counts of errors from the p4d structured error log (errors.csv), output as p4_error_count.
+// Used both by the monitor command (which re-reads the whole log each run, as per monitor_metrics.sh)
+// and when tailing, where the log is tailed alongside the main p4d log (errors_log_path).
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/perforce/p4prometheus/p4cmd"
+)
+
+// How long to wait before retrying p4 logschema after it fails
+const errorsSchemaRetry = time.Minute
+
+// How long p4 logschema may run when tailing, as the log is not processed meanwhile
+const errorsSchemaTimeout = 10 * time.Second
+
+// Error subsystems as per p4 help errors
+var errorSubsystems = []string{"OS", "SUPP", "LBR", "RPC", "DB", "DBSUPP", "DM", "SERVER", "CLIENT",
+	"INFO", "HELP", "SPEC", "FTPD", "BROKER", "P4QT", "X3SERVER", "GRAPH", "SCRIPT", "SERVER2", "DM2"}
+
+func errorSubsystem(id string) string {
+	if i, err := strconv.Atoi(id); err == nil && i >= 0 && i < len(errorSubsystems) {
+		return errorSubsystems[i]
+	}
+	return id
+}
+
+// severityField - the index of f_severity in the error log, from p4 logschema, e.g.
+//
+//	... f_field 16
+//	... f_name f_severity
+func severityField(buf []byte) int {
+	field := -1
+	for _, line := range nonEmptyLines(buf) {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "..." {
+			continue
+		}
+		if fields[1] == "f_field" {
+			field, _ = strconv.Atoi(fields[2])
+		} else if fields[1] == "f_name" && fields[2] == "f_severity" {
+			return field
+		}
+	}
+	return -1
+}
+
+// errorKey - the labels of p4_error_count
+type errorKey struct {
+	id, subsystem, level string
+}
+
+// errorCounter - counts lines of the structured error log by subsystem, id and severity.
+// The layout of the log differs according to p4d version (the first field of each line), and is
+// looked up with p4 logschema. The severity, subsystem and id fields are consecutive.
+type errorCounter struct {
+	logSchema func(ver string) ([]byte, error) // Runs p4 logschema
+	severity  map[string]int                   // Index of f_severity by log version, -1 if not present
+	failed    map[string]time.Time             // When p4 logschema last failed by log version
+	counts    map[errorKey]int64
+	unparsed  int64 // Lines skipped as the layout is not known
+	now       func() time.Time
+}
+
+func newErrorCounter(logSchema func(ver string) ([]byte, error)) *errorCounter {
+	return &errorCounter{
+		logSchema: logSchema,
+		severity:  make(map[string]int),
+		failed:    make(map[string]time.Time),
+		counts:    make(map[errorKey]int64),
+		now:       time.Now,
+	}
+}
+
+// newTailErrorCounter - runs p4 logschema with the p4 settings from the monitor section
+// of the config, and the environment otherwise
+func newTailErrorCounter(cfg *config.Config) *errorCounter {
+	p4 := &p4cmd.P4{Runner: &p4cmd.ExecRunner{Timeout: errorsSchemaTimeout}, P4Bin: cfg.Monitor.P4Bin,
+		Port: cfg.Monitor.P4Port, User: cfg.Monitor.P4User}
+	return newErrorCounter(func(ver string) ([]byte, error) {
+		return p4.Run("logschema", ver)
+	})
+}
+
+// severityIndex - the index of f_severity for the log version, looking it up if not yet known
+func (c *errorCounter) severityIndex(ver string) (int, error) {
+	if ind, ok := c.severity[ver]; ok {
+		return ind, nil
+	}
+	if t, ok := c.failed[ver]; ok && c.now().Sub(t) < errorsSchemaRetry {
+		return -1, nil
+	}
+	out, err := c.logSchema(ver)
+	if err != nil {
+		c.failed[ver] = c.now()
+		return -1, fmt.Errorf("error getting schema for error log version %s: %v", ver, err)
+	}
+	delete(c.failed, ver)
+	c.severity[ver] = severityField(out)
+	return c.severity[ver], nil
+}
+
+// add - counts a line of the log. An error is returned if the log layout could not be looked up.
+func (c *errorCounter) add(line string) error {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil
+	}
+	fields := strings.Split(line, ",")
+	ind, err := c.severityIndex(fields[0])
+	if ind < 0 {
+		c.unparsed++
+		return err
+	}
+	if len(fields) <= ind+2 || fields[ind+1] == "" {
+		return nil
+	}
+	c.counts[errorKey{id: fields[ind+2], subsystem: fields[ind+1], level: fields[ind]}]++
+	return nil
+}
+
+// reset - clears the counts, e.g. when the log parser is restarted and the values last output
+// are used as a baseline
+func (c *errorCounter) reset() {
+	c.counts = make(map[errorKey]int64)
+	c.unparsed = 0
+}
+
+// write - outputs p4_error_count using the sample function (which adds the server labels)
+func (c *errorCounter) write(buf *bytes.Buffer, sample func(buf *bytes.Buffer, name, value string, labels ...labelPair)) {
+	keys := make([]errorKey, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		if keys[i].subsystem != keys[j].subsystem {
+			return keys[i].subsystem < keys[j].subsystem
+		}
+		return keys[i].level < keys[j].level
+	})
+	printHeader(buf, "p4_error_count", "Server errors by id", "counter")
+	for _, k := range keys {
+		sample(buf, "p4_error_count", strconv.FormatInt(c.counts[k], 10), labelPair{"subsystem", errorSubsystem(k.subsystem)},
+			labelPair{"error_id", k.id}, labelPair{"level", k.level})
+	}
+}
+
+// output - p4_error_count and the count of unparsed lines when tailing, with the self metrics labels
+func (c *errorCounter) output(fixed []labelPair) []byte {
+	buf := new(bytes.Buffer)
+	c.write(buf, func(buf *bytes.Buffer, name, value string, labels ...labelPair) {
+		printSample(buf, name, append(append([]labelPair{}, fixed...), labels...), value)
+	})
+	printMetric(buf, "p4prom_errors_log_unparsed", "A count of error log lines skipped as the log layout is unknown",
+		"counter", fixed, strconv.FormatInt(c.unparsed, 10))
+	return buf.Bytes()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// testErrorLine - a line of the structured error log with the fields in testLogSchema
+func testErrorLine(ver, severity, subsys, id string) string {
+	fields := make([]string, 20)
+	fields[0] = ver
+	fields[16] = severity
+	fields[17] = subsys
+	fields[18] = id
+	return strings.Join(fields, ",")
+}
+
+func TestErrorCounter(t *testing.T) {
+	schemaCalls := 0
+	schemaErr := fmt.Errorf("connect failed")
+	c := newErrorCounter(func(ver string) ([]byte, error) {
+		schemaCalls++
+		if ver == "4" {
+			return []byte(testLogSchema), nil
+		}
+		return nil, schemaErr
+	})
+	now := time.Unix(1643245000, 0)
+	c.now = func() time.Time { return now }
+
+	assert.NoError(t, c.add(testErrorLine("4", "3", "6", "17")+"\n"))
+	assert.NoError(t, c.add(testErrorLine("4", "3", "6", "17")))
+	assert.NoError(t, c.add(testErrorLine("4", "2", "7", "123")))
+	assert.NoError(t, c.add(testErrorLine("4", "3", "", "1")))
+	assert.NoError(t, c.add(""))
+	assert.Equal(t, 1, schemaCalls, "schema cached")
+
+	// Unknown layout - not retried until errorsSchemaRetry has passed
+	assert.Error(t, c.add(testErrorLine("5", "3", "6", "17")))
+	assert.NoError(t, c.add(testErrorLine("5", "3", "6", "17")))
+	assert.Equal(t, 2, schemaCalls)
+	now = now.Add(errorsSchemaRetry)
+	assert.Error(t, c.add(testErrorLine("5", "3", "6", "17")))
+	assert.Equal(t, 3, schemaCalls)
+
+	fixed := []labelPair{{"serverid", "master"}, {"sdpinst", "1"}}
+	assert.Equal(t, `# HELP p4_error_count Server errors by id
+# TYPE p4_error_count counter
+p4_error_count{serverid="master",sdpinst="1",subsystem="SERVER",error_id="123",level="2"} 1
+p4_error_count{serverid="master",sdpinst="1",subsystem="DM",error_id="17",level="3"} 2
+# HELP p4prom_errors_log_unparsed A count of error log lines skipped as the log layout is unknown
+# TYPE p4prom_errors_log_unparsed counter
+p4prom_errors_log_unparsed{serverid="master",sdpinst="1"} 3
+`, string(c.output(fixed)))
+
+	c.reset()
+	buf := new(bytes.Buffer)
+	c.write(buf, func(buf *bytes.Buffer, name, value string, labels ...labelPair) {
+		printSample(buf, name, labels, value)
+	})
+	assert.Equal(t, "# HELP p4_error_count Server errors by id\n# TYPE p4_error_count counter\n", buf.String())
+}
+
+func TestRunLogTailerErrorsLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake p4 is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	errorsPath := filepath.Join(dir, "errors.csv")
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	assert.NoError(t, os.WriteFile(errorsPath, []byte(""), 0644))
+	p4 := filepath.Join(dir, "p4")
+	assert.NoError(t, os.WriteFile(p4, []byte("#!/bin/sh\ncat <<EOF\n"+testLogSchema+"EOF\n"), 0755))
+	cfg := &config.Config{
+		LogPath:           logPath,
+		MetricsOutput:     filepath.Join(dir, "cmds.prom"),
+		ErrorsLogPath:     errorsPath,
+		ServerID:          "myserverid",
+		UpdateInterval:    time.Hour, // So metrics are only written on shutdown
+		StateSaveInterval: time.Hour,
+		ShutdownTimeout:   5 * time.Second,
+		Monitor:           config.Monitor{P4Bin: p4},
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, nil, false)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	f, err := os.OpenFile(errorsPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(testErrorLine("4", "3", "6", "17") + "\n" + testErrorLine("4", "3", "6", "17") + "\n")
+	f.Close()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4_error_count{serverid="myserverid",subsystem="DM",error_id="17",level="3"} 2`)
+}
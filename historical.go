@@ -0,0 +1,274 @@
+package main
+
+// Historical (backfill) mode - replays archived p4d logs through the parser in historical mode
+// and writes the resulting timestamped metrics in a format suitable for import into a TSDB:
+//   - openmetrics: for use with "promtool tsdb create-blocks-from openmetrics"
+//   - victoriametrics: JSON lines for VictoriaMetrics /api/v1/import
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/perforce/p4prometheus/config"
+	metrics "github.com/rcowham/go-libp4dlog/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported output formats for historical mode
+const (
+	formatOpenMetrics     = "openmetrics"
+	formatVictoriaMetrics = "victoriametrics"
+)
+
+type historicalSample struct {
+	value float64
+	ts    int64 // unix seconds
+}
+
+type historicalSeries struct {
+	name    string
+	labels  []labelPair
+	samples []historicalSample
+}
+
+// Parses a Graphite style line as output by the parser in historical mode:
+//
+//	metric_name;label1=val1;label2=val2 value timestamp
+func parseHistoricalLine(line string) (name string, labels []labelPair, value float64, ts int64, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return "", nil, 0, 0, fmt.Errorf("invalid historical metric line: '%s'", line)
+	}
+	parts := strings.Split(fields[0], ";")
+	name = parts[0]
+	for _, p := range parts[1:] {
+		i := strings.Index(p, "=")
+		if i <= 0 {
+			return "", nil, 0, 0, fmt.Errorf("invalid label '%s' in line: '%s'", p, line)
+		}
+		labels = append(labels, labelPair{p[:i], p[i+1:]})
+	}
+	if value, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return "", nil, 0, 0, fmt.Errorf("invalid value in line: '%s'", line)
+	}
+	if ts, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return "", nil, 0, 0, fmt.Errorf("invalid timestamp in line: '%s'", line)
+	}
+	return name, labels, value, ts, nil
+}
+
+// historicalWriter accumulates samples per series so that they can be written grouped by series
+// and in time order, as required by the import tools.
+type historicalWriter struct {
+	logger     *logrus.Logger
+	anonymiser *anonymiser
+	series     map[string]*historicalSeries
+}
+
+func newHistoricalWriter(logger *logrus.Logger, anonymiser *anonymiser) *historicalWriter {
+	return &historicalWriter{
+		logger:     logger,
+		anonymiser: anonymiser,
+		series:     make(map[string]*historicalSeries),
+	}
+}
+
+// add - processes a block of metrics output by the parser
+func (hw *historicalWriter) add(metricsBlock string) {
+	// Series may be combined by anonymisation (e.g. IPs in the same subnet) so values are
+	// totalled for the block before being added
+	keys := make([]string, 0)
+	block := make(map[string]*historicalSeries)
+	for _, line := range strings.Split(metricsBlock, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, labels, value, ts, err := parseHistoricalLine(line)
+		if err != nil {
+			hw.logger.Warnf("%v", err)
+			continue
+		}
+		key := strings.Fields(line)[0]
+		if hw.anonymiser != nil && hw.anonymiser.enabled() {
+			labels = hw.anonymiser.labels(labels)
+			key = formatSeries(name, labels)
+		}
+		if s, ok := block[key]; ok && s.samples[0].ts == ts {
+			s.samples[0].value += value
+			continue
+		}
+		if _, ok := block[key]; !ok {
+			keys = append(keys, key)
+		}
+		block[key] = &historicalSeries{name: name, labels: labels,
+			samples: []historicalSample{{value: value, ts: ts}}}
+	}
+	for _, key := range keys {
+		b := block[key]
+		s, ok := hw.series[key]
+		if !ok {
+			s = &historicalSeries{name: b.name, labels: b.labels}
+			hw.series[key] = s
+		}
+		smp := b.samples[0]
+		// The same timestamp may be output more than once - last value wins
+		if n := len(s.samples); n > 0 && s.samples[n-1].ts == smp.ts {
+			s.samples[n-1].value = smp.value
+			continue
+		}
+		s.samples = append(s.samples, smp)
+	}
+}
+
+func (hw *historicalWriter) sortedSeries() []*historicalSeries {
+	keys := make([]string, 0, len(hw.series))
+	for k := range hw.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*historicalSeries, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, hw.series[k])
+	}
+	return result
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// writeOpenMetrics - OpenMetrics text with timestamps (in seconds) terminated by # EOF
+func (hw *historicalWriter) writeOpenMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range hw.sortedSeries() {
+		series := formatSeries(s.name, s.labels)
+		for _, smp := range s.samples {
+			fmt.Fprintf(bw, "%s %s %d\n", series, formatValue(smp.value), smp.ts)
+		}
+	}
+	fmt.Fprintf(bw, "# EOF\n")
+	return bw.Flush()
+}
+
+type vmImportLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// writeVictoriaMetrics - JSON line per series with timestamps in milliseconds
+func (hw *historicalWriter) writeVictoriaMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, s := range hw.sortedSeries() {
+		l := vmImportLine{
+			Metric:     map[string]string{"__name__": s.name},
+			Values:     make([]float64, 0, len(s.samples)),
+			Timestamps: make([]int64, 0, len(s.samples)),
+		}
+		for _, lbl := range s.labels {
+			l.Metric[lbl.name] = lbl.value
+		}
+		for _, smp := range s.samples {
+			l.Values = append(l.Values, smp.value)
+			l.Timestamps = append(l.Timestamps, smp.ts*1000)
+		}
+		if err := enc.Encode(l); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (hw *historicalWriter) write(w io.Writer, format string) error {
+	switch format {
+	case formatOpenMetrics:
+		return hw.writeOpenMetrics(w)
+	case formatVictoriaMetrics:
+		return hw.writeVictoriaMetrics(w)
+	}
+	return fmt.Errorf("unknown historical output format '%s'", format)
+}
+
+// Sends all lines of a log file, which may be gzipped, to the lines channel
+func readLogFile(filename string, linesChan chan<- string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	scanner := bufio.NewScanner(r)
+	const maxCapacity = 5 * 1024 * 1024
+	buf := make([]byte, maxCapacity)
+	scanner.Buffer(buf, maxCapacity)
+	for scanner.Scan() {
+		linesChan <- scanner.Text()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+// runHistorical - processes the specified logs in order and writes the metrics to output ("-" for stdout)
+func runHistorical(logger *logrus.Logger, cfg *config.Config, logFiles []string, format string, output string, debug bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mp := metrics.NewP4DMetricsLogParser(newMetricsConfig(cfg, debug), logger, true)
+	linesChan := make(chan string, 10000)
+	_, metricsChan := mp.ProcessEvents(ctx, linesChan, false)
+
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(linesChan)
+		for _, f := range logFiles {
+			logger.Infof("Processing historical log: %s", f)
+			if err := readLogFile(f, linesChan); err != nil {
+				errChan <- err
+				return
+			}
+		}
+		errChan <- nil
+	}()
+
+	hw := newHistoricalWriter(logger, newAnonymiser(cfg))
+	for m := range metricsChan {
+		hw.add(m)
+	}
+	if err := <-errChan; err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := hw.write(w, format); err != nil {
+		return err
+	}
+	logger.Infof("Wrote %d series in %s format", len(hw.series), format)
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHistoricalLine(t *testing.T) {
+	name, labels, value, ts, err := parseHistoricalLine("p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1441207389")
+	assert.NoError(t, err)
+	assert.Equal(t, "p4_cmd_counter", name)
+	assert.Equal(t, []labelPair{{"serverid", "myserverid"}, {"cmd", "user-sync"}}, labels)
+	assert.Equal(t, 1.0, value)
+	assert.Equal(t, int64(1441207389), ts)
+
+	_, _, _, _, err = parseHistoricalLine("p4_cmd_counter;serverid 1 1441207389")
+	assert.Error(t, err)
+	_, _, _, _, err = parseHistoricalLine("p4_cmd_counter 1")
+	assert.Error(t, err)
+}
+
+func TestHistoricalWriter(t *testing.T) {
+	hw := newHistoricalWriter(logger, nil)
+	hw.add(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1441207389
+p4_cmd_running;serverid=myserverid 1 1441207389
+`)
+	hw.add(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 3 1441207404
+p4_cmd_running;serverid=myserverid 0 1441207404
+`)
+	var om strings.Builder
+	assert.NoError(t, hw.write(&om, formatOpenMetrics))
+	assert.Equal(t, `p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1 1441207389
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 3 1441207404
+p4_cmd_running{serverid="myserverid"} 1 1441207389
+p4_cmd_running{serverid="myserverid"} 0 1441207404
+# EOF
+`, om.String())
+
+	var vm strings.Builder
+	assert.NoError(t, hw.write(&vm, formatVictoriaMetrics))
+	assert.Equal(t, `{"metric":{"__name__":"p4_cmd_counter","cmd":"user-sync","serverid":"myserverid"},"values":[1,3],"timestamps":[1441207389000,1441207404000]}
+{"metric":{"__name__":"p4_cmd_running","serverid":"myserverid"},"values":[1,0],"timestamps":[1441207389000,1441207404000]}
+`, vm.String())
+
+	// Label values are escaped
+	hw = newHistoricalWriter(logger, nil)
+	hw.add(`p4_cmd_program_counter;serverid=myserverid;program=p4v/"quoted"\path 1 1441207389
+`)
+	om.Reset()
+	assert.NoError(t, hw.write(&om, formatOpenMetrics))
+	assert.Equal(t, `p4_cmd_program_counter{serverid="myserverid",program="p4v/\"quoted\"\\path"} 1 1441207389
+# EOF
+`, om.String())
+	name, labels, err := parseSeries(strings.Fields(om.String())[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "p4_cmd_program_counter", name)
+	assert.Equal(t, `p4v/"quoted"\path`, labels[1].value)
+}
+
+func TestRunHistorical(t *testing.T) {
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 compute end .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "log.gz")
+	f, err := os.Create(logFile)
+	assert.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(input))
+	gz.Close()
+	f.Close()
+
+	cfg := &config.Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Second,
+	}
+	output := filepath.Join(dir, "out.txt")
+	assert.NoError(t, runHistorical(logger, cfg, []string{logFile}, formatOpenMetrics, output, false))
+	buf, err := os.ReadFile(output)
+	assert.NoError(t, err)
+	result := string(buf)
+	assert.Contains(t, result, `p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1 1441207389`)
+	assert.True(t, strings.HasSuffix(result, "# EOF\n"))
+
+	assert.Error(t, runHistorical(logger, cfg, []string{filepath.Join(dir, "missing")}, formatOpenMetrics, output, false))
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// Inodes are not available on Windows - so rotation of the log is detected by size only
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,246 @@
+package main
+
+// Limits the number of distinct user and IP label values output, for servers with too many
+// users/clients to output all of them. Each update interval the values are ranked by activity
+// during the interval (command count or seconds), and only the top N are output.
+// The remainder are folded into a single "other" value.
+//
+// To keep counters monotonic, "other" accumulates the increase of each folded series since the
+// previous output, rather than their current values. So values which move into or out of the
+// top N do not cause "other" to go backwards.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/perforce/p4prometheus/config"
+)
+
+// Label value used for all values not in the top N
+const otherLabelValue = "other"
+
+// limitedLabel - the metric families containing a label to be limited
+type limitedLabel struct {
+	label           string
+	families        []string
+	countFamilies   []string // Used for ranking, in order of preference
+	secondsFamilies []string
+}
+
+var limitedLabels = []limitedLabel{
+	{
+		label: "user",
+		families: []string{"p4_cmd_user_counter", "p4_cmd_user_cumulative_seconds",
+			"p4_cmd_user_detail_counter", "p4_cmd_user_detail_cumulative_seconds"},
+		countFamilies:   []string{"p4_cmd_user_counter", "p4_cmd_user_detail_counter"},
+		secondsFamilies: []string{"p4_cmd_user_cumulative_seconds", "p4_cmd_user_detail_cumulative_seconds"},
+	},
+	{
+		label:           "ip",
+		families:        []string{"p4_cmd_ip_counter", "p4_cmd_ip_cumulative_seconds"},
+		countFamilies:   []string{"p4_cmd_ip_counter"},
+		secondsFamilies: []string{"p4_cmd_ip_cumulative_seconds"},
+	},
+}
+
+// labelLimiter - state is kept between outputs so must only be used from a single goroutine
+type labelLimiter struct {
+	config   *config.Config
+	previous map[string]float64            // Series value at previous output
+	other    map[string]map[string]float64 // Accumulated "other" series values by family
+	dropped  map[string]int                // Number of values folded into "other" at last output, by label
+}
+
+func newLabelLimiter(config *config.Config) *labelLimiter {
+	return &labelLimiter{
+		config:   config,
+		previous: make(map[string]float64),
+		other:    make(map[string]map[string]float64),
+		dropped:  make(map[string]int),
+	}
+}
+
+func (ll *labelLimiter) limit(label string) int {
+	switch label {
+	case "user":
+		return ll.config.UserLabelLimit
+	case "ip":
+		return ll.config.IPLabelLimit
+	}
+	return 0
+}
+
+// limitedSample - a sample line split into its parts
+type limitedSample struct {
+	series     string
+	labels     []labelPair
+	value      float64
+	labelValue string // Value of label being limited
+}
+
+func parseLimitedSamples(f *metricFamily, label string) []limitedSample {
+	result := make([]limitedSample, 0, len(f.samples))
+	for _, line := range f.samples {
+		series, v, err := parseSample(line)
+		if err != nil {
+			continue
+		}
+		_, labels, err := parseSeries(series)
+		if err != nil {
+			continue
+		}
+		s := limitedSample{series: series, labels: labels, value: v}
+		for _, l := range labels {
+			if l.name == label {
+				s.labelValue = l.value
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// increase - since the previous output, allowing for counter resets
+func (ll *labelLimiter) increase(s limitedSample) float64 {
+	prev, ok := ll.previous[s.series]
+	if !ok || s.value < prev {
+		return s.value
+	}
+	return s.value - prev
+}
+
+// topValues - returns the label values to be output, ranked by increase since the previous output,
+// then by total value, then name.
+func (ll *labelLimiter) topValues(mf *metricFamilies, ml limitedLabel, n int) map[string]bool {
+	rankFamilies := ml.countFamilies
+	if ll.config.LabelLimitRankBy == config.RankBySeconds {
+		rankFamilies = ml.secondsFamilies
+	}
+	increase := make(map[string]float64)
+	total := make(map[string]float64)
+	for _, name := range rankFamilies {
+		f, ok := mf.families[name]
+		if !ok {
+			continue
+		}
+		for _, s := range parseLimitedSamples(f, ml.label) {
+			increase[s.labelValue] += ll.increase(s)
+			total[s.labelValue] += s.value
+		}
+		break
+	}
+	// Values only present in other families are ranked last
+	for _, name := range ml.families {
+		if f, ok := mf.families[name]; ok {
+			for _, s := range parseLimitedSamples(f, ml.label) {
+				if _, ok := total[s.labelValue]; !ok {
+					increase[s.labelValue] = 0
+					total[s.labelValue] = 0
+				}
+			}
+		}
+	}
+	values := make([]string, 0, len(total))
+	for v := range total {
+		if v != otherLabelValue {
+			values = append(values, v)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		vi, vj := values[i], values[j]
+		if increase[vi] != increase[vj] {
+			return increase[vi] > increase[vj]
+		}
+		if total[vi] != total[vj] {
+			return total[vi] > total[vj]
+		}
+		return vi < vj
+	})
+	if len(values) > n {
+		values = values[:n]
+	}
+	result := make(map[string]bool, len(values))
+	for _, v := range values {
+		result[v] = true
+	}
+	return result
+}
+
+// apply - returns the metrics with limited labels folded into "other", plus the count of values dropped
+func (ll *labelLimiter) apply(metrics []byte) []byte {
+	if ll.config.UserLabelLimit == 0 && ll.config.IPLabelLimit == 0 {
+		return metrics
+	}
+	mf := newMetricFamilies()
+	mf.add(metrics)
+	for _, ml := range limitedLabels {
+		n := ll.limit(ml.label)
+		if n == 0 {
+			delete(ll.dropped, ml.label)
+			continue
+		}
+		top := ll.topValues(mf, ml, n)
+		dropped := make(map[string]bool)
+		for _, name := range ml.families {
+			f, ok := mf.families[name]
+			if !ok {
+				continue
+			}
+			if ll.other[name] == nil {
+				ll.other[name] = make(map[string]float64)
+			}
+			other := ll.other[name]
+			samples := make([]string, 0, n)
+			for _, s := range parseLimitedSamples(f, ml.label) {
+				inc := ll.increase(s)
+				ll.previous[s.series] = s.value
+				if top[s.labelValue] {
+					samples = append(samples, formatSample(s.series, s.value))
+					continue
+				}
+				dropped[s.labelValue] = true
+				labels := make([]labelPair, len(s.labels))
+				for i, l := range s.labels {
+					if l.name == ml.label {
+						l.value = otherLabelValue
+					}
+					labels[i] = l
+				}
+				other[formatSeries(name, labels)] += inc
+			}
+			otherSeries := make([]string, 0, len(other))
+			for series := range other {
+				otherSeries = append(otherSeries, series)
+			}
+			sort.Strings(otherSeries)
+			for _, series := range otherSeries {
+				samples = append(samples, formatSample(series, other[series]))
+			}
+			f.samples = samples
+		}
+		ll.dropped[ml.label] = len(dropped)
+	}
+	return append(mf.bytes(), ll.output()...)
+}
+
+// output - self metric reporting the number of label values dropped
+func (ll *labelLimiter) output() []byte {
+	buf := new(bytes.Buffer)
+	labels := make([]string, 0, len(ll.dropped))
+	for l := range ll.dropped {
+		labels = append(labels, l)
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	sort.Strings(labels)
+	fixed := []labelPair{{"serverid", ll.config.ServerID}, {"sdpinst", ll.config.SDPInstance}}
+	printHeader(buf, "p4prom_label_values_dropped",
+		fmt.Sprintf("The number of label values folded into '%s' by user_label_limit/ip_label_limit", otherLabelValue), "gauge")
+	for _, l := range labels {
+		printSample(buf, "p4prom_label_values_dropped", append(fixed, labelPair{"label", l}),
+			fmt.Sprintf("%d", ll.dropped[l]))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the sample lines for the named metric
+func samplesFor(metrics []byte, name string) []string {
+	result := make([]string, 0)
+	for _, line := range strings.Split(string(metrics), "\n") {
+		if strings.HasPrefix(line, name+"{") {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func userMetrics(counts map[string]int, seconds map[string]float64) []byte {
+	text := "# HELP p4_cmd_user_counter A count of completed p4 cmds (by user)\n# TYPE p4_cmd_user_counter counter\n"
+	for _, u := range []string{"alice", "bob", "carol", "dave"} {
+		if c, ok := counts[u]; ok {
+			text += formatSample(formatSeries("p4_cmd_user_counter", []labelPair{{"serverid", "master"}, {"user", u}}), float64(c)) + "\n"
+		}
+	}
+	text += "# HELP p4_cmd_user_cumulative_seconds The total in seconds (by user)\n# TYPE p4_cmd_user_cumulative_seconds counter\n"
+	for _, u := range []string{"alice", "bob", "carol", "dave"} {
+		if s, ok := seconds[u]; ok {
+			text += formatSample(formatSeries("p4_cmd_user_cumulative_seconds", []labelPair{{"serverid", "master"}, {"user", u}}), s) + "\n"
+		}
+	}
+	text += "# HELP p4_cmd_running The number of running commands\n# TYPE p4_cmd_running gauge\np4_cmd_running{serverid=\"master\"} 1\n"
+	return []byte(text)
+}
+
+func TestLabelLimiterDisabled(t *testing.T) {
+	ll := newLabelLimiter(&config.Config{})
+	metrics := userMetrics(map[string]int{"alice": 1, "bob": 2}, nil)
+	assert.Equal(t, metrics, ll.apply(metrics))
+}
+
+func TestLabelLimiter(t *testing.T) {
+	cfg := &config.Config{ServerID: "master", UserLabelLimit: 2, LabelLimitRankBy: config.RankByCount}
+	ll := newLabelLimiter(cfg)
+
+	output := ll.apply(userMetrics(
+		map[string]int{"alice": 10, "bob": 5, "carol": 1, "dave": 2},
+		map[string]float64{"alice": 1, "bob": 20, "carol": 3, "dave": 0.5}))
+	assert.Equal(t, []string{
+		`p4_cmd_user_counter{serverid="master",user="alice"} 10`,
+		`p4_cmd_user_counter{serverid="master",user="bob"} 5`,
+		`p4_cmd_user_counter{serverid="master",user="other"} 3`,
+	}, samplesFor(output, "p4_cmd_user_counter"))
+	assert.Equal(t, []string{
+		`p4_cmd_user_cumulative_seconds{serverid="master",user="alice"} 1`,
+		`p4_cmd_user_cumulative_seconds{serverid="master",user="bob"} 20`,
+		`p4_cmd_user_cumulative_seconds{serverid="master",user="other"} 3.5`,
+	}, samplesFor(output, "p4_cmd_user_cumulative_seconds"))
+	assert.Equal(t, []string{`p4_cmd_running{serverid="master"} 1`}, samplesFor(output, "p4_cmd_running"))
+	assert.Equal(t, []string{`p4prom_label_values_dropped{serverid="master",label="user"} 2`},
+		samplesFor(output, "p4prom_label_values_dropped"))
+	assert.Contains(t, string(output), "# TYPE p4_cmd_user_counter counter\n")
+
+	// Carol and dave are now most active in this interval, so replace alice and bob.
+	// Other only increases by the activity of those folded into it.
+	output = ll.apply(userMetrics(
+		map[string]int{"alice": 11, "bob": 5, "carol": 21, "dave": 12},
+		map[string]float64{"alice": 1, "bob": 20, "carol": 3, "dave": 0.5}))
+	assert.Equal(t, []string{
+		`p4_cmd_user_counter{serverid="master",user="carol"} 21`,
+		`p4_cmd_user_counter{serverid="master",user="dave"} 12`,
+		`p4_cmd_user_counter{serverid="master",user="other"} 4`,
+	}, samplesFor(output, "p4_cmd_user_counter"))
+
+	// Ranking by seconds, with no activity so ranked by total
+	cfg.LabelLimitRankBy = config.RankBySeconds
+	cfg.UserLabelLimit = 1
+	output = ll.apply(userMetrics(
+		map[string]int{"alice": 11, "bob": 5, "carol": 21, "dave": 12},
+		map[string]float64{"alice": 1, "bob": 20, "carol": 3, "dave": 0.5}))
+	assert.Equal(t, []string{
+		`p4_cmd_user_counter{serverid="master",user="bob"} 5`,
+		`p4_cmd_user_counter{serverid="master",user="other"} 4`,
+	}, samplesFor(output, "p4_cmd_user_counter"))
+	assert.Equal(t, []string{`p4prom_label_values_dropped{serverid="master",label="user"} 3`},
+		samplesFor(output, "p4prom_label_values_dropped"))
+
+	// Removing the limit
+	cfg.UserLabelLimit = 0
+	output = ll.apply(userMetrics(map[string]int{"alice": 11}, nil))
+	assert.Equal(t, []string{`p4_cmd_user_counter{serverid="master",user="alice"} 11`}, samplesFor(output, "p4_cmd_user_counter"))
+	assert.Empty(t, samplesFor(output, "p4prom_label_values_dropped"))
+}
+
+func TestLabelLimiterDetail(t *testing.T) {
+	cfg := &config.Config{ServerID: "master", IPLabelLimit: 1, UserLabelLimit: 1, LabelLimitRankBy: config.RankByCount}
+	ll := newLabelLimiter(cfg)
+	output := ll.apply([]byte(`# HELP p4_cmd_user_detail_counter A count of completed p4 cmds (by user and cmd)
+# TYPE p4_cmd_user_detail_counter counter
+p4_cmd_user_detail_counter{serverid="master",user="alice",cmd="user-sync"} 3
+p4_cmd_user_detail_counter{serverid="master",user="bob",cmd="user-sync"} 1
+p4_cmd_user_detail_counter{serverid="master",user="carol",cmd="user-sync"} 1
+p4_cmd_user_detail_counter{serverid="master",user="carol",cmd="user-edit"} 1
+# HELP p4_cmd_ip_counter A count of completed p4 cmds (by IP)
+# TYPE p4_cmd_ip_counter counter
+p4_cmd_ip_counter{serverid="master",ip="10.1.2.3"} 1
+p4_cmd_ip_counter{serverid="master",ip="10.1.2.4"} 2
+`))
+	assert.Equal(t, []string{
+		`p4_cmd_user_detail_counter{serverid="master",user="alice",cmd="user-sync"} 3`,
+		`p4_cmd_user_detail_counter{serverid="master",user="other",cmd="user-edit"} 1`,
+		`p4_cmd_user_detail_counter{serverid="master",user="other",cmd="user-sync"} 2`,
+	}, samplesFor(output, "p4_cmd_user_detail_counter"))
+	assert.Equal(t, []string{
+		`p4_cmd_ip_counter{serverid="master",ip="10.1.2.4"} 2`,
+		`p4_cmd_ip_counter{serverid="master",ip="other"} 1`,
+	}, samplesFor(output, "p4_cmd_ip_counter"))
+	assert.Equal(t, []string{
+		`p4prom_label_values_dropped{serverid="master",label="ip"} 1`,
+		`p4prom_label_values_dropped{serverid="master",label="user"} 2`,
+	}, samplesFor(output, "p4prom_label_values_dropped"))
+}
@@ -0,0 +1,215 @@
+package main
+
+// Simple handling of metrics in Prometheus text exposition format as output by the log parser,
+// so that the text can be merged, adjusted or filtered before being output.
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+// metricFamily - the HELP/TYPE header lines and sample lines for a single metric name
+type metricFamily struct {
+	name    string
+	help    string
+	mtype   string
+	samples []string
+}
+
+// metricFamilies - families in the order first seen
+type metricFamilies struct {
+	order    []string
+	families map[string]*metricFamily
+}
+
+func newMetricFamilies() *metricFamilies {
+	return &metricFamilies{
+		order:    make([]string, 0),
+		families: make(map[string]*metricFamily),
+	}
+}
+
+func (mf *metricFamilies) get(name string) *metricFamily {
+	f, ok := mf.families[name]
+	if !ok {
+		f = &metricFamily{name: name}
+		mf.families[name] = f
+		mf.order = append(mf.order, name)
+	}
+	return f
+}
+
+// Returns the metric family name for a sample line, allowing for histogram/summary suffixes
+func (mf *metricFamilies) familyName(line string) string {
+	name, _ := splitSample(line)
+	if i := strings.Index(name, "{"); i >= 0 {
+		name = name[:i]
+	}
+	if _, ok := mf.families[name]; !ok {
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); base != name {
+				if _, ok := mf.families[base]; ok {
+					return base
+				}
+			}
+		}
+	}
+	return name
+}
+
+// add - parses the text and adds its families/samples. HELP/TYPE lines are only recorded once per family.
+func (mf *metricFamilies) add(text []byte) {
+	for _, line := range strings.Split(string(text), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			f := mf.get(fields[2])
+			if fields[1] == "HELP" && f.help == "" {
+				f.help = line
+			} else if fields[1] == "TYPE" && f.mtype == "" {
+				f.mtype = line
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := mf.get(mf.familyName(line))
+		f.samples = append(f.samples, line)
+	}
+}
+
+// Returns the metric type from the TYPE line, e.g. counter or gauge
+func (f *metricFamily) metricType() string {
+	fields := strings.Fields(f.mtype)
+	if len(fields) < 4 {
+		return ""
+	}
+	return fields[3]
+}
+
+// bytes - returns the families in text format
+func (mf *metricFamilies) bytes() []byte {
+	var buf bytes.Buffer
+	for _, name := range mf.order {
+		f := mf.families[name]
+		if len(f.samples) == 0 {
+			continue
+		}
+		for _, l := range []string{f.help, f.mtype} {
+			if l != "" {
+				buf.WriteString(l + "\n")
+			}
+		}
+		for _, l := range f.samples {
+			buf.WriteString(l + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// splitSample - splits a sample line into series (name and labels) and value
+func splitSample(line string) (series string, value string) {
+	i := strings.LastIndex(line, " ")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], line[i+1:]
+}
+
+// parseSample - as splitSample but returning value as a float
+func parseSample(line string) (series string, value float64, err error) {
+	series, v := splitSample(line)
+	value, err = strconv.ParseFloat(v, 64)
+	return series, value, err
+}
+
+// parseSeries - splits a series, e.g. name{label1="val1",label2="val2"}, into name and labels
+func parseSeries(series string) (name string, labels []labelPair, err error) {
+	i := strings.Index(series, "{")
+	if i < 0 {
+		return series, nil, nil
+	}
+	name = series[:i]
+	rest := series[i+1:]
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if strings.HasPrefix(rest, "}") {
+			return name, labels, nil
+		}
+		eq := strings.Index(rest, "=\"")
+		if eq <= 0 {
+			return "", nil, fmt.Errorf("invalid labels in series: '%s'", series)
+		}
+		lname := rest[:eq]
+		rest = rest[eq+2:]
+		var val strings.Builder
+		closed := false
+		for j := 0; j < len(rest); j++ {
+			c := rest[j]
+			if c == '\\' && j+1 < len(rest) {
+				j++
+				switch rest[j] {
+				case 'n':
+					val.WriteByte('\n')
+				default:
+					val.WriteByte(rest[j])
+				}
+				continue
+			}
+			if c == '"' {
+				rest = rest[j+1:]
+				closed = true
+				break
+			}
+			val.WriteByte(c)
+		}
+		if !closed {
+			return "", nil, fmt.Errorf("invalid labels in series: '%s'", series)
+		}
+		labels = append(labels, labelPair{lname, val.String()})
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatSeries - the reverse of parseSeries
+func formatSeries(name string, labels []labelPair) string {
+	if len(labels) == 0 {
+		return name
+	}
+	vals := make([]string, 0, len(labels))
+	for _, l := range labels {
+		vals = append(vals, fmt.Sprintf("%s=\"%s\"", l.name, labelValueEscaper.Replace(l.value)))
+	}
+	return name + "{" + strings.Join(vals, ",") + "}"
+}
+
+func formatSample(series string, value float64) string {
+	return series + " " + strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// mergeMetrics - combines several text format snapshots (one per instance) so that each metric
+// family appears once with a single HELP/TYPE header, as required by Prometheus.
+func mergeMetrics(blobs [][]byte) []byte {
+	if len(blobs) == 1 {
+		return blobs[0]
+	}
+	mf := newMetricFamilies()
+	for _, b := range blobs {
+		mf.add(b)
+	}
+	return mf.bytes()
+}
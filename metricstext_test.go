@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeMetrics(t *testing.T) {
+	blob1 := `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="master",cmd="sync"} 1
+# HELP p4_cmd_running The number of running commands
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="master"} 1
+`
+	blob2 := `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="edge",cmd="sync"} 2
+`
+	expected := `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="master",cmd="sync"} 1
+p4_cmd_counter{serverid="edge",cmd="sync"} 2
+# HELP p4_cmd_running The number of running commands
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="master"} 1
+`
+	assert.Equal(t, expected, string(mergeMetrics([][]byte{[]byte(blob1), []byte(blob2)})))
+	assert.Equal(t, blob2, string(mergeMetrics([][]byte{[]byte(blob2)})))
+}
+
+func TestParseSeries(t *testing.T) {
+	name, labels, err := parseSeries(`p4_cmd_counter{serverid="master",cmd="user-sync"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "p4_cmd_counter", name)
+	assert.Equal(t, []labelPair{{"serverid", "master"}, {"cmd", "user-sync"}}, labels)
+
+	name, labels, err = parseSeries(`p4_cmd_running`)
+	assert.NoError(t, err)
+	assert.Equal(t, "p4_cmd_running", name)
+	assert.Empty(t, labels)
+
+	_, labels, err = parseSeries(`p4_test{a="x\\y",b="say \"hi\", ok",c=""}`)
+	assert.NoError(t, err)
+	assert.Equal(t, []labelPair{{"a", `x\y`}, {"b", `say "hi", ok`}, {"c", ""}}, labels)
+
+	_, _, err = parseSeries(`p4_test{a="x"`)
+	assert.Error(t, err)
+	_, _, err = parseSeries(`p4_test{a=x}`)
+	assert.Error(t, err)
+}
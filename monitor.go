@@ -0,0 +1,314 @@
+package main
+
+// The monitor command - a port of scripts/monitor_metrics.sh. It runs p4 commands (and reads
+// SDP log files etc) to collect metrics about the server which are not available from the log,
+// e.g. uptime, license and replication status. Each collector writes its own file, named as per
+// the script, for node_exporter's textfile collector.
+//
+// Run it once per minute from cron, or set an interval to run it continuously.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/perforce/p4prometheus/p4cmd"
+	"github.com/sirupsen/logrus"
+)
+
+// SDP file locations - variables for testing
+var (
+	sdpVars        = "/p4/common/bin/p4_vars"
+	sdpVersionFile = "/p4/sdp/Version"
+)
+
+// monitor - state for a single run of all collectors
+type monitor struct {
+	config     *config.Config
+	logger     *logrus.Logger
+	runner     p4cmd.Runner
+	env        map[string]string // SDP environment (as set by p4_vars)
+	info       map[string]string // Output of p4 info -s
+	serverID   string
+	metricsDir string
+	procDir    string // For counting p4d processes
+	now        func() time.Time
+	diskSpace  func(path string) (free uint64, total uint64, err error)
+}
+
+// monitorCollector - writes its metrics to <metrics_dir>/<file>[-<sdpinst>]-<serverid>.prom
+// Returning nil metrics leaves any existing file unchanged (e.g. not applicable for this server).
+type monitorCollector struct {
+	name    string
+	file    string
+	collect func(m *monitor) ([]byte, error)
+}
+
+var monitorCollectors = []monitorCollector{
+	{"uptime", "p4_uptime", (*monitor).collectUptime},
+	{"change", "p4_change", (*monitor).collectChange},
+	{"processes", "p4_monitor", (*monitor).collectProcesses},
+	{"commands", "p4_monitor_commands", (*monitor).collectCommands},
+	{"replication", "p4_replication", (*monitor).collectReplication},
+	{"pull", "p4_pull", (*monitor).collectPull},
+	{"realtime", "p4_realtime", (*monitor).collectRealtime},
+	{"license", "p4_license", (*monitor).collectLicense},
+	{"filesys", "p4_filesys", (*monitor).collectFilesys},
+	{"versions", "p4_version_info", (*monitor).collectVersions},
+	{"ssl", "p4_ssl_info", (*monitor).collectSSL},
+	{"checkpoint", "p4_checkpoint", (*monitor).collectCheckpoint},
+	{"errors", "p4_errors", (*monitor).collectErrors},
+	{"locks", "p4_locks", (*monitor).collectLocks},
+}
+
+func newMonitor(cfg *config.Config, logger *logrus.Logger, runner p4cmd.Runner) *monitor {
+	return &monitor{
+		config:     cfg,
+		logger:     logger,
+		runner:     runner,
+		env:        make(map[string]string),
+		info:       make(map[string]string),
+		metricsDir: cfg.Monitor.MetricsDir,
+		procDir:    "/proc",
+		now:        time.Now,
+		diskSpace:  diskSpace,
+	}
+}
+
+// parseEnv - parses the output of env, i.e. NAME=value lines
+func parseEnv(buf []byte) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			result[line[:i]] = line[i+1:]
+		}
+	}
+	return result
+}
+
+// loadSDPEnv - sources p4_vars for the instance to get P4PORT, P4USER, LOGS etc
+func loadSDPEnv(runner p4cmd.Runner, instance string) (map[string]string, error) {
+	out, err := runner.Run("/bin/bash", "-c", fmt.Sprintf("source %s %s > /dev/null 2>&1 && env", sdpVars, instance))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SDP environment: %v", err)
+	}
+	return parseEnv(out), nil
+}
+
+// parseInfo - parses the "Name: value" lines output by p4 info -s
+func parseInfo(buf []byte) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if i := strings.Index(line, ": "); i > 0 {
+			result[line[:i]] = strings.TrimSpace(line[i+2:])
+		}
+	}
+	return result
+}
+
+func (m *monitor) useSDP() bool {
+	return m.config.SDPInstance != ""
+}
+
+// p4 - runs p4 with the configured user and port
+func (m *monitor) p4(args ...string) ([]byte, error) {
+	p4bin := m.config.Monitor.P4Bin
+	if v := m.env["P4BIN"]; v != "" && m.useSDP() {
+		p4bin = v
+	}
+	p4 := &p4cmd.P4{Runner: m.runner, P4Bin: p4bin, Port: m.p4port(), User: m.p4user()}
+	return p4.Run(args...)
+}
+
+// p4ztag - runs p4 -ztag returning the records output
+func (m *monitor) p4ztag(args ...string) ([]p4cmd.Record, error) {
+	out, err := m.p4(append([]string{"-ztag"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return p4cmd.ParseZtag(out), nil
+}
+
+func (m *monitor) p4port() string {
+	if m.config.Monitor.P4Port != "" {
+		return m.config.Monitor.P4Port
+	}
+	return m.env["P4PORT"]
+}
+
+func (m *monitor) p4user() string {
+	if m.config.Monitor.P4User != "" {
+		return m.config.Monitor.P4User
+	}
+	return m.env["P4USER"]
+}
+
+// init - connects to the server and determines the server id. Errors here are fatal.
+func (m *monitor) init() error {
+	if _, err := os.Stat(m.metricsDir); err != nil {
+		return fmt.Errorf("metrics_dir: %v", err)
+	}
+	out, err := m.p4("info", "-s")
+	if err != nil {
+		return fmt.Errorf("can't connect to P4PORT %s: %v", m.p4port(), err)
+	}
+	m.info = parseInfo(out)
+	m.serverID = m.config.ServerID
+	if m.serverID == "" {
+		m.serverID = m.readServerID()
+	}
+	return nil
+}
+
+// readServerID - as per readServerID, but allowing for non SDP installations. Only the first line
+// of server.id is used, as after a 'p4 failover' the file contains a second line.
+func (m *monitor) readServerID() string {
+	if root := m.env["P4ROOT"]; root != "" {
+		if buf, err := ioutil.ReadFile(filepath.Join(root, "server.id")); err == nil {
+			if id := strings.TrimSpace(strings.SplitN(string(buf), "\n", 2)[0]); id != "" {
+				return id
+			}
+		}
+	}
+	if id := m.info["ServerID"]; id != "" {
+		return id
+	}
+	return "UnsetServerID"
+}
+
+// sample - prints a sample with the serverid/sdpinst labels. Unlike the log parser, label
+// values are escaped rather than sanitised, so that e.g. license info is output as is.
+func (m *monitor) sample(buf *bytes.Buffer, name string, value string, extra ...labelPair) {
+	labels := make([]labelPair, 0, 2+len(extra))
+	for _, l := range append([]labelPair{{"serverid", m.serverID}, {"sdpinst", m.config.SDPInstance}}, extra...) {
+		if l.value != "" {
+			labels = append(labels, l)
+		}
+	}
+	fmt.Fprintf(buf, "%s %s\n", formatSeries(name, labels), value)
+}
+
+func (m *monitor) outputPath(file string) string {
+	return m.instancePath(file) + ".prom"
+}
+
+// instancePath - file in metrics_dir named for this instance and serverid, so that several instances
+// can share the directory
+func (m *monitor) instancePath(file string) string {
+	name := file
+	if m.useSDP() {
+		name += "-" + m.config.SDPInstance
+	}
+	return filepath.Join(m.metricsDir, fmt.Sprintf("%s-%s", name, m.serverID))
+}
+
+// cachedP4 - returns the output of the p4 commands, only re-running them if the cached output
+// in cacheFile is older than maxAge, e.g. for commands whose results rarely change
+func (m *monitor) cachedP4(cacheFile string, maxAge time.Duration, cmds ...[]string) ([]byte, error) {
+	if st, err := os.Stat(cacheFile); err == nil && m.now().Sub(st.ModTime()) < maxAge {
+		return ioutil.ReadFile(cacheFile)
+	}
+	var buf bytes.Buffer
+	for _, args := range cmds {
+		out, err := m.p4(args...)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(out)
+	}
+	if err := ioutil.WriteFile(cacheFile, buf.Bytes(), 0644); err != nil {
+		m.logger.Warnf("Error writing %s: %v", cacheFile, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// runCollectors - runs the configured collectors once. Errors for individual collectors are logged,
+// so that one failing does not prevent output of the others, and the number of failures returned.
+func (m *monitor) runCollectors() int {
+	enabled := make(map[string]bool)
+	for _, name := range m.config.Monitor.Collectors {
+		enabled[name] = true
+	}
+	failures := 0
+	for _, c := range monitorCollectors {
+		if !enabled[c.name] {
+			continue
+		}
+		metrics, err := c.collect(m)
+		if err != nil {
+			m.logger.Errorf("Monitor %s: %v", c.name, err)
+			failures++
+			continue
+		}
+		if metrics == nil {
+			continue
+		}
+		sink := &textfileSink{sinkName: c.name, path: m.outputPath(c.file), logger: m.logger}
+		if err := sink.write(metrics); err != nil {
+			m.logger.Errorf("Monitor %s: %v", c.name, err)
+			failures++
+		}
+	}
+	return failures
+}
+
+// runMonitor - runs the collectors once, or every interval until the context is cancelled
+func runMonitor(ctx context.Context, logger *logrus.Logger, cfg *config.Config) error {
+	runner := &p4cmd.ExecRunner{Env: os.Environ(), Timeout: cfg.Monitor.CmdTimeout()}
+	env := make(map[string]string)
+	if cfg.SDPInstance != "" {
+		var err error
+		if env, err = loadSDPEnv(runner, cfg.SDPInstance); err != nil {
+			return err
+		}
+		runner.Env = make([]string, 0, len(env))
+		for k, v := range env {
+			runner.Env = append(runner.Env, k+"="+v)
+		}
+	}
+	if cfg.Monitor.P4Tickets != "" {
+		runner.Env = append(runner.Env, "P4TICKETS="+cfg.Monitor.P4Tickets)
+	}
+	for {
+		m := newMonitor(cfg, logger, runner)
+		m.env = env
+		if err := m.init(); err != nil {
+			if cfg.Monitor.Interval == 0 {
+				return err
+			}
+			logger.Errorf("Monitor: %v", err)
+		} else if failures := m.runCollectors(); failures > 0 && cfg.Monitor.Interval == 0 {
+			return fmt.Errorf("%d collector(s) failed", failures)
+		}
+		if cfg.Monitor.Interval == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.Monitor.Interval):
+		}
+	}
+}
+
+// readLines - returns the lines of the file, for small files
+func readLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
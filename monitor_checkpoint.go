@@ -0,0 +1,219 @@
+package main
+
+// Checkpoint and journal rotation metrics for the monitor command, from the logs written by the SDP
+// scripts. Each run of daily_checkpoint.sh, live_checkpoint.sh or rotate_journal.sh writes a new
+// checkpoint.log (the previous ones being renamed), e.g.
+//
+//	Tue Mar 15 02:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_1 Checkpoint
+//	Tue Mar 15 02:00:02 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Rotating journal
+//	Tue Mar 15 02:10:31 UTC 2022 /p4/common/bin/daily_checkpoint.sh: End p4_1 Checkpoint
+//
+// A run which fails logs an "ERROR!!!" line (from die() in backup_functions.sh) and has no End line.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of p4_sdp_checkpoint_status
+const (
+	checkpointSuccess = 0
+	checkpointFailed  = 1
+	checkpointRunning = 2
+)
+
+// parseSDPLogTime - SDP log lines start with the output of date, e.g.
+//
+//	Wed Mar 16 02:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_1 Checkpoint
+func parseSDPLogTime(line string) (time.Time, error) {
+	dt := line
+	if i := strings.Index(line, "/p4"); i >= 0 {
+		dt = line[:i]
+	}
+	return time.ParseInLocation("Mon Jan _2 15:04:05 MST 2006", strings.TrimSpace(dt), time.Local)
+}
+
+// sdpLogScript - the script which wrote the line, e.g. daily_checkpoint.sh
+func sdpLogScript(line string) string {
+	i := strings.Index(line, "/p4")
+	if i < 0 {
+		return ""
+	}
+	j := strings.Index(line[i:], ": ")
+	if j < 0 {
+		return ""
+	}
+	return filepath.Base(line[i : i+j])
+}
+
+// checkpointRun - a run of an SDP script as recorded in a single checkpoint.log
+type checkpointRun struct {
+	path       string
+	modTime    time.Time
+	script     string
+	checkpoint bool // False for journal rotation only
+	ended      bool // False if no End line, e.g. failed or still running
+	start, end time.Time
+	rotated    time.Time // When the journal was rotated, if it was
+	errors     int       // ERROR!!! lines
+}
+
+// parseCheckpointLog - returns nil if the log is not from a checkpoint or journal rotation
+func parseCheckpointLog(lines []string, instance string) *checkpointRun {
+	startCkp := fmt.Sprintf("Start p4_%s Checkpoint", instance)
+	endCkp := fmt.Sprintf("End p4_%s Checkpoint", instance)
+	startRotation := fmt.Sprintf("Start p4_%s journal rotation", instance)
+	endRotation := fmt.Sprintf("End p4_%s journal rotation", instance)
+	var run *checkpointRun
+	for _, line := range lines {
+		isStartCkp := strings.Contains(line, startCkp)
+		if run == nil {
+			if isStartCkp || strings.Contains(line, startRotation) {
+				run = &checkpointRun{script: sdpLogScript(line), checkpoint: isStartCkp}
+				run.start, _ = parseSDPLogTime(line)
+			}
+			continue
+		}
+		switch {
+		case isStartCkp:
+			// A second start is not expected, so this log can't be relied on
+			return nil
+		case strings.Contains(line, endCkp):
+			run.ended = true
+			run.end, _ = parseSDPLogTime(line)
+		case strings.Contains(line, endRotation):
+			run.ended = true
+			run.end, _ = parseSDPLogTime(line)
+			run.rotated = run.end
+		case strings.Contains(line, "Rotating journal"):
+			run.rotated, _ = parseSDPLogTime(line)
+		case strings.Contains(line, "ERROR!!!"):
+			run.errors++
+		}
+	}
+	return run
+}
+
+// status - a run with no End line has failed unless its script is still running
+func (r *checkpointRun) status(procDir string) int {
+	switch {
+	case r.errors > 0:
+		return checkpointFailed
+	case r.ended:
+		return checkpointSuccess
+	case r.script != "" && countProcesses(procDir, r.script) > 0:
+		return checkpointRunning
+	}
+	return checkpointFailed
+}
+
+// checkpointRuns - runs from all checkpoint logs, latest first
+func (m *monitor) checkpointRuns() ([]*checkpointRun, error) {
+	files, err := filepath.Glob(filepath.Join(m.sdpLogsDir(), "checkpoint.log*"))
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]*checkpointRun, 0, len(files))
+	for _, f := range files {
+		st, err := os.Stat(f)
+		if err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		lines, err := readLines(f)
+		if err != nil {
+			m.logger.Warnf("Monitor checkpoint: %v", err)
+			continue
+		}
+		if run := parseCheckpointLog(lines, m.config.SDPInstance); run != nil {
+			run.path = f
+			run.modTime = st.ModTime()
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].modTime.After(runs[j].modTime) })
+	return runs, nil
+}
+
+// latestCheckpointFile - the most recent checkpoint, e.g. /p4/1/checkpoints/p4_1.ckp.1234.gz
+func (m *monitor) latestCheckpointFile() os.FileInfo {
+	dir := m.env["CHECKPOINTS"]
+	if dir == "" {
+		dir = fmt.Sprintf("/p4/%s/checkpoints", m.config.SDPInstance)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ckp.*"))
+	var latest os.FileInfo
+	for _, f := range files {
+		if strings.HasSuffix(f, ".md5") {
+			continue
+		}
+		if st, err := os.Stat(f); err == nil && st.Mode().IsRegular() && (latest == nil || st.ModTime().After(latest.ModTime())) {
+			latest = st
+		}
+	}
+	return latest
+}
+
+// collectCheckpoint - when the last SDP checkpoint ran, how long it took and whether it succeeded,
+// together with the time of the last journal rotation and the size of the latest checkpoint.
+// The time and duration are from the latest successful checkpoint, ignoring any in progress
+// and logs from rotate_journal.sh.
+func (m *monitor) collectCheckpoint() ([]byte, error) {
+	if !m.useSDP() {
+		return nil, nil
+	}
+	runs, err := m.checkpointRuns()
+	if err != nil {
+		return nil, err
+	}
+	var lastSuccess, lastAttempt *checkpointRun
+	var rotated time.Time
+	for _, r := range runs {
+		if r.checkpoint && lastAttempt == nil {
+			lastAttempt = r
+		}
+		if r.checkpoint && lastSuccess == nil && r.status(m.procDir) == checkpointSuccess {
+			lastSuccess = r
+		}
+		if r.errors == 0 && r.rotated.After(rotated) {
+			rotated = r.rotated
+		}
+	}
+	var ckpTime, ckpDuration, ckpEnd int64
+	if lastSuccess != nil {
+		ckpTime = lastSuccess.modTime.Unix()
+		ckpEnd = lastSuccess.end.Unix()
+		if lastSuccess.start.IsZero() || lastSuccess.end.IsZero() {
+			m.logger.Warnf("Monitor checkpoint: %s: invalid start/end time", lastSuccess.path)
+			ckpEnd = ckpTime
+		} else {
+			ckpDuration = int64(lastSuccess.end.Sub(lastSuccess.start).Seconds())
+		}
+	}
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_sdp_checkpoint_log_time", "Time of last checkpoint log", "gauge")
+	m.sample(buf, "p4_sdp_checkpoint_log_time", strconv.FormatInt(ckpTime, 10))
+	printHeader(buf, "p4_sdp_checkpoint_duration", "Time taken for last checkpoint/restore action", "gauge")
+	m.sample(buf, "p4_sdp_checkpoint_duration", strconv.FormatInt(ckpDuration, 10))
+	printHeader(buf, "p4_sdp_checkpoint_last_success_time", "Time last successful checkpoint completed (epoch secs)", "gauge")
+	m.sample(buf, "p4_sdp_checkpoint_last_success_time", strconv.FormatInt(ckpEnd, 10))
+	if lastAttempt != nil {
+		printHeader(buf, "p4_sdp_checkpoint_status", "Status of latest checkpoint: 0 success, 1 failed, 2 running", "gauge")
+		m.sample(buf, "p4_sdp_checkpoint_status", strconv.Itoa(lastAttempt.status(m.procDir)),
+			labelPair{"script", lastAttempt.script})
+	}
+	if !rotated.IsZero() {
+		printHeader(buf, "p4_sdp_journal_rotation_time", "Time of last successful journal rotation (epoch secs)", "gauge")
+		m.sample(buf, "p4_sdp_journal_rotation_time", strconv.FormatInt(rotated.Unix(), 10))
+	}
+	if st := m.latestCheckpointFile(); st != nil {
+		printHeader(buf, "p4_sdp_checkpoint_size_bytes", "Size of latest checkpoint file", "gauge")
+		m.sample(buf, "p4_sdp_checkpoint_size_bytes", strconv.FormatInt(st.Size(), 10))
+	}
+	return buf.Bytes(), nil
+}
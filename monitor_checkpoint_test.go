@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCheckpointLog(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		log      string
+		expected *checkpointRun
+	}{
+		{"success", `Tue Mar 15 02:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_1 Checkpoint
+Tue Mar 15 02:00:02 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Rotating journal
+Tue Mar 15 02:10:31 UTC 2022 /p4/common/bin/daily_checkpoint.sh: End p4_1 Checkpoint`,
+			&checkpointRun{script: "daily_checkpoint.sh", checkpoint: true, ended: true, start: time.Unix(1647309601, 0),
+				end: time.Unix(1647310231, 0), rotated: time.Unix(1647309602, 0)}},
+		{"failed", `Tue Mar 15 02:00:01 UTC 2022 /p4/common/bin/live_checkpoint.sh: Start p4_1 Checkpoint
+Tue Mar 15 02:00:03 UTC 2022 /p4/common/bin/live_checkpoint.sh: ERROR!!! - myhost p4_1 /p4/common/bin/live_checkpoint.sh: Checkpoint failed`,
+			&checkpointRun{script: "live_checkpoint.sh", checkpoint: true, start: time.Unix(1647309601, 0), errors: 1}},
+		{"rotation", `Wed Mar 16 12:00:01 UTC 2022 /p4/common/bin/rotate_journal.sh: Start p4_1 journal rotation
+Wed Mar 16 12:00:05 UTC 2022 /p4/common/bin/rotate_journal.sh: End p4_1 journal rotation`,
+			&checkpointRun{script: "rotate_journal.sh", ended: true, start: time.Unix(1647432001, 0),
+				end: time.Unix(1647432005, 0), rotated: time.Unix(1647432005, 0)}},
+		{"other instance", `Tue Mar 15 02:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_2 Checkpoint`, nil},
+		{"two starts", `Tue Mar 15 02:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_1 Checkpoint
+Tue Mar 15 03:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_1 Checkpoint`, nil},
+	} {
+		run := parseCheckpointLog(strings.Split(tc.log, "\n"), "1")
+		if tc.expected == nil {
+			assert.Nil(t, run, tc.name)
+			continue
+		}
+		if assert.NotNil(t, run, tc.name) {
+			for _, tm := range []*time.Time{&run.start, &run.end, &run.rotated} {
+				if !tm.IsZero() {
+					*tm = time.Unix(tm.Unix(), 0)
+				}
+			}
+			assert.Equal(t, tc.expected, run, tc.name)
+		}
+	}
+}
+
+func TestMonitorCheckpoint(t *testing.T) {
+	m, _ := newTestMonitor(t, "1", nil)
+	m.serverID = "master"
+	logs := t.TempDir()
+	m.env["LOGS"] = logs
+	writeFile := func(dir, name string, content string, modTime time.Time) {
+		f := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(f, []byte(content), 0644))
+		assert.NoError(t, os.Chtimes(f, modTime, modTime))
+	}
+	// Latest log is from rotate_journal.sh, and the one before is in progress
+	writeFile(logs, "checkpoint.log", `Wed Mar 16 12:00:01 UTC 2022 /p4/common/bin/rotate_journal.sh: Start p4_1 journal rotation
+Wed Mar 16 12:00:05 UTC 2022 /p4/common/bin/rotate_journal.sh: End p4_1 journal rotation
+`, time.Unix(1647432005, 0))
+	writeFile(logs, "checkpoint.log.1", "Wed Mar 16 02:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_1 Checkpoint\n",
+		time.Unix(1647396001, 0))
+	writeFile(logs, "checkpoint.log.2", `Tue Mar 15 02:00:01 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Start p4_1 Checkpoint
+Tue Mar 15 02:00:02 UTC 2022 /p4/common/bin/daily_checkpoint.sh: Rotating journal
+Tue Mar 15 02:10:31 UTC 2022 /p4/common/bin/daily_checkpoint.sh: End p4_1 Checkpoint
+`, time.Unix(1647310231, 0))
+	ckps := t.TempDir()
+	m.env["CHECKPOINTS"] = ckps
+	writeFile(ckps, "p4_1.ckp.11.gz", strings.Repeat("x", 50), time.Unix(1647223831, 0))
+	writeFile(ckps, "p4_1.ckp.12.gz", strings.Repeat("x", 100), time.Unix(1647310231, 0))
+	writeFile(ckps, "p4_1.ckp.12.gz.md5", "md5", time.Unix(1647310232, 0))
+	procDir := filepath.Join(m.procDir, "1234")
+	assert.NoError(t, os.Mkdir(procDir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "cmdline"),
+		[]byte("/bin/bash\x00/p4/common/bin/daily_checkpoint.sh\x001\x00"), 0644))
+
+	out, err := m.collectCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_sdp_checkpoint_log_time Time of last checkpoint log
+# TYPE p4_sdp_checkpoint_log_time gauge
+p4_sdp_checkpoint_log_time{serverid="master",sdpinst="1"} 1647310231
+# HELP p4_sdp_checkpoint_duration Time taken for last checkpoint/restore action
+# TYPE p4_sdp_checkpoint_duration gauge
+p4_sdp_checkpoint_duration{serverid="master",sdpinst="1"} 630
+# HELP p4_sdp_checkpoint_last_success_time Time last successful checkpoint completed (epoch secs)
+# TYPE p4_sdp_checkpoint_last_success_time gauge
+p4_sdp_checkpoint_last_success_time{serverid="master",sdpinst="1"} 1647310231
+# HELP p4_sdp_checkpoint_status Status of latest checkpoint: 0 success, 1 failed, 2 running
+# TYPE p4_sdp_checkpoint_status gauge
+p4_sdp_checkpoint_status{serverid="master",sdpinst="1",script="daily_checkpoint.sh"} 2
+# HELP p4_sdp_journal_rotation_time Time of last successful journal rotation (epoch secs)
+# TYPE p4_sdp_journal_rotation_time gauge
+p4_sdp_journal_rotation_time{serverid="master",sdpinst="1"} 1647432005
+# HELP p4_sdp_checkpoint_size_bytes Size of latest checkpoint file
+# TYPE p4_sdp_checkpoint_size_bytes gauge
+p4_sdp_checkpoint_size_bytes{serverid="master",sdpinst="1"} 100
+`, string(out))
+
+	// No longer running so has failed
+	assert.NoError(t, os.RemoveAll(procDir))
+	out, err = m.collectCheckpoint()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_sdp_checkpoint_status{serverid="master",sdpinst="1",script="daily_checkpoint.sh"} 1`)
+
+	// Not SDP
+	m.config.SDPInstance = ""
+	out, err = m.collectCheckpoint()
+	assert.NoError(t, err)
+	assert.Nil(t, out)
+}
@@ -0,0 +1,493 @@
+package main
+
+// Collectors for the monitor command. Metric names, help and labels are as per
+// scripts/monitor_metrics.sh so that existing dashboards and alerts continue to work.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/p4cmd"
+)
+
+// How often to refresh the output of commands whose results rarely change
+const monitorCacheTime = time.Hour
+
+// firstRecord - for commands which output a single record, returning an empty record if none
+func firstRecord(records []p4cmd.Record) p4cmd.Record {
+	if len(records) == 0 {
+		return p4cmd.Record{}
+	}
+	return records[0]
+}
+
+// nonEmptyLines - returns the lines of the output ignoring blank lines
+func nonEmptyLines(buf []byte) []string {
+	result := make([]string, 0)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.TrimSpace(line) != "" {
+			result = append(result, strings.TrimRight(line, "\r"))
+		}
+	}
+	return result
+}
+
+func (m *monitor) isReplica() bool {
+	if v := m.env["P4REPLICA"]; v != "" && m.useSDP() {
+		return v == "TRUE"
+	}
+	_, ok := m.info["Replica of"]
+	return ok
+}
+
+// parseHMS - converts elapsed times such as 168:39:20 (hours may exceed 24) to seconds
+func parseHMS(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time: '%s'", value)
+	}
+	secs := 0
+	for i, mult := range []int{3600, 60, 1} {
+		v, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid time: '%s'", value)
+		}
+		secs += v * mult
+	}
+	return secs, nil
+}
+
+// collectUptime - from p4 info, e.g. "Server uptime: 168:39:20"
+func (m *monitor) collectUptime() ([]byte, error) {
+	secs := 0
+	if uptime := m.info["Server uptime"]; uptime != "" {
+		var err error
+		if secs, err = parseHMS(uptime); err != nil {
+			return nil, fmt.Errorf("invalid uptime: '%s'", uptime)
+		}
+	}
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_server_uptime", "P4D Server uptime (seconds)", "counter")
+	m.sample(buf, "p4_server_uptime", strconv.Itoa(secs))
+	return buf.Bytes(), nil
+}
+
+// collectChange - the change counter from p4 counters, e.g. "change = 1234"
+func (m *monitor) collectChange() ([]byte, error) {
+	out, err := m.p4("counters")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range nonEmptyLines(out) {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "change" && fields[1] == "=" {
+			buf := new(bytes.Buffer)
+			printHeader(buf, "p4_change_counter", "P4D change counter", "counter")
+			m.sample(buf, "p4_change_counter", fields[2])
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, nil
+}
+
+// countProcesses - the number of processes whose command line contains the name followed by
+// a space, i.e. as per "ps ax | grep 'p4d_1 '"
+func countProcesses(procDir string, name string) int {
+	dirs, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, d := range dirs {
+		if _, err := strconv.Atoi(d.Name()); err != nil {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(procDir, d.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Join(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), " ") + " "
+		if strings.Contains(args, name+" ") {
+			count++
+		}
+	}
+	return count
+}
+
+// sortedCounts - prints a sample for each value in order
+func (m *monitor) sortedCounts(buf *bytes.Buffer, name string, label string, counts map[string]int) {
+	values := make([]string, 0, len(counts))
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		m.sample(buf, name, strconv.Itoa(counts[v]), labelPair{label, v})
+	}
+}
+
+// collectProcesses - running commands by cmd and user from p4 monitor show -l, e.g.
+//
+//	2345 R fred 00:00:01 sync //depot/...
+//
+// plus the number of p4d processes
+func (m *monitor) collectProcesses() ([]byte, error) {
+	out, err := m.p4("monitor", "show", "-l")
+	if err != nil {
+		return nil, err
+	}
+	byCmd := make(map[string]int)
+	byUser := make(map[string]int)
+	for _, line := range nonEmptyLines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		byUser[fields[2]]++
+		byCmd[fields[4]]++
+	}
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_monitor_by_cmd", "P4 running processes", "counter")
+	m.sortedCounts(buf, "p4_monitor_by_cmd", "cmd", byCmd)
+	printHeader(buf, "p4_monitor_by_user", "P4 running processes", "counter")
+	m.sortedCounts(buf, "p4_monitor_by_user", "user", byUser)
+
+	proc := "p4d"
+	if m.useSDP() {
+		proc = "p4d_" + m.config.SDPInstance
+	}
+	printHeader(buf, "p4_process_count", "P4 ps running processes", "counter")
+	m.sample(buf, "p4_process_count", strconv.Itoa(countProcesses(m.procDir, proc)))
+	return buf.Bytes(), nil
+}
+
+// Services of servers which replicate journals
+var replicaServicesRE = regexp.MustCompile(`standard|replica|commit-server|edge-server|forwarding-replica|build-server|standby|forwarding-standby`)
+
+// replicaStatus - journal position of a server as reported by p4 -ztag servers -J
+type replicaStatus struct {
+	serverID string
+	services string
+	jnl, pos int64
+	valid    bool // False if the server has not reported its position
+}
+
+// parseServersJournal - replicas from p4 -ztag servers records, in the order output, with their
+// journal positions from p4 -ztag servers -J records. Servers which don't replicate (e.g. proxies
+// and brokers) are ignored. Fields are as for the -F spec in monitor_metrics.sh.
+func parseServersJournal(servers, journal []p4cmd.Record) []replicaStatus {
+	positions := make(map[string]p4cmd.Record)
+	for _, r := range journal {
+		positions[r.String("serverID")] = r
+	}
+	result := make([]replicaStatus, 0)
+	for _, r := range servers {
+		if !replicaServicesRE.MatchString(r.String("services")) {
+			continue
+		}
+		s := replicaStatus{serverID: r.String("serverID"), services: r.String("services")}
+		if p, ok := positions[s.serverID]; ok {
+			jnl, errJnl := p.Int("appliedJnl")
+			pos, errPos := p.Int("appliedPos")
+			if errJnl == nil && errPos == nil {
+				s.jnl, s.pos, s.valid = jnl, pos, true
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// replicationLag - journals and bytes the replica is behind the reference server (normally the
+// commit server running the collector). Bytes behind can only be calculated when both are
+// in the same journal, otherwise it is -1.
+func replicationLag(ref, replica replicaStatus) (journals, lag int64) {
+	journals = ref.jnl - replica.jnl
+	if journals != 0 {
+		return journals, -1
+	}
+	return journals, ref.pos - replica.pos
+}
+
+// collectReplication - journal position and lag of each replica as reported by p4 servers -J
+func (m *monitor) collectReplication() ([]byte, error) {
+	// As for monitor_metrics.sh, services are from p4 servers and journal positions from p4 servers -J
+	records, err := m.p4ztag("servers")
+	if err != nil {
+		return nil, err
+	}
+	journal, err := m.p4ztag("servers", "-J")
+	if err != nil {
+		return nil, err
+	}
+	servers := parseServersJournal(records, journal)
+	var ref *replicaStatus
+	for i := range servers {
+		if servers[i].serverID == m.serverID && servers[i].valid {
+			ref = &servers[i]
+		}
+	}
+	labels := func(s replicaStatus) []labelPair {
+		return []labelPair{{"servername", s.serverID}, {"services", s.services}}
+	}
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_replica_curr_jnl", "Current journal for server", "counter")
+	for _, s := range servers {
+		m.sample(buf, "p4_replica_curr_jnl", strconv.FormatInt(s.jnl, 10), labels(s)...)
+	}
+	printHeader(buf, "p4_replica_curr_pos", "Current journal position for server", "counter")
+	for _, s := range servers {
+		m.sample(buf, "p4_replica_curr_pos", strconv.FormatInt(s.pos, 10), labels(s)...)
+	}
+	printHeader(buf, "p4_replica_replication_error", "Set to 1 if server is not reporting its journal position", "gauge")
+	for _, s := range servers {
+		replicationError := 0
+		if !s.valid {
+			replicationError = 1
+		}
+		m.sample(buf, "p4_replica_replication_error", strconv.Itoa(replicationError), labels(s)...)
+	}
+	// Lag is relative to this server, so is only output when it is in the list (e.g. the commit server)
+	if ref == nil {
+		return buf.Bytes(), nil
+	}
+	printHeader(buf, "p4_replica_journals_behind", "Count of how many journals server is behind this one", "gauge")
+	for _, s := range servers {
+		if s.valid && s.serverID != ref.serverID {
+			journals, _ := replicationLag(*ref, s)
+			m.sample(buf, "p4_replica_journals_behind", strconv.FormatInt(journals, 10), labels(s)...)
+		}
+	}
+	printHeader(buf, "p4_replica_lag", "Server lag behind this one in current journal (bytes, -1 if in a different journal)", "gauge")
+	for _, s := range servers {
+		if s.valid && s.serverID != ref.serverID {
+			_, lag := replicationLag(*ref, s)
+			m.sample(buf, "p4_replica_lag", strconv.FormatInt(lag, 10), labels(s)...)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// collectPull - pull queue and replication status, for replicas only
+func (m *monitor) collectPull() ([]byte, error) {
+	if !m.isReplica() {
+		return nil, nil
+	}
+	out, err := m.p4("pull", "-l")
+	if err != nil {
+		return nil, err
+	}
+	failed, queued := 0, 0
+	for _, line := range nonEmptyLines(out) {
+		if strings.HasSuffix(line, "failed.") {
+			failed++
+		} else {
+			queued++
+		}
+	}
+	services := labelPair{"services", m.info["Server services"]}
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_pull_errors", "P4 pull transfers failed count", "counter")
+	m.sample(buf, "p4_pull_errors", strconv.Itoa(failed), services)
+	printHeader(buf, "p4_pull_queue", "P4 pull files in queue count", "counter")
+	m.sample(buf, "p4_pull_queue", strconv.Itoa(queued), services)
+
+	// Note that if the replica can't talk to the master, masterJournalSequence is -1 (or missing)
+	records, err := m.p4ztag("pull", "-lj")
+	if err != nil {
+		return nil, err
+	}
+	pull := firstRecord(records)
+	value := func(name string) int64 {
+		return pull.IntOr(name, 0)
+	}
+	printHeader(buf, "p4_pull_replica_journals_behind", "Count of how many journals behind replica is", "gauge")
+	m.sample(buf, "p4_pull_replica_journals_behind",
+		strconv.FormatInt(value("masterJournalNumber")-value("replicaJournalCounter"), 10), services)
+	replicationError, lag := 0, int64(-1)
+	if !pull.Has("masterJournalSequence") || value("masterJournalSequence") < 0 {
+		replicationError = 1
+	} else {
+		lag = value("masterJournalSequence") - value("replicaJournalSequence")
+	}
+	printHeader(buf, "p4_pull_replication_error", "Set to 1 if replication error", "gauge")
+	m.sample(buf, "p4_pull_replication_error", strconv.Itoa(replicationError), services)
+	printHeader(buf, "p4_pull_replica_lag", "Replica lag count (bytes)", "gauge")
+	m.sample(buf, "p4_pull_replica_lag", strconv.FormatInt(lag, 10), services)
+	return buf.Bytes(), nil
+}
+
+// realtimeMetric - a value output by p4d --show-realtime
+type realtimeMetric struct {
+	name       string
+	help       string
+	metricType string
+}
+
+var realtimeMetrics = []realtimeMetric{
+	{"rtv.db.lockwait", "P4 realtime lockwait counter", "gauge"},
+	{"rtv.db.ckp.active", "P4 realtime checkpoint active indicator", "gauge"},
+	{"rtv.db.ckp.records", "P4 realtime checkpoint records counter", "gauge"},
+	{"rtv.db.io.records", "P4 realtime IO records counter", "counter"},
+	{"rtv.rpl.behind.bytes", "P4 realtime replica bytes lag counter", "gauge"},
+	{"rtv.rpl.behind.journals", "P4 realtime replica journal lag counter", "gauge"},
+	{"rtv.svr.sessions.active", "P4 realtime server active sessions counter", "gauge"},
+	{"rtv.svr.sessions.total", "P4 realtime server total sessions counter", "counter"},
+}
+
+func (m *monitor) p4dbin() string {
+	if m.config.Monitor.P4DBin != "" {
+		return m.config.Monitor.P4DBin
+	}
+	if v := m.env["P4DBIN"]; v != "" {
+		return v
+	}
+	return "p4d"
+}
+
+// p4dVersion - the release from p4d -V, e.g. "Rev. P4D/LINUX26X86_64/2021.1/2156517 (2021/05/24)." -> 2021.1
+func p4dVersion(buf []byte) string {
+	for _, line := range nonEmptyLines(buf) {
+		if strings.HasPrefix(line, "Rev.") {
+			if parts := strings.Split(line, "/"); len(parts) > 2 {
+				return parts[2]
+			}
+		}
+	}
+	return ""
+}
+
+// collectRealtime - from p4d --show-realtime (2021.1 or later) which outputs lines such as:
+//
+//	rtv.db.lockwait (flags 0) 0 max 382
+//	rtv.db.io.records (flags 0) 126389592854
+//
+// Only for SDP, as p4d must run with the server's environment.
+func (m *monitor) collectRealtime() ([]byte, error) {
+	if !m.useSDP() {
+		return nil, nil
+	}
+	out, err := m.runner.Run(m.p4dbin(), "-V")
+	if err != nil {
+		return nil, err
+	}
+	if ver := p4dVersion(out); ver <= "2020.0" {
+		return nil, nil
+	}
+	out, err = m.runner.Run(m.p4dbin(), "--show-realtime")
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range nonEmptyLines(out) {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 {
+			values[fields[0]] = fields[3]
+		}
+	}
+	buf := new(bytes.Buffer)
+	for _, rm := range realtimeMetrics {
+		v, ok := values[rm.name]
+		if !ok {
+			continue
+		}
+		name := "p4_" + strings.ReplaceAll(rm.name, ".", "_")
+		printHeader(buf, name, rm.help, rm.metricType)
+		m.sample(buf, name, v)
+	}
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
+
+var versionDateRE = regexp.MustCompile(` \([0-9/]+\)`)
+
+// collectVersions - p4d version and services from p4 info, and SDP version
+func (m *monitor) collectVersions() ([]byte, error) {
+	valueOrUnknown := func(v string) string {
+		if v == "" {
+			return "unknown"
+		}
+		return v
+	}
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_p4d_build_info", "P4D Version/build info", "gauge")
+	m.sample(buf, "p4_p4d_build_info", "1",
+		labelPair{"version", valueOrUnknown(versionDateRE.ReplaceAllString(m.info["Server version"], ""))})
+	printHeader(buf, "p4_p4d_server_type", "P4D server type/services", "gauge")
+	m.sample(buf, "p4_p4d_server_type", "1", labelPair{"services", valueOrUnknown(m.info["Server services"])})
+	if m.useSDP() {
+		if sdpVersion, err := ioutil.ReadFile(sdpVersionFile); err == nil {
+			printHeader(buf, "p4_sdp_version", "SDP Version", "gauge")
+			m.sample(buf, "p4_sdp_version", "1", labelPair{"version", valueOrUnknown(strings.TrimSpace(string(sdpVersion)))})
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *monitor) sdpLogsDir() string {
+	if v := m.env["LOGS"]; v != "" {
+		return v
+	}
+	return fmt.Sprintf("/p4/%s/logs", m.config.SDPInstance)
+}
+
+// errorsFile - the structured error log, e.g. as configured by
+//
+//	serverlog.file.3=/p4/1/logs/errors.csv (configure)
+func (m *monitor) errorsFile() (string, error) {
+	if m.useSDP() {
+		return filepath.Join(m.sdpLogsDir(), "errors.csv"), nil
+	}
+	out, err := m.p4("configure", "show")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range nonEmptyLines(out) {
+		if strings.HasPrefix(line, "serverlog.file.") && strings.Contains(line, "errors.csv") {
+			value := strings.SplitN(line, "=", 2)[1]
+			return strings.SplitN(value, " (", 2)[0], nil
+		}
+	}
+	return "", nil
+}
+
+// collectErrors - counts of errors by subsystem, id and severity from the structured error log
+// (if configured)
+func (m *monitor) collectErrors() ([]byte, error) {
+	errorsFile, err := m.errorsFile()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(errorsFile); errorsFile == "" || err != nil {
+		os.Remove(m.outputPath("p4_errors"))
+		return nil, nil
+	}
+	lines, err := readLines(errorsFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	counter := newErrorCounter(func(ver string) ([]byte, error) {
+		return m.p4("logschema", ver)
+	})
+	for _, line := range lines {
+		if err := counter.add(line); err != nil {
+			return nil, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	counter.write(buf, m.sample)
+	return buf.Bytes(), nil
+}
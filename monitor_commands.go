@@ -0,0 +1,131 @@
+package main
+
+// Running command metrics for the monitor command from p4 -ztag monitor show -al, e.g.
+//
+//	... id 2345
+//	... status R
+//	... owner fred
+//	... time 00:10:01
+//	... command sync
+//	... args //depot/...
+//
+// Unlike p4_cmd_running (from the log), these show long running or stuck commands before they complete.
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+
+	"github.com/perforce/p4prometheus/p4cmd"
+)
+
+// Upper bounds (seconds) of the p4_monitor_cmd_age_seconds buckets
+var commandAgeBuckets = []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600}
+
+// Command states always output by p4_monitor_cmd_state (others are output if present):
+// running, terminated (marked for termination), idle and background
+var commandStates = []string{"R", "T", "I", "B"}
+
+// runningCommand - a command from p4 monitor show
+type runningCommand struct {
+	id, state, user, cmd string
+	age                  int // seconds
+}
+
+// parseRunningCommands - skips records without a valid time
+func parseRunningCommands(records []p4cmd.Record) []runningCommand {
+	cmds := make([]runningCommand, 0, len(records))
+	for _, r := range records {
+		age, err := parseHMS(r.String("time"))
+		if err != nil {
+			continue
+		}
+		cmds = append(cmds, runningCommand{id: r.String("id"), state: r.String("status"),
+			user: r.String("owner"), cmd: r.String("command"), age: age})
+	}
+	return cmds
+}
+
+// longestCommands - the n longest running commands which are not idle, longest first. Only the
+// longest for each user and cmd is included, so that the series don't change with the command ids.
+func longestCommands(cmds []runningCommand, n int) []runningCommand {
+	active := make([]runningCommand, 0, len(cmds))
+	for _, c := range cmds {
+		if c.state != "I" {
+			active = append(active, c)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool { return active[i].age > active[j].age })
+	longest := make([]runningCommand, 0, n)
+	seen := make(map[[2]string]bool)
+	for _, c := range active {
+		if len(longest) >= n {
+			break
+		}
+		if key := [2]string{c.user, c.cmd}; !seen[key] {
+			seen[key] = true
+			longest = append(longest, c)
+		}
+	}
+	return longest
+}
+
+// collectCommands - counts of commands by state, a histogram of the age of those not idle (an idle
+// command's time is that of the connection), and the longest running ones with their user and cmd
+func (m *monitor) collectCommands() ([]byte, error) {
+	records, err := m.p4ztag("monitor", "show", "-al")
+	if err != nil {
+		return nil, err
+	}
+	cmds := parseRunningCommands(records)
+	buf := new(bytes.Buffer)
+
+	states := make(map[string]int)
+	for _, s := range commandStates {
+		states[s] = 0
+	}
+	others := make([]string, 0)
+	for _, c := range cmds {
+		if _, ok := states[c.state]; !ok {
+			others = append(others, c.state)
+		}
+		states[c.state]++
+	}
+	sort.Strings(others)
+	printHeader(buf, "p4_monitor_cmd_state", "P4 running commands by state (R running, T terminating, I idle, B background)", "gauge")
+	for _, s := range append(append([]string{}, commandStates...), others...) {
+		m.sample(buf, "p4_monitor_cmd_state", strconv.Itoa(states[s]), labelPair{"state", s})
+	}
+
+	buckets := make([]int, len(commandAgeBuckets))
+	count, sum := 0, 0
+	for _, c := range cmds {
+		if c.state == "I" {
+			continue
+		}
+		count++
+		sum += c.age
+		for i, le := range commandAgeBuckets {
+			if float64(c.age) <= le {
+				buckets[i]++
+			}
+		}
+	}
+	printHeader(buf, "p4_monitor_cmd_age_seconds", "Time P4 commands have been running (excluding idle)", "histogram")
+	for i, le := range commandAgeBuckets {
+		m.sample(buf, "p4_monitor_cmd_age_seconds_bucket", strconv.Itoa(buckets[i]),
+			labelPair{"le", strconv.FormatFloat(le, 'f', -1, 64)})
+	}
+	m.sample(buf, "p4_monitor_cmd_age_seconds_bucket", strconv.Itoa(count), labelPair{"le", "+Inf"})
+	m.sample(buf, "p4_monitor_cmd_age_seconds_sum", strconv.Itoa(sum))
+	m.sample(buf, "p4_monitor_cmd_age_seconds_count", strconv.Itoa(count))
+
+	if n := m.config.Monitor.TopCommands; n > 0 {
+		printHeader(buf, "p4_monitor_cmd_longest_seconds", "Time the longest running P4 commands have been running (by user and cmd)", "gauge")
+		for _, c := range longestCommands(cmds, n) {
+			m.sample(buf, "p4_monitor_cmd_longest_seconds", strconv.Itoa(c.age),
+				labelPair{"user", c.user}, labelPair{"cmd", c.cmd})
+		}
+	}
+	return buf.Bytes(), nil
+}
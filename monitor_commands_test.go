@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMonitorShowZtag = `... id 1234
+... status R
+... owner fred
+... time 02:00:10
+... command sync
+... args //depot/...
+
+... id 1235
+... status R
+... owner bob
+... time 00:01:10
+... command sync
+... args //depot/a/...
+
+... id 1236
+... status I
+... owner swarm
+... time 10:00:00
+... command IDLE
+... args none
+
+... id 1237
+... status T
+... owner bob
+... time 00:00:05
+... command submit
+... args -d test
+
+... id 1238
+... status P
+... owner fred
+... time 00:00:01
+... command edit
+... args file
+
+... id 1239
+... status R
+... owner perforce
+... time 00:00:00
+... command monitor
+... args show -al
+`
+
+func TestMonitorCommands(t *testing.T) {
+	m, _ := newTestMonitor(t, "", map[string]string{
+		"p4 -u perforce -p perforce:1666 -ztag monitor show -al": testMonitorShowZtag,
+	})
+	m.serverID = "master"
+	m.config.Monitor.TopCommands = 2
+	out, err := m.collectCommands()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_monitor_cmd_state P4 running commands by state (R running, T terminating, I idle, B background)
+# TYPE p4_monitor_cmd_state gauge
+p4_monitor_cmd_state{serverid="master",state="R"} 3
+p4_monitor_cmd_state{serverid="master",state="T"} 1
+p4_monitor_cmd_state{serverid="master",state="I"} 1
+p4_monitor_cmd_state{serverid="master",state="B"} 0
+p4_monitor_cmd_state{serverid="master",state="P"} 1
+# HELP p4_monitor_cmd_age_seconds Time P4 commands have been running (excluding idle)
+# TYPE p4_monitor_cmd_age_seconds histogram
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="1"} 2
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="10"} 3
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="60"} 3
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="300"} 4
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="900"} 4
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="3600"} 4
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="14400"} 5
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="86400"} 5
+p4_monitor_cmd_age_seconds_bucket{serverid="master",le="+Inf"} 5
+p4_monitor_cmd_age_seconds_sum{serverid="master"} 7286
+p4_monitor_cmd_age_seconds_count{serverid="master"} 5
+# HELP p4_monitor_cmd_longest_seconds Time the longest running P4 commands have been running (by user and cmd)
+# TYPE p4_monitor_cmd_longest_seconds gauge
+p4_monitor_cmd_longest_seconds{serverid="master",user="fred",cmd="sync"} 7210
+p4_monitor_cmd_longest_seconds{serverid="master",user="bob",cmd="sync"} 70
+`, string(out))
+
+	m.config.Monitor.TopCommands = 0
+	out, err = m.collectCommands()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "p4_monitor_cmd_longest_seconds")
+}
+
+func TestLongestCommands(t *testing.T) {
+	cmds := []runningCommand{{id: "1", state: "R", user: "fred", cmd: "sync", age: 5},
+		{id: "2", state: "I", user: "swarm", cmd: "IDLE", age: 500},
+		{id: "3", state: "R", user: "bob", cmd: "sync", age: 50},
+		{id: "4", state: "B", user: "fred", cmd: "submit", age: 5},
+		{id: "5", state: "R", user: "bob", cmd: "sync", age: 40},
+		{id: "6", state: "R", user: "fred", cmd: "sync", age: 1}}
+	longest := longestCommands(cmds, 10)
+	assert.Equal(t, 3, len(longest), "only the longest for each user and cmd")
+	assert.Equal(t, "3", longest[0].id)
+	assert.Equal(t, "1", longest[1].id, "stable order for equal ages")
+	assert.Equal(t, "4", longest[2].id)
+	assert.Equal(t, 1, len(longestCommands(cmds, 1)))
+	assert.Equal(t, "1", longestCommands(cmds, 2)[1].id)
+}
@@ -0,0 +1,208 @@
+package main
+
+// Filesystem free space for the monitor command, compared with the filesys.*.min configurables below
+// which p4d stops accepting commands that write to the filesystem.
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/perforce/p4prometheus/config"
+)
+
+var filesysConfigurables = func() []string {
+	names := make([]string, 0, len(config.MonitorFilesys))
+	for _, f := range config.MonitorFilesys {
+		names = append(names, "filesys."+f+".min")
+	}
+	return names
+}()
+
+// dehumanise - converts values such as 500M or 1G to bytes (powers of 2), or such as 10% to that
+// percentage of the total size of the filesystem (0 if not known)
+func dehumanise(value string, total uint64) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "%") {
+		v, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		if err != nil || v < 0 || v > 100 {
+			return 0, fmt.Errorf("invalid percentage: '%s'", value)
+		}
+		if total == 0 {
+			return 0, fmt.Errorf("size of filesystem not known for '%s'", value)
+		}
+		return uint64(v / 100 * float64(total)), nil
+	}
+	mult := 1.0
+	if value != "" {
+		switch strings.ToUpper(value[len(value)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: '%s'", value)
+	}
+	return uint64(v * mult), nil
+}
+
+// filesysPath - the path whose volume holds the filesystem, from filesys_paths in the config,
+// else the SDP environment and p4 info. Journal and log are files, so their directory is used.
+// Returns "" if not known.
+func (m *monitor) filesysPath(filesys string) string {
+	if p := m.config.Monitor.FilesysPaths[filesys]; p != "" {
+		return p
+	}
+	root := m.env["P4ROOT"]
+	if root == "" {
+		root = m.info["Server root"]
+	}
+	relRoot := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		if root == "" {
+			return ""
+		}
+		return filepath.Join(root, p)
+	}
+	firstEnv := func(names ...string) string {
+		for _, n := range names {
+			if v := m.env[n]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	switch filesys {
+	case "P4ROOT":
+		return root
+	case "P4JOURNAL", "P4LOG":
+		p := m.env[filesys]
+		if p == "" {
+			if filesys == "P4JOURNAL" {
+				p = "journal"
+			} else {
+				p = "log"
+			}
+		}
+		if p = relRoot(p); p == "" {
+			return ""
+		}
+		return filepath.Dir(p)
+	case "TEMP":
+		if p := firstEnv("P4TMP", "TEMP", "TMP"); p != "" {
+			return relRoot(p)
+		}
+		return root
+	case "depot":
+		if p := m.env["DEPOTS"]; p != "" {
+			return relRoot(p)
+		}
+		return root
+	}
+	return ""
+}
+
+// collectFilesys - filesys.*.min settings (refreshed hourly) together with the free space of
+// the corresponding volumes (checked every run). p4 configure show outputs the
+// configured value (if any) as well as the default, e.g.
+//
+//	filesys.P4ROOT.min=5G (configure)
+//	filesys.P4ROOT.min=250M (default)
+func (m *monitor) collectFilesys() ([]byte, error) {
+	cmds := make([][]string, 0, len(filesysConfigurables))
+	for _, c := range filesysConfigurables {
+		cmds = append(cmds, []string{"configure", "show", c})
+	}
+	out, err := m.cachedP4(m.instancePath("tmp_filesys"), monitorCacheTime, cmds...)
+	if err != nil {
+		return nil, err
+	}
+	configured := make(map[string]string)
+	defaults := make(map[string]string)
+	for _, line := range nonEmptyLines(out) {
+		fields := strings.Fields(line)
+		parts := strings.SplitN(fields[0], "=", 2)
+		if len(fields) < 2 || len(parts) != 2 {
+			continue
+		}
+		switch fields[1] {
+		case "(configure)":
+			configured[parts[0]] = parts[1]
+		case "(default)":
+			defaults[parts[0]] = parts[1]
+		}
+	}
+
+	type space struct {
+		filesys, path string
+		free, total   uint64
+	}
+	spaces := make([]space, 0, len(config.MonitorFilesys))
+	totals := make(map[string]uint64)
+	for _, filesys := range config.MonitorFilesys {
+		path := m.filesysPath(filesys)
+		if path == "" {
+			continue
+		}
+		free, total, err := m.diskSpace(path)
+		if err != nil {
+			m.logger.Warnf("Monitor filesys: %s: %v", filesys, err)
+			continue
+		}
+		spaces = append(spaces, space{filesys, path, free, total})
+		totals[filesys] = total
+	}
+
+	mins := make(map[string]uint64)
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_filesys_min", "Minimum space for filesystem", "gauge")
+	for i, c := range filesysConfigurables {
+		value, ok := configured[c]
+		if !ok {
+			value = defaults[c]
+		}
+		filesys := config.MonitorFilesys[i]
+		size, err := dehumanise(value, totals[filesys])
+		if err != nil {
+			m.logger.Warnf("Monitor filesys: %s: %v", c, err)
+			continue
+		}
+		mins[filesys] = size
+		m.sample(buf, "p4_filesys_min", strconv.FormatUint(size, 10), labelPair{"filesys", filesys})
+	}
+	if len(spaces) == 0 {
+		return buf.Bytes(), nil
+	}
+	printHeader(buf, "p4_filesys_free_bytes", "Free space on filesystem", "gauge")
+	for _, s := range spaces {
+		m.sample(buf, "p4_filesys_free_bytes", strconv.FormatUint(s.free, 10),
+			labelPair{"filesys", s.filesys}, labelPair{"path", s.path})
+	}
+	printHeader(buf, "p4_filesys_size_bytes", "Total size of filesystem", "gauge")
+	for _, s := range spaces {
+		m.sample(buf, "p4_filesys_size_bytes", strconv.FormatUint(s.total, 10),
+			labelPair{"filesys", s.filesys}, labelPair{"path", s.path})
+	}
+	printHeader(buf, "p4_filesys_free_ratio", "Free space on filesystem divided by filesys.*.min (p4d rejects commands below 1)", "gauge")
+	for _, s := range spaces {
+		if min := mins[s.filesys]; min > 0 {
+			m.sample(buf, "p4_filesys_free_ratio", strconv.FormatFloat(float64(s.free)/float64(min), 'f', 3, 64),
+				labelPair{"filesys", s.filesys})
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitorFilesys(t *testing.T) {
+	outputs := map[string]string{}
+	for _, c := range filesysConfigurables {
+		outputs["p4 -u perforce -p perforce:1666 configure show "+c] = c + "=250M (default)\n"
+	}
+	outputs["p4 -u perforce -p perforce:1666 configure show filesys.P4ROOT.min"] =
+		"filesys.P4ROOT.min=5G (configure)\nfilesys.P4ROOT.min=250M (default)\n"
+	outputs["p4 -u perforce -p perforce:1666 configure show filesys.TEMP.min"] = "filesys.TEMP.min=1.5k (configure)\n"
+	m, _ := newTestMonitor(t, "", outputs)
+	m.serverID = "master"
+	out, err := m.collectFilesys()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_filesys_min Minimum space for filesystem
+# TYPE p4_filesys_min gauge
+p4_filesys_min{serverid="master",filesys="depot"} 262144000
+p4_filesys_min{serverid="master",filesys="P4ROOT"} 5368709120
+p4_filesys_min{serverid="master",filesys="P4JOURNAL"} 262144000
+p4_filesys_min{serverid="master",filesys="P4LOG"} 262144000
+p4_filesys_min{serverid="master",filesys="TEMP"} 1536
+`, string(out))
+}
+
+func TestDehumanise(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected uint64
+	}{
+		{"0", 0}, {"10", 10}, {"1K", 1024}, {"500m", 500 << 20}, {"2G", 2 << 30}, {"1T", 1 << 40},
+	} {
+		v, err := dehumanise(tc.value, 1<<40)
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, tc.expected, v, tc.value)
+	}
+	// Percentages of the filesystem size
+	for _, tc := range []struct {
+		value    string
+		expected uint64
+	}{
+		{"10%", 100 << 30}, {"0%", 0}, {"2.5%", 25 << 30}, {"100%", 1000 << 30},
+	} {
+		v, err := dehumanise(tc.value, 1000<<30)
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, tc.expected, v, tc.value)
+	}
+	for _, value := range []string{"", "G", "abc", "-1", "%", "x%", "-5%", "101%"} {
+		_, err := dehumanise(value, 1<<40)
+		assert.Error(t, err, value)
+	}
+	_, err := dehumanise("10%", 0)
+	assert.Error(t, err)
+}
+
+func TestFilesysPath(t *testing.T) {
+	m, _ := newTestMonitor(t, "1", nil)
+	for _, f := range config.MonitorFilesys {
+		assert.Equal(t, "", m.filesysPath(f), f)
+	}
+
+	m.info["Server root"] = "/p4/1/root"
+	assert.Equal(t, "/p4/1/root", m.filesysPath("P4ROOT"))
+	assert.Equal(t, "/p4/1/root", m.filesysPath("P4JOURNAL"))
+	assert.Equal(t, "/p4/1/root", m.filesysPath("P4LOG"))
+	assert.Equal(t, "/p4/1/root", m.filesysPath("TEMP"))
+	assert.Equal(t, "/p4/1/root", m.filesysPath("depot"))
+
+	m.env = map[string]string{"P4ROOT": "/p4/1/root", "P4JOURNAL": "/p4/1/logs/journal",
+		"P4LOG": "/p4/1/logs/log", "P4TMP": "/p4/1/tmp", "DEPOTS": "/p4/1/depots"}
+	assert.Equal(t, "/p4/1/logs", m.filesysPath("P4JOURNAL"))
+	assert.Equal(t, "/p4/1/logs", m.filesysPath("P4LOG"))
+	assert.Equal(t, "/p4/1/tmp", m.filesysPath("TEMP"))
+	assert.Equal(t, "/p4/1/depots", m.filesysPath("depot"))
+
+	m.config.Monitor.FilesysPaths = map[string]string{"depot": "/hxdepots/p4/1/depots"}
+	assert.Equal(t, "/hxdepots/p4/1/depots", m.filesysPath("depot"))
+}
+
+func TestMonitorFilesysFree(t *testing.T) {
+	outputs := map[string]string{}
+	for _, c := range filesysConfigurables {
+		outputs["p4 -u perforce -p perforce:1666 configure show "+c] = c + "=1G (default)\n"
+	}
+	m, _ := newTestMonitor(t, "", outputs)
+	m.serverID = "master"
+	m.env = map[string]string{"P4ROOT": "/p4/1/root", "P4JOURNAL": "/p4/1/logs/journal"}
+	m.diskSpace = func(path string) (uint64, uint64, error) {
+		if path == "/p4/1/logs" {
+			return 0, 0, fmt.Errorf("no such file or directory")
+		}
+		return 1 << 29, 1 << 32, nil
+	}
+	out, err := m.collectFilesys()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `# HELP p4_filesys_free_bytes Free space on filesystem
+# TYPE p4_filesys_free_bytes gauge
+p4_filesys_free_bytes{serverid="master",filesys="depot",path="/p4/1/root"} 536870912
+p4_filesys_free_bytes{serverid="master",filesys="P4ROOT",path="/p4/1/root"} 536870912
+p4_filesys_free_bytes{serverid="master",filesys="P4LOG",path="/p4/1/root"} 536870912
+p4_filesys_free_bytes{serverid="master",filesys="TEMP",path="/p4/1/root"} 536870912
+`)
+	assert.Contains(t, string(out), `p4_filesys_size_bytes{serverid="master",filesys="P4ROOT",path="/p4/1/root"} 4294967296`)
+	assert.Contains(t, string(out), `p4_filesys_free_ratio{serverid="master",filesys="P4ROOT"} 0.500`)
+	assert.NotContains(t, string(out), `filesys="P4JOURNAL",path`)
+
+	// Percentages of the filesystem size, which is not known for P4JOURNAL, for another instance
+	// sharing the metrics directory (so not using the first instance's cached configurables)
+	outputs2 := map[string]string{}
+	for _, c := range filesysConfigurables {
+		outputs2["p4 -u perforce -p perforce:1666 configure show "+c] = c + "=10% (configure)\n"
+	}
+	m2, _ := newTestMonitor(t, "", outputs2)
+	m2.metricsDir = m.metricsDir
+	m2.serverID = "master"
+	m2.config.SDPInstance = "2"
+	m2.env = m.env
+	m2.diskSpace = m.diskSpace
+	out, err = m2.collectFilesys()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_filesys_min{serverid="master",sdpinst="2",filesys="P4ROOT"} 429496729
+`)
+	assert.NotContains(t, string(out), `filesys="P4JOURNAL"}`)
+	assert.Contains(t, string(out), `p4_filesys_free_ratio{serverid="master",sdpinst="2",filesys="P4ROOT"} 1.250`)
+}
+
+func TestDiskSpace(t *testing.T) {
+	free, total, err := diskSpace(t.TempDir())
+	assert.NoError(t, err)
+	assert.True(t, total > 0)
+	assert.True(t, free <= total)
+	_, _, err = diskSpace("/nonexistent/path")
+	assert.Error(t, err)
+}
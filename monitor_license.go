@@ -0,0 +1,210 @@
+package main
+
+// License metrics for the monitor command, including a forecast of when the licensed user limit
+// will be reached, based on the history of user counts recorded in the metrics directory.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/p4cmd"
+)
+
+// Minimum period of history required for a forecast, to avoid wild values from a few samples
+const licenseForecastMinSpan = 24 * time.Hour
+
+var (
+	licenseExpiresRE = regexp.MustCompile(`\(expires [^\)]+\)`)
+	licenseSupportRE = regexp.MustCompile(`\(support [^\)]+\)`)
+)
+
+// collectLicense - from p4 license -u (refreshed every license_refresh) and p4 info, e.g.
+//
+//	... userCount 893
+//	... userLimit 1000
+//	... licenseExpires 1677628800
+//	... licenseTimeRemaining 34431485
+//	... supportExpires 1677628800
+//
+// Sometimes only supportExpires is present, in which case time remaining is calculated from it.
+// The user count is also recorded in a history file, to forecast when the user limit will be reached.
+func (m *monitor) collectLicense() ([]byte, error) {
+	userCount, userLimit, licenseTimeRemaining := "0", "0", "0"
+	licenseExpires, supportExpires := "", ""
+	licenseInfo, licenseIP := "", ""
+	// No license for this server, e.g. a replica
+	if m.info["Server license"] != "none" {
+		out, err := m.cachedP4(m.instancePath("tmp_license"), m.config.Monitor.LicenseRefresh, []string{"license", "-u"})
+		if err != nil {
+			return nil, err
+		}
+		license := firstRecord(p4cmd.ParseZtag(out))
+		valueOr := func(name, def string) string {
+			if v := license[name]; v != "" {
+				return v
+			}
+			return def
+		}
+		userCount = valueOr("userCount", "0")
+		userLimit = valueOr("userLimit", "0")
+		licenseExpires = license["licenseExpires"]
+		supportExpires = license["supportExpires"]
+		licenseTimeRemaining = license["licenseTimeRemaining"]
+		if licenseTimeRemaining == "" {
+			licenseTimeRemaining = "0"
+			if expires, err := strconv.ParseInt(supportExpires, 10, 64); err == nil {
+				licenseTimeRemaining = strconv.FormatInt(expires-m.now().Unix(), 10)
+			}
+		}
+		licenseInfo = licenseExpiresRE.ReplaceAllString(m.info["Server license"], "")
+		licenseInfo = strings.TrimSpace(licenseSupportRE.ReplaceAllString(licenseInfo, ""))
+		licenseIP = m.info["Server license-ip"]
+	}
+	if licenseInfo == "" {
+		licenseInfo = "none"
+	}
+	if licenseIP == "" {
+		licenseIP = "none"
+	}
+
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_licensed_user_count", "P4D Licensed User count", "gauge")
+	m.sample(buf, "p4_licensed_user_count", userCount)
+	printHeader(buf, "p4_licensed_user_limit", "P4D Licensed User Limit", "gauge")
+	m.sample(buf, "p4_licensed_user_limit", userLimit)
+	if licenseExpires != "" {
+		printHeader(buf, "p4_license_expires", "P4D License expiry (epoch secs)", "gauge")
+		m.sample(buf, "p4_license_expires", licenseExpires)
+	}
+	printHeader(buf, "p4_license_time_remaining", "P4D License time remaining (secs)", "gauge")
+	m.sample(buf, "p4_license_time_remaining", licenseTimeRemaining)
+	if supportExpires != "" {
+		printHeader(buf, "p4_license_support_expires", "P4D License support expiry (epoch secs)", "gauge")
+		m.sample(buf, "p4_license_support_expires", supportExpires)
+	}
+	if count, limit := atoi64(userCount), atoi64(userLimit); limit > 0 {
+		printHeader(buf, "p4_license_users_headroom", "P4D Licensed users remaining before limit reached", "gauge")
+		m.sample(buf, "p4_license_users_headroom", strconv.FormatInt(limit-count, 10))
+		if days, ok := m.licenseForecast(count, limit); ok {
+			printHeader(buf, "p4_license_users_forecast_days",
+				"Days until P4D Licensed User Limit reached at current rate of growth (-1 if not growing)", "gauge")
+			m.sample(buf, "p4_license_users_forecast_days", strconv.FormatInt(days, 10))
+		}
+	}
+	printHeader(buf, "p4_license_info", "P4D License info", "gauge")
+	m.sample(buf, "p4_license_info", "1", labelPair{"info", licenseInfo})
+	printHeader(buf, "p4_license_IP", "P4D Licensed IP", "gauge")
+	m.sample(buf, "p4_license_IP", "1", labelPair{"IP", licenseIP})
+	return buf.Bytes(), nil
+}
+
+// licenseSample - user count at a point in time, as stored in the history file
+type licenseSample struct {
+	time  int64 // epoch secs
+	users int64
+}
+
+func atoi64(s string) int64 {
+	v, _ := strconv.ParseInt(s, 10, 64)
+	return v
+}
+
+// readLicenseHistory - the history file has a line per sample of "<epoch secs> <user count>"
+func readLicenseHistory(path string) ([]licenseSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	result := make([]licenseSample, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		t, err1 := strconv.ParseInt(fields[0], 10, 64)
+		users, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 == nil && err2 == nil {
+			result = append(result, licenseSample{t, users})
+		}
+	}
+	return result, scanner.Err()
+}
+
+func writeLicenseHistory(path string, history []licenseSample) error {
+	var buf bytes.Buffer
+	for _, s := range history {
+		fmt.Fprintf(&buf, "%d %d\n", s.time, s.users)
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// forecastDays - days until the limit is reached from a least squares linear fit of the samples.
+// Returns -1 if the user count is not growing.
+func forecastDays(history []licenseSample, count, limit int64) int64 {
+	n := float64(len(history))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range history {
+		x := float64(s.time-history[0].time) / (24 * 60 * 60)
+		y := float64(s.users)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return -1
+	}
+	slope := (n*sumXY - sumX*sumY) / denom // Users per day
+	if slope <= 0 {
+		return -1
+	}
+	if count >= limit {
+		return 0
+	}
+	return int64(float64(limit-count) / slope)
+}
+
+// licenseForecast - records the user count in the history file (at most once per license_refresh),
+// discarding samples older than license_history, and returns the forecast if there is enough history.
+func (m *monitor) licenseForecast(count, limit int64) (int64, bool) {
+	path := m.instancePath("tmp_license_history")
+	history, err := readLicenseHistory(path)
+	if err != nil {
+		m.logger.Warnf("Monitor license: error reading %s: %v", path, err)
+	}
+	now := m.now().Unix()
+	oldest := now - int64(m.config.Monitor.LicenseHistory.Seconds())
+	kept := make([]licenseSample, 0, len(history)+1)
+	for _, s := range history {
+		if s.time >= oldest && s.time <= now {
+			kept = append(kept, s)
+		}
+	}
+	changed := len(kept) != len(history)
+	if len(kept) == 0 || now-kept[len(kept)-1].time >= int64(m.config.Monitor.LicenseRefresh.Seconds()) {
+		kept = append(kept, licenseSample{now, count})
+		changed = true
+	}
+	if changed {
+		if err := writeLicenseHistory(path, kept); err != nil {
+			m.logger.Warnf("Monitor license: error writing %s: %v", path, err)
+		}
+	}
+	if len(kept) < 2 || time.Duration(kept[len(kept)-1].time-kept[0].time)*time.Second < licenseForecastMinSpan {
+		return 0, false
+	}
+	return forecastDays(kept, count, limit), true
+}
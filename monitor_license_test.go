@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitorLicense(t *testing.T) {
+	m, runner := newTestMonitor(t, "1", map[string]string{"p4 -u perforce -p perforce:1666 license -u": testP4License})
+	m.info = parseInfo([]byte(testP4Info))
+	m.serverID = "master.1"
+	out, err := m.collectLicense()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_licensed_user_count P4D Licensed User count
+# TYPE p4_licensed_user_count gauge
+p4_licensed_user_count{serverid="master.1",sdpinst="1"} 893
+# HELP p4_licensed_user_limit P4D Licensed User Limit
+# TYPE p4_licensed_user_limit gauge
+p4_licensed_user_limit{serverid="master.1",sdpinst="1"} 1000
+# HELP p4_license_expires P4D License expiry (epoch secs)
+# TYPE p4_license_expires gauge
+p4_license_expires{serverid="master.1",sdpinst="1"} 1677628800
+# HELP p4_license_time_remaining P4D License time remaining (secs)
+# TYPE p4_license_time_remaining gauge
+p4_license_time_remaining{serverid="master.1",sdpinst="1"} 34431485
+# HELP p4_license_support_expires P4D License support expiry (epoch secs)
+# TYPE p4_license_support_expires gauge
+p4_license_support_expires{serverid="master.1",sdpinst="1"} 1677628800
+# HELP p4_license_users_headroom P4D Licensed users remaining before limit reached
+# TYPE p4_license_users_headroom gauge
+p4_license_users_headroom{serverid="master.1",sdpinst="1"} 107
+# HELP p4_license_info P4D License info
+# TYPE p4_license_info gauge
+p4_license_info{serverid="master.1",sdpinst="1",info="Perforce Software, Inc. 1000 users"} 1
+# HELP p4_license_IP P4D Licensed IP
+# TYPE p4_license_IP gauge
+p4_license_IP{serverid="master.1",sdpinst="1",IP="10.0.0.2"} 1
+`, string(out))
+
+	// Output is cached, so p4 license is not run again
+	_, err = m.collectLicense()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(runner.Calls))
+
+	// Time remaining calculated from support expiry if necessary
+	assert.NoError(t, os.WriteFile(filepath.Join(m.metricsDir, "tmp_license-1-master.1"),
+		[]byte("... userCount 5\n... userLimit 5\n... supportExpires 1643245100\n"), 0644))
+	out, err = m.collectLicense()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_license_time_remaining{serverid="master.1",sdpinst="1"} 100`)
+	assert.NotContains(t, string(out), "p4_license_expires")
+
+	m.info["Server license"] = "none"
+	out, err = m.collectLicense()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_licensed_user_limit{serverid="master.1",sdpinst="1"} 0`)
+	assert.Contains(t, string(out), `p4_license_info{serverid="master.1",sdpinst="1",info="none"} 1`)
+	assert.NotContains(t, string(out), "p4_license_users_headroom")
+
+	// Another instance sharing the metrics directory has its own cache
+	m2, runner2 := newTestMonitor(t, "2", map[string]string{"p4 -u perforce -p perforce:1666 license -u": testP4License})
+	m2.metricsDir = m.metricsDir
+	m2.info = parseInfo([]byte(testP4Info))
+	m2.serverID = "master.2"
+	out, err = m2.collectLicense()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(runner2.Calls))
+	assert.Contains(t, string(out), `p4_licensed_user_count{serverid="master.2",sdpinst="2"} 893`)
+}
+
+func TestForecastDays(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	for _, tc := range []struct {
+		name     string
+		history  []licenseSample
+		count    int64
+		expected int64
+	}{
+		{"10 users per day", []licenseSample{{0, 800}, {day, 810}, {2 * day, 820}}, 820, 18},
+		{"noisy growth", []licenseSample{{0, 800}, {day, 815}, {2 * day, 810}, {3 * day, 830}}, 830, 20},
+		{"flat", []licenseSample{{0, 800}, {day, 800}}, 800, -1},
+		{"shrinking", []licenseSample{{0, 800}, {day, 790}}, 790, -1},
+		{"same time", []licenseSample{{0, 800}, {0, 810}}, 810, -1},
+		{"over limit", []licenseSample{{0, 990}, {day, 1010}}, 1010, 0},
+	} {
+		assert.Equal(t, tc.expected, forecastDays(tc.history, tc.count, 1000), tc.name)
+	}
+}
+
+func TestMonitorLicenseForecast(t *testing.T) {
+	m, _ := newTestMonitor(t, "1", nil)
+	m.serverID = "master.1"
+	now := time.Unix(1643245000, 0)
+	m.now = func() time.Time { return now }
+	historyFile := filepath.Join(m.metricsDir, "tmp_license_history-1-master.1")
+
+	// Not enough history yet
+	_, ok := m.licenseForecast(800, 1000)
+	assert.False(t, ok)
+	now = now.Add(30 * time.Minute) // Within license_refresh so not recorded
+	_, ok = m.licenseForecast(805, 1000)
+	assert.False(t, ok)
+	history, err := readLicenseHistory(historyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []licenseSample{{1643245000, 800}}, history)
+
+	// 10 users per day
+	now = time.Unix(1643245000, 0).Add(24 * time.Hour)
+	days, ok := m.licenseForecast(810, 1000)
+	assert.True(t, ok)
+	assert.Equal(t, int64(19), days)
+
+	// Old samples discarded, leaving no growth
+	now = now.Add(m.config.Monitor.LicenseHistory)
+	days, ok = m.licenseForecast(810, 1000)
+	assert.True(t, ok)
+	assert.Equal(t, int64(-1), days)
+	history, err = readLicenseHistory(historyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []licenseSample{{1643245000 + 86400, 810}, {now.Unix(), 810}}, history)
+
+	// Each instance on the machine has its own history
+	m2, _ := newTestMonitor(t, "2", nil)
+	m2.metricsDir = m.metricsDir
+	m2.serverID = "master.2"
+	m2.now = m.now
+	_, ok = m2.licenseForecast(100, 1000)
+	assert.False(t, ok)
+	history, err = readLicenseHistory(filepath.Join(m.metricsDir, "tmp_license_history-2-master.2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []licenseSample{{now.Unix(), 100}}, history)
+	history, err = readLicenseHistory(historyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(history))
+
+	assert.NoError(t, os.WriteFile(historyFile, []byte("invalid\n1643245000 x\n"), 0644))
+	_, ok = m.licenseForecast(810, 1000)
+	assert.False(t, ok)
+}
@@ -0,0 +1,255 @@
+package main
+
+// Lock metrics for the monitor command - a port of scripts/monitor_metrics.py. The file locks held
+// by p4d processes (from lslocks) are counted by type, and any blocked commands are logged with
+// the user/cmd of the process blocking them (from p4 monitor show).
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// lockInfo - a lock as output by lslocks
+type lockInfo struct {
+	Command lslocksValue `json:"command"`
+	PID     lslocksValue `json:"pid"`
+	Type    lslocksValue `json:"type"`
+	Mode    lslocksValue `json:"mode"`
+	Path    lslocksValue `json:"path"`
+	Blocker lslocksValue `json:"blocker"`
+}
+
+// lslocksValue - depending on version, lslocks -J outputs pid/blocker etc as strings or numbers
+// and missing values as null
+type lslocksValue string
+
+func (v *lslocksValue) UnmarshalJSON(b []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	switch val := raw.(type) {
+	case nil:
+		*v = ""
+	case string:
+		*v = lslocksValue(val)
+	case float64:
+		*v = lslocksValue(strconv.FormatFloat(val, 'f', -1, 64))
+	case bool:
+		*v = lslocksValue(strconv.FormatBool(val))
+	default:
+		return fmt.Errorf("unexpected value: %s", string(b))
+	}
+	return nil
+}
+
+// lslocksVersion - from lslocks -V, e.g. "lslocks from util-linux 2.23.2" -> [2 23 2]
+func lslocksVersion(buf []byte) []int {
+	fields := strings.Fields(string(buf))
+	if len(fields) == 0 {
+		return nil
+	}
+	result := make([]int, 0, 3)
+	for _, p := range strings.Split(fields[len(fields)-1], ".") {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// lslocksSupportsJSON - -J was added in util-linux 2.27
+func lslocksSupportsJSON(ver []int) bool {
+	return len(ver) >= 2 && (ver[0] > 2 || (ver[0] == 2 && ver[1] >= 27))
+}
+
+// parseLslocksJSON - parses the output of lslocks -J, e.g.
+//
+//	{"locks": [{"command": "p4d", "pid": "2502", "type": "FLOCK", "size": "17B", "mode": "READ", "m": "0",
+//	  "start": "0", "end": "0", "path": "/p4/1/root/server.locks/clientEntity/10,d/robomerge-main-ts", "blocker": null}]}
+func parseLslocksJSON(buf []byte) ([]lockInfo, error) {
+	var locks struct {
+		Locks []lockInfo `json:"locks"`
+	}
+	if len(bytes.TrimSpace(buf)) == 0 {
+		return nil, nil // No locks
+	}
+	if err := json.Unmarshal(buf, &locks); err != nil {
+		return nil, fmt.Errorf("failed to parse lslocks output: %v", err)
+	}
+	return locks.Locks, nil
+}
+
+// parseLslocksText - parses the output of older versions of lslocks which don't support JSON. Assumes
+// no spaces in paths. Locks with no path, e.g. OFDLCK, have fewer fields and are ignored.
+//
+//	COMMAND           PID   TYPE SIZE MODE  M START END PATH                       BLOCKER
+//	(unknown)          -1 OFDLCK   0B WRITE 0     0   0 /etc/hosts
+//	p4d               107  FLOCK  16K READ* 0     0   0 /path/db.config            105
+//	p4d               105  FLOCK  16K WRITE 0     0   0 /path/db.config
+func parseLslocksText(buf []byte) []lockInfo {
+	locks := make([]lockInfo, 0)
+	for _, line := range nonEmptyLines(buf) {
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] == "COMMAND" || fields[3] == "START" {
+			continue
+		}
+		l := lockInfo{
+			Command: lslocksValue(fields[0]),
+			PID:     lslocksValue(fields[1]),
+			Type:    lslocksValue(fields[2]),
+			Mode:    lslocksValue(fields[4]),
+			Path:    lslocksValue(fields[8]),
+		}
+		if len(fields) == 10 {
+			l.Blocker = lslocksValue(fields[9])
+		}
+		locks = append(locks, l)
+	}
+	return locks
+}
+
+// monitorProcess - a command as output by p4 monitor show
+type monitorProcess struct {
+	user, cmd, args string
+}
+
+var monitorProcessRE = regexp.MustCompile(`(\d+)\s+(\S+)\s+(\S+)\s+(\S+)\s+(\S+)\s*(.*)$`)
+
+// parseMonitorProcesses - parses p4 -F "%id% %runstate% %user% %elapsed% %function% %args%" monitor show -al
+func parseMonitorProcesses(buf []byte) map[string]monitorProcess {
+	result := make(map[string]monitorProcess)
+	for _, line := range nonEmptyLines(buf) {
+		if m := monitorProcessRE.FindStringSubmatch(line); m != nil {
+			result[m[1]] = monitorProcess{user: m[3], cmd: m[5], args: m[6]}
+		}
+	}
+	return result
+}
+
+// lockCounts - the values output as metrics
+type lockCounts struct {
+	dbRead, dbWrite                     int
+	clientEntityRead, clientEntityWrite int
+	metaRead, metaWrite                 int
+	blockedCommands                     int
+	msgs                                []string // Details of blocked commands
+}
+
+// dbFileInPath - returns the name of the db file, or blank if not a db file
+func dbFileInPath(path string) string {
+	parts := strings.Split(path, "/")
+	p := parts[len(parts)-1]
+	if strings.HasPrefix(p, "db.") || p == "rdb.lbr" {
+		return p
+	}
+	return ""
+}
+
+// findLocks - counts the locks held by p4d processes
+func findLocks(locks []lockInfo, procs map[string]monitorProcess) *lockCounts {
+	counts := &lockCounts{}
+	for _, l := range locks {
+		path := string(l.Path)
+		if !strings.Contains(string(l.Command), "p4d") || path == "" {
+			continue
+		}
+		if strings.Contains(path, "clientEntity") {
+			switch l.Mode {
+			case "READ":
+				counts.clientEntityRead++
+			case "WRITE":
+				counts.clientEntityWrite++
+			}
+		}
+		if strings.Contains(path, "server.locks/meta") {
+			switch l.Mode {
+			case "READ":
+				counts.metaRead++
+			case "WRITE":
+				counts.metaWrite++
+			}
+		}
+		if dbFileInPath(path) != "" {
+			switch l.Mode {
+			case "READ":
+				counts.dbRead++
+			case "WRITE":
+				counts.dbWrite++
+			}
+		}
+		if l.Blocker != "" {
+			counts.blockedCommands++
+			p := procs[string(l.PID)]
+			b, ok := procs[string(l.Blocker)]
+			if !ok {
+				b = monitorProcess{user: "unknown", cmd: "unknown", args: "unknown"}
+			}
+			counts.msgs = append(counts.msgs, fmt.Sprintf("pid %s, user %s, cmd %s, table %s, blocked by pid %s, user %s, cmd %s, args %s",
+				l.PID, p.user, p.cmd, path, l.Blocker, b.user, b.cmd, b.args))
+		}
+	}
+	return counts
+}
+
+func (m *monitor) lockMetrics(counts *lockCounts) []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"p4_locks_db_read", "Database read locks", counts.dbRead},
+		{"p4_locks_db_write", "Database write locks", counts.dbWrite},
+		{"p4_locks_cliententity_read", "clientEntity read locks", counts.clientEntityRead},
+		{"p4_locks_cliententity_write", "clientEntity write locks", counts.clientEntityWrite},
+		{"p4_locks_meta_read", "meta db read locks", counts.metaRead},
+		{"p4_locks_meta_write", "meta db write locks", counts.metaWrite},
+		{"p4_locks_cmds_blocked", "cmds blocked by locks", counts.blockedCommands},
+	} {
+		printHeader(buf, v.name, v.help, "gauge")
+		m.sample(buf, v.name, strconv.Itoa(v.value))
+	}
+	return buf.Bytes()
+}
+
+// collectLocks - lock counts from lslocks (Linux only)
+func (m *monitor) collectLocks() ([]byte, error) {
+	if runtime.GOOS != "linux" {
+		return nil, nil
+	}
+	out, err := m.runner.Run("lslocks", "-V")
+	if err != nil {
+		return nil, err
+	}
+	var locks []lockInfo
+	if lslocksSupportsJSON(lslocksVersion(out)) {
+		if out, err = m.runner.Run("lslocks", "-o", "+BLOCKER", "-J"); err != nil {
+			return nil, err
+		}
+		if locks, err = parseLslocksJSON(out); err != nil {
+			return nil, err
+		}
+	} else {
+		if out, err = m.runner.Run("lslocks", "-o", "+BLOCKER"); err != nil {
+			return nil, err
+		}
+		locks = parseLslocksText(out)
+	}
+	out, err = m.p4("-F", "%id% %runstate% %user% %elapsed% %function% %args%", "monitor", "show", "-al")
+	if err != nil {
+		return nil, err
+	}
+	counts := findLocks(locks, parseMonitorProcesses(out))
+	for _, msg := range counts.msgs {
+		m.logger.Infof("Monitor locks: %s", msg)
+	}
+	return m.lockMetrics(counts), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Captured from util-linux 2.23.2 (CentOS 7) which doesn't support -J
+const testLslocksText = `COMMAND           PID   TYPE SIZE MODE  M START END PATH                       BLOCKER
+(unknown)          -1 OFDLCK   0B WRITE 0     0   0 /etc/hosts
+(unknown)          -1 OFDLCK   0B READ  0     0   0
+p4d               107  FLOCK  16K READ* 0     0   0 /p4/1/root/db.config     105
+p4d               105  FLOCK  16K WRITE 0     0   0 /p4/1/root/db.config
+p4d               105  FLOCK  16K READ  0     0   0 /p4/1/root/db.have
+p4d               108  FLOCK   0B READ  0     0   0 /p4/1/root/server.locks/meta/db
+p4d               109  FLOCK  17B WRITE 0     0   0 /p4/1/root/server.locks/clientEntity/10,d/ws1
+`
+
+// util-linux 2.32 outputs all values as strings
+const testLslocksJSONStrings = `{
+   "locks": [
+      {"command": "p4d", "pid": "2502", "type": "FLOCK", "size": "17B", "mode": "READ", "m": "0", "start": "0", "end": "0", "path": "/p4/1/root/server.locks/clientEntity/10,d/robomerge-main-ts", "blocker": null},
+      {"command": "p4d", "pid": "2503", "type": "FLOCK", "size": "16K", "mode": "WRITE", "m": "0", "start": "0", "end": "0", "path": "/p4/1/root/db.rev", "blocker": null},
+      {"command": "p4d", "pid": "2504", "type": "FLOCK", "size": "16K", "mode": "READ", "m": "0", "start": "0", "end": "0", "path": "/p4/1/root/db.rev", "blocker": "2503"},
+      {"command": "(unknown)", "pid": "-1", "type": "OFDLCK", "size": null, "mode": "READ", "m": "0", "start": "0", "end": "0", "path": null, "blocker": null}
+   ]
+}
+`
+
+// util-linux 2.37 outputs numbers and booleans
+const testLslocksJSONNumbers = `{
+   "locks": [
+      {"command": "p4d_1", "pid": 2502, "type": "FLOCK", "size": 17, "mode": "WRITE", "m": false, "start": 0, "end": 0, "path": "/p4/1/root/server.locks/meta/db", "blocker": null},
+      {"command": "p4d_1", "pid": 2505, "type": "FLOCK", "size": 0, "mode": "READ", "m": false, "start": 0, "end": 0, "path": "/p4/1/root/rdb.lbr", "blocker": 2502}
+   ]
+}
+`
+
+const testMonitorShow = `2502 R fred 00:00:10 sync -f //depot/...
+2503 R bob 00:01:10 submit -d test
+2504 R jim 00:00:01 fstat //depot/a.txt
+`
+
+func TestLslocksVersion(t *testing.T) {
+	for _, tc := range []struct {
+		output   string
+		expected []int
+		json     bool
+	}{
+		{"lslocks from util-linux 2.23.2", []int{2, 23, 2}, false},
+		{"lslocks from util-linux 2.27", []int{2, 27}, true},
+		{"lslocks from util-linux 2.37.2\n", []int{2, 37, 2}, true},
+		{"lslocks from util-linux 3.0", []int{3, 0}, true},
+		{"", nil, false},
+	} {
+		ver := lslocksVersion([]byte(tc.output))
+		if len(tc.expected) == 0 {
+			assert.Empty(t, ver, tc.output)
+		} else {
+			assert.Equal(t, tc.expected, ver, tc.output)
+		}
+		assert.Equal(t, tc.json, lslocksSupportsJSON(ver), tc.output)
+	}
+}
+
+func TestFindLocks(t *testing.T) {
+	procs := parseMonitorProcesses([]byte(testMonitorShow))
+	assert.Equal(t, monitorProcess{user: "fred", cmd: "sync", args: "-f //depot/..."}, procs["2502"])
+
+	jsonLocks := func(s string) []lockInfo {
+		locks, err := parseLslocksJSON([]byte(s))
+		assert.NoError(t, err)
+		return locks
+	}
+	for _, tc := range []struct {
+		name     string
+		locks    []lockInfo
+		expected lockCounts
+	}{
+		{"text", parseLslocksText([]byte(testLslocksText)), lockCounts{dbRead: 1, dbWrite: 1, metaRead: 1,
+			clientEntityWrite: 1, blockedCommands: 1, msgs: []string{
+				"pid 107, user , cmd , table /p4/1/root/db.config, blocked by pid 105, user unknown, cmd unknown, args unknown"}}},
+		{"json strings", jsonLocks(testLslocksJSONStrings), lockCounts{dbRead: 1, dbWrite: 1, clientEntityRead: 1,
+			blockedCommands: 1, msgs: []string{
+				"pid 2504, user jim, cmd fstat, table /p4/1/root/db.rev, blocked by pid 2503, user bob, cmd submit, args -d test"}}},
+		{"json numbers", jsonLocks(testLslocksJSONNumbers), lockCounts{dbRead: 1, metaWrite: 1,
+			blockedCommands: 1, msgs: []string{
+				"pid 2505, user , cmd , table /p4/1/root/rdb.lbr, blocked by pid 2502, user fred, cmd sync, args -f //depot/..."}}},
+		{"empty", jsonLocks(""), lockCounts{}},
+	} {
+		assert.Equal(t, tc.expected, *findLocks(tc.locks, procs), tc.name)
+	}
+	_, err := parseLslocksJSON([]byte("lslocks: unknown option -- J"))
+	assert.Error(t, err)
+}
+
+func TestMonitorLocks(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("lslocks only available on Linux")
+	}
+	m, runner := newTestMonitor(t, "1", map[string]string{
+		"lslocks -V":             "lslocks from util-linux 2.32.1\n",
+		"lslocks -o +BLOCKER -J": testLslocksJSONStrings,
+		"lslocks -o +BLOCKER":    testLslocksText,
+		"p4 -u perforce -p perforce:1666 -F %id% %runstate% %user% %elapsed% %function% %args% monitor show -al": testMonitorShow,
+	})
+	m.serverID = "master"
+	out, err := m.collectLocks()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_locks_db_read Database read locks
+# TYPE p4_locks_db_read gauge
+p4_locks_db_read{serverid="master",sdpinst="1"} 1
+# HELP p4_locks_db_write Database write locks
+# TYPE p4_locks_db_write gauge
+p4_locks_db_write{serverid="master",sdpinst="1"} 1
+# HELP p4_locks_cliententity_read clientEntity read locks
+# TYPE p4_locks_cliententity_read gauge
+p4_locks_cliententity_read{serverid="master",sdpinst="1"} 1
+# HELP p4_locks_cliententity_write clientEntity write locks
+# TYPE p4_locks_cliententity_write gauge
+p4_locks_cliententity_write{serverid="master",sdpinst="1"} 0
+# HELP p4_locks_meta_read meta db read locks
+# TYPE p4_locks_meta_read gauge
+p4_locks_meta_read{serverid="master",sdpinst="1"} 0
+# HELP p4_locks_meta_write meta db write locks
+# TYPE p4_locks_meta_write gauge
+p4_locks_meta_write{serverid="master",sdpinst="1"} 0
+# HELP p4_locks_cmds_blocked cmds blocked by locks
+# TYPE p4_locks_cmds_blocked gauge
+p4_locks_cmds_blocked{serverid="master",sdpinst="1"} 1
+`, string(out))
+
+	// Older versions are parsed as text
+	runner.Outputs["lslocks -V"] = "lslocks from util-linux 2.23.2\n"
+	runner.Calls = nil
+	out, err = m.collectLocks()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_locks_meta_read{serverid="master",sdpinst="1"} 1`)
+	assert.Contains(t, runner.Calls, "lslocks -o +BLOCKER")
+}
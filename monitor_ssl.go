@@ -0,0 +1,139 @@
+package main
+
+// Certificate metrics for the monitor command. Rather than relying on "Server cert expires" from
+// p4 info (which is only for the server connected to), a TLS handshake is made with each ssl P4PORT
+// so that the certificate actually presented to clients is checked, including those of brokers/proxies.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for a TLS handshake
+const sslDialTimeout = 10 * time.Second
+
+// sslAddress - the host:port to connect to for a P4PORT, e.g. ssl:perforce:1666 -> perforce:1666,
+// ssl:1666 -> localhost:1666. Returns blank if the P4PORT is not ssl.
+func sslAddress(p4port string) string {
+	i := strings.Index(p4port, ":")
+	if i < 0 || !strings.HasPrefix(p4port, "ssl") {
+		return ""
+	}
+	addr := p4port[i+1:]
+	if !strings.Contains(addr, ":") {
+		return net.JoinHostPort("localhost", addr)
+	}
+	return addr
+}
+
+// p4Fingerprint - as displayed by p4 trust and p4d -Gf, i.e. the SHA1 of the public key as colon separated hex
+func p4Fingerprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.RawSubjectPublicKeyInfo)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// serverCert - the certificate presented by the server. p4d certificates are normally self signed
+// (clients use p4 trust instead), so the certificate is not verified.
+func serverCert(addr string) (*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: sslDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificate presented", addr)
+	}
+	return certs[0], nil
+}
+
+// sslPorts - ports to check, from config or p4port if it is ssl
+func (m *monitor) sslPorts() []string {
+	if len(m.config.Monitor.SSLPorts) > 0 {
+		return m.config.Monitor.SSLPorts
+	}
+	if sslAddress(m.p4port()) != "" {
+		return []string{m.p4port()}
+	}
+	return nil
+}
+
+// collectSSL - certificate expiry and details for each ssl port. Falls back to p4 info if there are
+// no ssl ports to check, e.g. "Server cert expires: Jun 21 09:50:31 2025 GMT"
+func (m *monitor) collectSSL() ([]byte, error) {
+	ports := m.sslPorts()
+	if len(ports) == 0 {
+		return m.collectSSLInfo()
+	}
+	type result struct {
+		port string
+		cert *x509.Certificate
+	}
+	results := make([]result, 0, len(ports))
+	failed := make(map[string]bool)
+	for _, port := range ports {
+		cert, err := serverCert(sslAddress(port))
+		if err != nil {
+			m.logger.Warnf("Monitor ssl: %s: %v", port, err)
+			failed[port] = true
+			continue
+		}
+		results = append(results, result{port, cert})
+	}
+	// Output even if all handshakes failed, so that p4_ssl_handshake_error can be alerted on
+	buf := new(bytes.Buffer)
+	if len(results) > 0 {
+		printHeader(buf, "p4_ssl_cert_expires", "P4D SSL certificate expiry epoch seconds", "gauge")
+		for _, r := range results {
+			m.sample(buf, "p4_ssl_cert_expires", strconv.FormatInt(r.cert.NotAfter.Unix(), 10), labelPair{"p4port", r.port})
+		}
+		printHeader(buf, "p4_ssl_cert_days_remaining", "Days until P4D SSL certificate expires", "gauge")
+		for _, r := range results {
+			days := int64(r.cert.NotAfter.Sub(m.now()).Hours() / 24)
+			m.sample(buf, "p4_ssl_cert_days_remaining", strconv.FormatInt(days, 10), labelPair{"p4port", r.port})
+		}
+		printHeader(buf, "p4_ssl_cert_info", "P4D SSL certificate details (value is always 1)", "gauge")
+		for _, r := range results {
+			m.sample(buf, "p4_ssl_cert_info", "1", labelPair{"p4port", r.port},
+				labelPair{"issuer", r.cert.Issuer.String()}, labelPair{"subject", r.cert.Subject.String()},
+				labelPair{"fingerprint", p4Fingerprint(r.cert)})
+		}
+	}
+	printHeader(buf, "p4_ssl_handshake_error", "Set to 1 if the TLS handshake failed", "gauge")
+	for _, port := range ports {
+		value := "0"
+		if failed[port] {
+			value = "1"
+		}
+		m.sample(buf, "p4_ssl_handshake_error", value, labelPair{"p4port", port})
+	}
+	return buf.Bytes(), nil
+}
+
+// collectSSLInfo - certificate expiry from p4 info, e.g. "Server cert expires: Jun 21 09:50:31 2025 GMT"
+func (m *monitor) collectSSLInfo() ([]byte, error) {
+	certExpiry := m.info["Server cert expires"]
+	if certExpiry == "" {
+		return nil, nil
+	}
+	expires, err := time.Parse("Jan _2 15:04:05 2006 MST", certExpiry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert expiry: '%s'", certExpiry)
+	}
+	buf := new(bytes.Buffer)
+	printHeader(buf, "p4_ssl_cert_expires", "P4D SSL certificate expiry epoch seconds", "gauge")
+	m.sample(buf, "p4_ssl_cert_expires", strconv.FormatInt(expires.Unix(), 10))
+	return buf.Bytes(), nil
+}
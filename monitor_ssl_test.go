@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTLSServer - a stand in for p4d with a self signed certificate, as generated by p4d -Gc
+func testTLSServer(t *testing.T, notAfter time.Time) (string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "perforce", Organization: []string{"Perforce Autogen Cert"}},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	tmpl.Issuer = tmpl.Subject
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), cert
+}
+
+func TestSSLAddress(t *testing.T) {
+	for port, expected := range map[string]string{
+		"ssl:perforce:1666":  "perforce:1666",
+		"ssl:1666":           "localhost:1666",
+		"ssl64:[::1]:1666":   "[::1]:1666",
+		"ssl4:10.0.0.1:1666": "10.0.0.1:1666",
+		"tcp:perforce:1666":  "",
+		"perforce:1666":      "",
+		"1666":               "",
+	} {
+		assert.Equal(t, expected, sslAddress(port), port)
+	}
+}
+
+func TestMonitorSSL(t *testing.T) {
+	expires := time.Unix(1750499431, 0)
+	addr, cert := testTLSServer(t, expires)
+	m, _ := newTestMonitor(t, "", nil)
+	m.serverID = "master"
+	m.config.Monitor.P4Port = "ssl:" + addr
+	fingerprint := p4Fingerprint(cert)
+	assert.Regexp(t, `^([0-9A-F]{2}:){19}[0-9A-F]{2}$`, fingerprint)
+
+	out, err := m.collectSSL()
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`# HELP p4_ssl_cert_expires P4D SSL certificate expiry epoch seconds
+# TYPE p4_ssl_cert_expires gauge
+p4_ssl_cert_expires{serverid="master",p4port="ssl:%s"} 1750499431
+# HELP p4_ssl_cert_days_remaining Days until P4D SSL certificate expires
+# TYPE p4_ssl_cert_days_remaining gauge
+p4_ssl_cert_days_remaining{serverid="master",p4port="ssl:%s"} 1241
+# HELP p4_ssl_cert_info P4D SSL certificate details (value is always 1)
+# TYPE p4_ssl_cert_info gauge
+p4_ssl_cert_info{serverid="master",p4port="ssl:%s",issuer="CN=perforce,O=Perforce Autogen Cert",subject="CN=perforce,O=Perforce Autogen Cert",fingerprint="%s"} 1
+# HELP p4_ssl_handshake_error Set to 1 if the TLS handshake failed
+# TYPE p4_ssl_handshake_error gauge
+p4_ssl_handshake_error{serverid="master",p4port="ssl:%s"} 0
+`, addr, addr, addr, fingerprint, addr), string(out))
+
+	// Configured ports - one of which isn't listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+	m.config.Monitor.SSLPorts = []string{"ssl:" + addr, "ssl:" + closed}
+	out, err = m.collectSSL()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), fmt.Sprintf(`p4_ssl_handshake_error{serverid="master",p4port="ssl:%s"} 1`, closed))
+	assert.Contains(t, string(out), fmt.Sprintf(`p4_ssl_cert_expires{serverid="master",p4port="ssl:%s"} 1750499431`, addr))
+	assert.NotContains(t, string(out), fmt.Sprintf(`p4_ssl_cert_expires{serverid="master",p4port="ssl:%s"}`, closed))
+
+	// All failing - still output so that the handshake errors can be alerted on
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closed2 := l.Addr().String()
+	l.Close()
+	m.config.Monitor.SSLPorts = []string{"ssl:" + closed, "ssl:" + closed2}
+	out, err = m.collectSSL()
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`# HELP p4_ssl_handshake_error Set to 1 if the TLS handshake failed
+# TYPE p4_ssl_handshake_error gauge
+p4_ssl_handshake_error{serverid="master",p4port="ssl:%s"} 1
+p4_ssl_handshake_error{serverid="master",p4port="ssl:%s"} 1
+`, closed, closed2), string(out))
+
+	// Replacing the file written when the handshake succeeded
+	m.config.Monitor.Collectors = []string{"ssl"}
+	m.config.Monitor.SSLPorts = []string{"ssl:" + addr}
+	assert.Equal(t, 0, m.runCollectors())
+	m.config.Monitor.SSLPorts = []string{"ssl:" + closed}
+	assert.Equal(t, 0, m.runCollectors())
+	buf, err := os.ReadFile(m.outputPath("p4_ssl_info"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), fmt.Sprintf(`p4_ssl_handshake_error{serverid="master",p4port="ssl:%s"} 1`, closed))
+	assert.NotContains(t, string(buf), "p4_ssl_cert_expires")
+}
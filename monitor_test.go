@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/perforce/p4prometheus/p4cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+const testP4Info = `User name: perforce
+Client name: myhost
+Client host: myhost
+Current directory: /p4
+Peer address: 10.0.0.1:52234
+Client address: 10.0.0.1
+Server address: perforce:1666
+Server root: /p4/1/root
+Server date: 2022/03/29 14:15:18 +0000 GMT
+Server uptime: 168:39:20
+Server version: P4D/LINUX26X86_64/2021.2/2201121 (2021/11/30)
+Server encryption: encrypted
+Server cert expires: Jun 21 09:50:31 2025 GMT
+ServerID: master.1
+Server services: commit-server
+Server license: Perforce Software, Inc. 1000 users (expires 2023/03/01) (support ends 2023/03/01)
+Server license-ip: 10.0.0.2
+Case Handling: sensitive
+`
+
+const testP4License = `... userCount 893
+... userLimit 1000
+... licenseExpires 1677628800
+... licenseTimeRemaining 34431485
+... supportExpires 1677628800
+`
+
+func newTestMonitor(t *testing.T, sdpInstance string, outputs map[string]string) (*monitor, *p4cmd.FakeRunner) {
+	cfg := &config.Config{
+		SDPInstance: sdpInstance,
+		Monitor: config.Monitor{
+			P4Bin:          "p4",
+			P4Port:         "perforce:1666",
+			P4User:         "perforce",
+			MetricsDir:     t.TempDir(),
+			Collectors:     config.MonitorCollectors,
+			LicenseRefresh: time.Hour,
+			LicenseHistory: 30 * 24 * time.Hour,
+		},
+	}
+	runner := p4cmd.NewFakeRunner(outputs)
+	m := newMonitor(cfg, logger, runner)
+	m.now = func() time.Time { return time.Unix(1643245000, 0) }
+	m.procDir = t.TempDir()
+	return m, runner
+}
+
+func TestMonitorInit(t *testing.T) {
+	m, runner := newTestMonitor(t, "1", map[string]string{"p4 -u perforce -p perforce:1666 info -s": testP4Info})
+	assert.NoError(t, m.init())
+	assert.Equal(t, "master.1", m.serverID)
+	assert.Equal(t, "168:39:20", m.info["Server uptime"])
+	assert.Equal(t, filepath.Join(m.metricsDir, "p4_uptime-1-master.1.prom"), m.outputPath("p4_uptime"))
+
+	// server.id takes precedence, and only the first line is used
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "server.id"), []byte("commit\nfailed over\n"), 0644))
+	m.env["P4ROOT"] = root
+	assert.NoError(t, m.init())
+	assert.Equal(t, "commit", m.serverID)
+
+	runner.Errors["p4 -u perforce -p perforce:1666 info -s"] = fmt.Errorf("connect failed")
+	assert.Error(t, m.init())
+}
+
+func TestMonitorSDPEnv(t *testing.T) {
+	runner := p4cmd.NewFakeRunner(map[string]string{
+		"/bin/bash -c source /p4/common/bin/p4_vars 1 > /dev/null 2>&1 && env": "P4PORT=ssl:1666\nP4USER=perforce\nLOGS=/p4/1/logs\n",
+	})
+	env, err := loadSDPEnv(runner, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssl:1666", env["P4PORT"])
+	assert.Equal(t, "/p4/1/logs", env["LOGS"])
+
+	m, runner := newTestMonitor(t, "1", map[string]string{"p4 -u perforce -p ssl:1666 info -s": testP4Info})
+	m.config.Monitor.P4Port = ""
+	m.env = env
+	assert.NoError(t, m.init())
+	assert.Equal(t, []string{"p4 -u perforce -p ssl:1666 info -s"}, runner.Calls)
+}
+
+func TestMonitorInfoCollectors(t *testing.T) {
+	m, _ := newTestMonitor(t, "", nil)
+	m.info = parseInfo([]byte(testP4Info))
+	m.serverID = "master.1"
+
+	out, err := m.collectUptime()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_server_uptime P4D Server uptime (seconds)
+# TYPE p4_server_uptime counter
+p4_server_uptime{serverid="master.1"} 607160
+`, string(out))
+
+	out, err = m.collectVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_p4d_build_info P4D Version/build info
+# TYPE p4_p4d_build_info gauge
+p4_p4d_build_info{serverid="master.1",version="P4D/LINUX26X86_64/2021.2/2201121"} 1
+# HELP p4_p4d_server_type P4D server type/services
+# TYPE p4_p4d_server_type gauge
+p4_p4d_server_type{serverid="master.1",services="commit-server"} 1
+`, string(out))
+
+	out, err = m.collectSSL()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_ssl_cert_expires{serverid="master.1"} 1750499431`)
+
+	m.info = parseInfo([]byte("Server uptime: 1:2\n"))
+	_, err = m.collectUptime()
+	assert.Error(t, err)
+	out, err = m.collectSSL()
+	assert.NoError(t, err)
+	assert.Nil(t, out)
+}
+
+func TestMonitorChangeAndProcesses(t *testing.T) {
+	m, _ := newTestMonitor(t, "1", map[string]string{
+		"p4 -u perforce -p perforce:1666 counters": "change = 12345\njournal = 12\nupgrade = 50\n",
+		"p4 -u perforce -p perforce:1666 monitor show -l": ` 1234 R fred       00:00:10 sync //depot/...
+ 1235 R bob        00:01:10 sync //depot/a/...
+ 1236 I bob        00:00:00 monitor show -l
+`,
+	})
+	m.serverID = "master"
+	out, err := m.collectChange()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_change_counter{serverid="master",sdpinst="1"} 12345`)
+
+	// Fake /proc with two p4d_1 processes
+	for pid, cmdline := range map[string]string{
+		"100": "p4d_1\x00-d\x00",
+		"101": "p4d_1\x00-r\x00/p4/1/root\x00",
+		"102": "p4d_10\x00-d\x00",
+		"103": "bash\x00",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(m.procDir, pid), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(m.procDir, pid, "cmdline"), []byte(cmdline), 0644))
+	}
+	out, err = m.collectProcesses()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_monitor_by_cmd P4 running processes
+# TYPE p4_monitor_by_cmd counter
+p4_monitor_by_cmd{serverid="master",sdpinst="1",cmd="monitor"} 1
+p4_monitor_by_cmd{serverid="master",sdpinst="1",cmd="sync"} 2
+# HELP p4_monitor_by_user P4 running processes
+# TYPE p4_monitor_by_user counter
+p4_monitor_by_user{serverid="master",sdpinst="1",user="bob"} 2
+p4_monitor_by_user{serverid="master",sdpinst="1",user="fred"} 1
+# HELP p4_process_count P4 ps running processes
+# TYPE p4_process_count counter
+p4_process_count{serverid="master",sdpinst="1"} 2
+`, string(out))
+}
+
+// p4 -ztag servers on a commit server with an edge, a standby which has stopped replicating and a proxy
+const testServers = `... serverID master
+... type server
+... name master
+... address ssl:perforce:1666
+... services commit-server
+
+... serverID edge1
+... type server
+... name edge1
+... address ssl:edge1:1666
+... services edge-server
+
+... serverID replica1
+... type server
+... name replica1
+... address ssl:replica1:1666
+... services standby
+
+... serverID replica2
+... type server
+... name replica2
+... address ssl:replica2:1666
+... services forwarding-replica
+
+... serverID proxy1
+... type proxy
+... name proxy1
+... address ssl:proxy1:1666
+... services proxy
+
+`
+
+// p4 -ztag servers -J for the same servers - only those which have reported their position
+const testServersJournal = `... serverID master
+... appliedJnl 12
+... appliedPos 3456
+
+... serverID edge1
+... appliedJnl 12
+... appliedPos 3400
+
+... serverID replica2
+... appliedJnl 11
+... appliedPos 98765
+
+`
+
+func TestMonitorReplication(t *testing.T) {
+	m, _ := newTestMonitor(t, "", map[string]string{
+		"p4 -u perforce -p perforce:1666 -ztag servers":    testServers,
+		"p4 -u perforce -p perforce:1666 -ztag servers -J": testServersJournal,
+	})
+	m.serverID = "master"
+	out, err := m.collectReplication()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_replica_curr_jnl Current journal for server
+# TYPE p4_replica_curr_jnl counter
+p4_replica_curr_jnl{serverid="master",servername="master",services="commit-server"} 12
+p4_replica_curr_jnl{serverid="master",servername="edge1",services="edge-server"} 12
+p4_replica_curr_jnl{serverid="master",servername="replica1",services="standby"} 0
+p4_replica_curr_jnl{serverid="master",servername="replica2",services="forwarding-replica"} 11
+# HELP p4_replica_curr_pos Current journal position for server
+# TYPE p4_replica_curr_pos counter
+p4_replica_curr_pos{serverid="master",servername="master",services="commit-server"} 3456
+p4_replica_curr_pos{serverid="master",servername="edge1",services="edge-server"} 3400
+p4_replica_curr_pos{serverid="master",servername="replica1",services="standby"} 0
+p4_replica_curr_pos{serverid="master",servername="replica2",services="forwarding-replica"} 98765
+# HELP p4_replica_replication_error Set to 1 if server is not reporting its journal position
+# TYPE p4_replica_replication_error gauge
+p4_replica_replication_error{serverid="master",servername="master",services="commit-server"} 0
+p4_replica_replication_error{serverid="master",servername="edge1",services="edge-server"} 0
+p4_replica_replication_error{serverid="master",servername="replica1",services="standby"} 1
+p4_replica_replication_error{serverid="master",servername="replica2",services="forwarding-replica"} 0
+# HELP p4_replica_journals_behind Count of how many journals server is behind this one
+# TYPE p4_replica_journals_behind gauge
+p4_replica_journals_behind{serverid="master",servername="edge1",services="edge-server"} 0
+p4_replica_journals_behind{serverid="master",servername="replica2",services="forwarding-replica"} 1
+# HELP p4_replica_lag Server lag behind this one in current journal (bytes, -1 if in a different journal)
+# TYPE p4_replica_lag gauge
+p4_replica_lag{serverid="master",servername="edge1",services="edge-server"} 56
+p4_replica_lag{serverid="master",servername="replica2",services="forwarding-replica"} -1
+`, string(out))
+
+	// Run on a server not in the list, lag can't be calculated
+	m.serverID = "other"
+	out, err = m.collectReplication()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "p4_replica_replication_error")
+	assert.NotContains(t, string(out), "p4_replica_lag")
+}
+
+func TestMonitorPull(t *testing.T) {
+	m, runner := newTestMonitor(t, "", map[string]string{
+		"p4 -u perforce -p perforce:1666 pull -l": `//depot/a.txt 1.2 failed.
+//depot/b.txt 1.3
+//depot/c.txt 1.4
+`,
+		"p4 -u perforce -p perforce:1666 -ztag pull -lj": `... replicaJournalCounter 12670
+... replicaJournalNumber 12671
+... replicaJournalSequence 17984845
+... replicaStatefileModified 1664718313
+... replicaTime 1664718339
+... masterJournalNumber 12671
+... masterJournalSequence 17985009
+`,
+	})
+	m.serverID = "replica1"
+	out, err := m.collectPull()
+	assert.NoError(t, err)
+	assert.Nil(t, out, "not a replica")
+	assert.Empty(t, runner.Calls)
+
+	m.info["Replica of"] = "perforce:1666"
+	m.info["Server services"] = "edge-server"
+	out, err = m.collectPull()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_pull_errors P4 pull transfers failed count
+# TYPE p4_pull_errors counter
+p4_pull_errors{serverid="replica1",services="edge-server"} 1
+# HELP p4_pull_queue P4 pull files in queue count
+# TYPE p4_pull_queue counter
+p4_pull_queue{serverid="replica1",services="edge-server"} 2
+# HELP p4_pull_replica_journals_behind Count of how many journals behind replica is
+# TYPE p4_pull_replica_journals_behind gauge
+p4_pull_replica_journals_behind{serverid="replica1",services="edge-server"} 1
+# HELP p4_pull_replication_error Set to 1 if replication error
+# TYPE p4_pull_replication_error gauge
+p4_pull_replication_error{serverid="replica1",services="edge-server"} 0
+# HELP p4_pull_replica_lag Replica lag count (bytes)
+# TYPE p4_pull_replica_lag gauge
+p4_pull_replica_lag{serverid="replica1",services="edge-server"} 164
+`, string(out))
+
+	// Replica can't talk to master
+	runner.Outputs["p4 -u perforce -p perforce:1666 -ztag pull -lj"] = `... replicaJournalCounter 12671
+... replicaJournalSequence 2568249374
+... masterJournalNumber 12671
+... masterJournalSequence -1
+`
+	out, err = m.collectPull()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_pull_replication_error{serverid="replica1",services="edge-server"} 1`)
+	assert.Contains(t, string(out), `p4_pull_replica_lag{serverid="replica1",services="edge-server"} -1`)
+
+	// Older replicas output nothing for the master when it can't be contacted
+	runner.Outputs["p4 -u perforce -p perforce:1666 -ztag pull -lj"] = `... replicaJournalCounter 12671
+... replicaJournalSequence 2568249374
+`
+	out, err = m.collectPull()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `p4_pull_replication_error{serverid="replica1",services="edge-server"} 1`)
+}
+
+func TestMonitorRealtime(t *testing.T) {
+	m, runner := newTestMonitor(t, "1", map[string]string{
+		"/p4/1/bin/p4d_1 -V": "Perforce - The Fast Software Configuration Management System.\n" +
+			"Rev. P4D/LINUX26X86_64/2021.1/2156517 (2021/05/24).\n",
+		"/p4/1/bin/p4d_1 --show-realtime": `rtv.db.lockwait (flags 0) 0 max 382
+rtv.db.ckp.active (flags 0) 0
+rtv.db.io.records (flags 0) 126389592854
+rtv.svr.sessions.active (flags 0) 110 max 585
+`,
+	})
+	m.env["P4DBIN"] = "/p4/1/bin/p4d_1"
+	m.serverID = "master"
+	out, err := m.collectRealtime()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_rtv_db_lockwait P4 realtime lockwait counter
+# TYPE p4_rtv_db_lockwait gauge
+p4_rtv_db_lockwait{serverid="master",sdpinst="1"} 0
+# HELP p4_rtv_db_ckp_active P4 realtime checkpoint active indicator
+# TYPE p4_rtv_db_ckp_active gauge
+p4_rtv_db_ckp_active{serverid="master",sdpinst="1"} 0
+# HELP p4_rtv_db_io_records P4 realtime IO records counter
+# TYPE p4_rtv_db_io_records counter
+p4_rtv_db_io_records{serverid="master",sdpinst="1"} 126389592854
+# HELP p4_rtv_svr_sessions_active P4 realtime server active sessions counter
+# TYPE p4_rtv_svr_sessions_active gauge
+p4_rtv_svr_sessions_active{serverid="master",sdpinst="1"} 110
+`, string(out))
+
+	// Not supported by older p4d versions
+	runner.Outputs["/p4/1/bin/p4d_1 -V"] = "Rev. P4D/LINUX26X86_64/2019.2/1234567 (2020/01/24).\n"
+	runner.Calls = nil
+	out, err = m.collectRealtime()
+	assert.NoError(t, err)
+	assert.Nil(t, out)
+	assert.Equal(t, []string{"/p4/1/bin/p4d_1 -V"}, runner.Calls)
+}
+
+const testLogSchema = `... f_recordType 4
+... f_recordVersion 58
+... f_field 15
+... f_name f_clientIp
+... f_type 7
+... f_field 16
+... f_name f_severity
+... f_type 8
+... f_field 17
+... f_name f_subsys
+`
+
+func TestMonitorErrors(t *testing.T) {
+	m, _ := newTestMonitor(t, "1", map[string]string{"p4 -u perforce -p perforce:1666 logschema 4": testLogSchema})
+	m.serverID = "master"
+	logs := t.TempDir()
+	m.env["LOGS"] = logs
+
+	// No errors file - any previous output is removed
+	prev := m.outputPath("p4_errors")
+	assert.NoError(t, os.WriteFile(prev, []byte("old"), 0644))
+	out, err := m.collectErrors()
+	assert.NoError(t, err)
+	assert.Nil(t, out)
+	assert.NoFileExists(t, prev)
+
+	errorLine := func(severity, subsys, id string) string {
+		return testErrorLine("4", severity, subsys, id)
+	}
+	content := strings.Join([]string{
+		errorLine("3", "6", "17"),
+		errorLine("3", "6", "17"),
+		errorLine("2", "7", "123"),
+		errorLine("3", "25", "1"),
+		errorLine("3", "", "1"),
+	}, "\n") + "\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(logs, "errors.csv"), []byte(content), 0644))
+	out, err = m.collectErrors()
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP p4_error_count Server errors by id
+# TYPE p4_error_count counter
+p4_error_count{serverid="master",sdpinst="1",subsystem="25",error_id="1",level="3"} 1
+p4_error_count{serverid="master",sdpinst="1",subsystem="SERVER",error_id="123",level="2"} 1
+p4_error_count{serverid="master",sdpinst="1",subsystem="DM",error_id="17",level="3"} 2
+`, string(out))
+}
+
+func TestMonitorErrorsFileNonSDP(t *testing.T) {
+	m, _ := newTestMonitor(t, "", map[string]string{"p4 -u perforce -p perforce:1666 configure show": `P4ROOT=/p4/root (-r)
+P4LOG=/p4/logs/log (-L)
+serverlog.file.3=/p4/logs/errors.csv (configure)
+`})
+	f, err := m.errorsFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "/p4/logs/errors.csv", f)
+}
+
+func TestMonitorRunCollectors(t *testing.T) {
+	m, runner := newTestMonitor(t, "", map[string]string{
+		"p4 -u perforce -p perforce:1666 info -s":  testP4Info,
+		"p4 -u perforce -p perforce:1666 counters": "change = 12345\n",
+	})
+	m.config.Monitor.Collectors = []string{"uptime", "change", "processes"}
+	runner.Errors["p4 -u perforce -p perforce:1666 monitor show -l"] = fmt.Errorf("access denied")
+	assert.NoError(t, m.init())
+	assert.Equal(t, 1, m.runCollectors())
+
+	buf, err := os.ReadFile(filepath.Join(m.metricsDir, "p4_uptime-master.1.prom"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4_server_uptime{serverid="master.1"} 607160`)
+	buf, err = os.ReadFile(filepath.Join(m.metricsDir, "p4_change-master.1.prom"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4_change_counter{serverid="master.1"} 12345`)
+	assert.NoFileExists(t, filepath.Join(m.metricsDir, "p4_monitor-master.1.prom"))
+}
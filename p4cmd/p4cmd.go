@@ -0,0 +1,181 @@
+// Package p4cmd runs p4 (and other) commands and parses their tagged output into records,
+// for collectors which need information not available from the p4d log.
+//
+// Both -ztag output:
+//
+//	... userCount 893
+//	... userLimit 1000
+//
+// and -G (Python marshalled dictionaries) output are supported. Use -G where values may
+// contain newlines, as -ztag output is ambiguous in that case.
+package p4cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record - a single tagged record, e.g. one server from p4 servers
+type Record map[string]string
+
+// Has - returns true if the field is present
+func (r Record) Has(name string) bool {
+	_, ok := r[name]
+	return ok
+}
+
+// String - returns the field, or blank if not present
+func (r Record) String(name string) string {
+	return r[name]
+}
+
+// Int - returns the field as an integer, with an error if not present or not a valid integer
+func (r Record) Int(name string) (int64, error) {
+	v, ok := r[name]
+	if !ok {
+		return 0, fmt.Errorf("field %s not found", name)
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("field %s: invalid integer '%s'", name, v)
+	}
+	return i, nil
+}
+
+// IntOr - returns the field as an integer, or the default if not present or invalid
+func (r Record) IntOr(name string, def int64) int64 {
+	if i, err := r.Int(name); err == nil {
+		return i
+	}
+	return def
+}
+
+// Keys - the field names in order
+func (r Record) Keys() []string {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Runner - runs external commands, so that they can be faked in tests
+type Runner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// ExecRunner - runs commands with the specified environment (the current environment if nil).
+// Commands running longer than Timeout (if set) are killed.
+type ExecRunner struct {
+	Env     []string
+	Timeout time.Duration
+}
+
+// Run - returns stdout, or an error including stderr if the command fails
+func (r *ExecRunner) Run(name string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = r.Env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("%s %s: timed out after %v", name, strings.Join(args, " "), r.Timeout)
+	}
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// FakeRunner - returns canned output for each command line (name and args joined by spaces),
+// e.g. as captured from real servers. All commands run are recorded in Calls.
+type FakeRunner struct {
+	Outputs map[string]string
+	Errors  map[string]error
+	Calls   []string
+}
+
+// NewFakeRunner - a runner returning the specified outputs
+func NewFakeRunner(outputs map[string]string) *FakeRunner {
+	if outputs == nil {
+		outputs = make(map[string]string)
+	}
+	return &FakeRunner{Outputs: outputs, Errors: make(map[string]error)}
+}
+
+// Run - returns the output for the command, or an error if it is not known
+func (r *FakeRunner) Run(name string, args ...string) ([]byte, error) {
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	r.Calls = append(r.Calls, cmd)
+	if err, ok := r.Errors[cmd]; ok {
+		return nil, err
+	}
+	out, ok := r.Outputs[cmd]
+	if !ok {
+		return nil, fmt.Errorf("unexpected command: %s", cmd)
+	}
+	return []byte(out), nil
+}
+
+// P4 - runs p4 commands against a server
+type P4 struct {
+	Runner Runner
+	P4Bin  string
+	Port   string // Blank for P4PORT from the environment
+	User   string // Blank for P4USER from the environment
+}
+
+// Run - runs p4 with the specified global options and command, returning the output
+func (p *P4) Run(args ...string) ([]byte, error) {
+	base := make([]string, 0, 4+len(args))
+	if p.User != "" {
+		base = append(base, "-u", p.User)
+	}
+	if p.Port != "" {
+		base = append(base, "-p", p.Port)
+	}
+	return p.Runner.Run(p.P4Bin, append(base, args...)...)
+}
+
+// RunZtag - runs the command with -ztag and parses the output
+func (p *P4) RunZtag(args ...string) ([]Record, error) {
+	out, err := p.Run(append([]string{"-ztag"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return ParseZtag(out), nil
+}
+
+// RunMarshal - runs the command with -G and parses the output. Error messages from the server
+// (e.g. "Perforce password (P4PASSWD) invalid or unset.") are returned as an error.
+func (p *P4) RunMarshal(args ...string) ([]Record, error) {
+	out, err := p.Run(append([]string{"-G"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	records, err := ParseMarshal(out)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Record, 0, len(records))
+	for _, r := range records {
+		if r["code"] == "error" {
+			return nil, fmt.Errorf("p4 %s: %s", strings.Join(args, " "), strings.TrimSpace(r["data"]))
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
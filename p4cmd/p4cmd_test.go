@@ -0,0 +1,131 @@
+package p4cmd
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseZtag(t *testing.T) {
+	// p4 -ztag pull -lj when the replica can't authenticate to the master
+	records := ParseZtag([]byte(`Perforce password (P4PASSWD) invalid or unset.
+... replicaJournalCounter 12671
+... replicaJournalSequence 17984845
+... masterJournalSequence -1
+`))
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, Record{"replicaJournalCounter": "12671", "replicaJournalSequence": "17984845",
+		"masterJournalSequence": "-1"}, records[0])
+
+	// Multiple records, empty values, multi-line values and nested fields
+	records = ParseZtag([]byte("... serverID master\r\n... type server\r\n... Description Line 1\r\nLine 2\r\n\r\n" +
+		"... serverID edge1\n... type server\n... Address\n... ... otherOpen0 fred@ws\n\n\n"))
+	assert.Equal(t, []Record{
+		{"serverID": "master", "type": "server", "Description": "Line 1\nLine 2"},
+		{"serverID": "edge1", "type": "server", "Address": "", "otherOpen0": "fred@ws"},
+	}, records)
+
+	assert.Empty(t, ParseZtag([]byte("")))
+	assert.Empty(t, ParseZtag([]byte("No such file(s).\n")))
+}
+
+func TestRecord(t *testing.T) {
+	r := Record{"userCount": "893", "name": "fred", "bad": "1x"}
+	assert.True(t, r.Has("name"))
+	assert.False(t, r.Has("missing"))
+	assert.Equal(t, "fred", r.String("name"))
+	assert.Equal(t, "", r.String("missing"))
+	v, err := r.Int("userCount")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(893), v)
+	_, err = r.Int("bad")
+	assert.Error(t, err)
+	_, err = r.Int("missing")
+	assert.Error(t, err)
+	assert.Equal(t, int64(-1), r.IntOr("missing", -1))
+	assert.Equal(t, int64(893), r.IntOr("userCount", -1))
+	assert.Equal(t, []string{"bad", "name", "userCount"}, r.Keys())
+}
+
+func TestParseMarshal(t *testing.T) {
+	rec1 := Record{"code": "stat", "serverID": "master", "Description": "Line 1\nLine 2"}
+	rec2 := Record{"code": "stat", "serverID": "edge1"}
+	buf := append(MarshalRecord(rec1), MarshalRecord(rec2)...)
+	records, err := ParseMarshal(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []Record{rec1, rec2}, records)
+
+	// Other types, as output by Python marshal.dumps({'i': 5, 'neg': -2, 'big': 2**40, 'none': None, 't': True})
+	var b bytes.Buffer
+	b.WriteString("{")
+	b.Write([]byte{'s', 1, 0, 0, 0, 'i', 'i', 5, 0, 0, 0})
+	b.Write([]byte{'u', 3, 0, 0, 0, 'n', 'e', 'g', 'i', 0xfe, 0xff, 0xff, 0xff})
+	b.Write([]byte{'t', 3, 0, 0, 0, 'b', 'i', 'g', 'l', 3, 0, 0, 0, 0, 0, 0, 0, 0, 0x04})
+	b.Write([]byte{'s', 4, 0, 0, 0, 'n', 'o', 'n', 'e', 'N'})
+	b.Write([]byte{'s', 1, 0, 0, 0, 't', 'T'})
+	b.WriteString("0")
+	records, err = ParseMarshal(b.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, []Record{{"i": "5", "neg": "-2", "big": fmt.Sprintf("%d", int64(1)<<40), "none": "", "t": "true"}}, records)
+
+	for _, bad := range [][]byte{
+		[]byte("... ztag output"),
+		{'{', 's', 1, 0, 0, 0},
+		{'{', 's', 1, 0, 0, 0, 'k', 's', 9, 0, 0, 0, 'v'},
+		{'{', 's', 1, 0, 0, 0, 'k', '0'},
+		{'{', 's', 1, 0, 0, 0, 'k', 'x', '0'},
+	} {
+		_, err := ParseMarshal(bad)
+		assert.Error(t, err, "%q", bad)
+	}
+}
+
+func TestFakeRunner(t *testing.T) {
+	r := NewFakeRunner(map[string]string{"p4 -p perforce:1666 -ztag info": "... serverID master\n"})
+	r.Errors["p4 -p perforce:1666 -ztag pull -lj"] = fmt.Errorf("not a replica")
+	p := &P4{Runner: r, P4Bin: "p4", Port: "perforce:1666"}
+	records, err := p.RunZtag("info")
+	assert.NoError(t, err)
+	assert.Equal(t, []Record{{"serverID": "master"}}, records)
+	_, err = p.RunZtag("pull", "-lj")
+	assert.Error(t, err)
+	_, err = p.Run("counters")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"p4 -p perforce:1666 -ztag info", "p4 -p perforce:1666 -ztag pull -lj",
+		"p4 -p perforce:1666 counters"}, r.Calls)
+}
+
+func TestRunMarshal(t *testing.T) {
+	r := NewFakeRunner(map[string]string{
+		"p4 -u perforce -G servers": string(MarshalRecord(Record{"code": "stat", "serverID": "master"})),
+		"p4 -u perforce -G license -u": string(MarshalRecord(Record{"code": "error", "severity": "3",
+			"data": "Perforce password (P4PASSWD) invalid or unset.\n"})),
+	})
+	p := &P4{Runner: r, P4Bin: "p4", User: "perforce"}
+	records, err := p.RunMarshal("servers")
+	assert.NoError(t, err)
+	assert.Equal(t, "master", records[0].String("serverID"))
+	_, err = p.RunMarshal("license", "-u")
+	assert.EqualError(t, err, "p4 license -u: Perforce password (P4PASSWD) invalid or unset.")
+}
+
+func TestExecRunner(t *testing.T) {
+	r := &ExecRunner{}
+	out, err := r.Run("echo", "hello")
+	if err != nil {
+		t.Skipf("echo not available: %v", err)
+	}
+	assert.Equal(t, "hello\n", string(out))
+	_, err = r.Run("sh", "-c", "echo failed >&2; exit 1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed")
+
+	r.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err = r.Run("sleep", "10")
+	assert.EqualError(t, err, "sleep 10: timed out after 100ms")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
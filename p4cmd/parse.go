@@ -0,0 +1,198 @@
+package p4cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ParseZtag - parses p4 -ztag output. Records are separated by blank lines. Lines not starting with
+// "... " are treated as continuations of the previous value (e.g. multi-line descriptions), or ignored
+// if before the first field (e.g. warnings output by p4).
+func ParseZtag(buf []byte) []Record {
+	result := make([]Record, 0)
+	var rec Record
+	lastKey := ""
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			if rec != nil {
+				result = append(result, rec)
+			}
+			rec = nil
+			lastKey = ""
+			continue
+		}
+		if !strings.HasPrefix(line, "... ") {
+			if rec != nil && lastKey != "" {
+				rec[lastKey] += "\n" + line
+			}
+			continue
+		}
+		// Nested fields, e.g. "... ... otherOpen0 fred@ws" from fstat
+		for strings.HasPrefix(line, "... ") {
+			line = line[4:]
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if rec == nil {
+			rec = make(Record)
+		}
+		lastKey = parts[0]
+		if len(parts) == 2 {
+			rec[lastKey] = parts[1]
+		} else {
+			rec[lastKey] = ""
+		}
+	}
+	if rec != nil {
+		result = append(result, rec)
+	}
+	return result
+}
+
+// Python marshal type codes as output by p4 -G
+const (
+	marshalDict     = '{'
+	marshalNull     = '0' // End of dict
+	marshalString   = 's'
+	marshalUnicode  = 'u'
+	marshalInterned = 't'
+	marshalInt      = 'i'
+	marshalLong     = 'l'
+	marshalNone     = 'N'
+	marshalTrue     = 'T'
+	marshalFalse    = 'F'
+)
+
+type marshalReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *marshalReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, fmt.Errorf("unexpected end of data at offset %d", r.pos)
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *marshalReader) int32() (int32, error) {
+	if r.pos+4 > len(r.buf) {
+		return 0, fmt.Errorf("unexpected end of data at offset %d", r.pos)
+	}
+	v := int32(binary.LittleEndian.Uint32(r.buf[r.pos:]))
+	r.pos += 4
+	return v, nil
+}
+
+// value - returns the next value as a string. end is true for the end of dict marker.
+func (r *marshalReader) value() (v string, end bool, err error) {
+	t, err := r.byte()
+	if err != nil {
+		return "", false, err
+	}
+	switch t {
+	case marshalNull:
+		return "", true, nil
+	case marshalString, marshalUnicode, marshalInterned:
+		n, err := r.int32()
+		if err != nil {
+			return "", false, err
+		}
+		if n < 0 || r.pos+int(n) > len(r.buf) {
+			return "", false, fmt.Errorf("invalid string length %d at offset %d", n, r.pos)
+		}
+		v = string(r.buf[r.pos : r.pos+int(n)])
+		r.pos += int(n)
+		return v, false, nil
+	case marshalInt:
+		i, err := r.int32()
+		return strconv.FormatInt(int64(i), 10), false, err
+	case marshalLong:
+		// Number of 15 bit digits, least significant first, negative for negative numbers
+		n, err := r.int32()
+		if err != nil {
+			return "", false, err
+		}
+		digits := int(n)
+		if digits < 0 {
+			digits = -digits
+		}
+		if r.pos+2*digits > len(r.buf) {
+			return "", false, fmt.Errorf("unexpected end of data at offset %d", r.pos)
+		}
+		result := new(big.Int)
+		for i := digits - 1; i >= 0; i-- {
+			d := binary.LittleEndian.Uint16(r.buf[r.pos+2*i:])
+			result.Lsh(result, 15)
+			result.Or(result, big.NewInt(int64(d)))
+		}
+		r.pos += 2 * digits
+		if n < 0 {
+			result.Neg(result)
+		}
+		return result.String(), false, nil
+	case marshalNone:
+		return "", false, nil
+	case marshalTrue:
+		return "true", false, nil
+	case marshalFalse:
+		return "false", false, nil
+	}
+	return "", false, fmt.Errorf("unsupported marshal type '%c' at offset %d", t, r.pos-1)
+}
+
+// ParseMarshal - parses p4 -G output, i.e. a sequence of Python marshalled dictionaries
+func ParseMarshal(buf []byte) ([]Record, error) {
+	result := make([]Record, 0)
+	r := &marshalReader{buf: buf}
+	for r.pos < len(buf) {
+		t, _ := r.byte()
+		if t != marshalDict {
+			return nil, fmt.Errorf("expected dictionary at offset %d", r.pos-1)
+		}
+		rec := make(Record)
+		for {
+			key, end, err := r.value()
+			if err != nil {
+				return nil, err
+			}
+			if end {
+				break
+			}
+			value, end, err := r.value()
+			if err != nil {
+				return nil, err
+			}
+			if end {
+				return nil, fmt.Errorf("missing value for %s at offset %d", key, r.pos-1)
+			}
+			rec[key] = value
+		}
+		result = append(result, rec)
+	}
+	return result, nil
+}
+
+// MarshalRecord - encodes a record as p4 -G does, e.g. for creating test data.
+// Fields are written in key order.
+func MarshalRecord(rec Record) []byte {
+	var buf bytes.Buffer
+	writeString := func(s string) {
+		buf.WriteByte(marshalString)
+		binary.Write(&buf, binary.LittleEndian, int32(len(s)))
+		buf.WriteString(s)
+	}
+	buf.WriteByte(marshalDict)
+	for _, k := range rec.Keys() {
+		writeString(k)
+		writeString(rec[k])
+	}
+	buf.WriteByte(marshalNull)
+	return buf.Bytes()
+}
@@ -3,19 +3,24 @@ package main
 // This command line utility builds on top of the p4d log analyzer
 // and outputs Prometheus metrics in a single file to be picked up by
 // node_exporter's textfile.collector module.
+// Optionally the metrics can also be served directly over HTTP, or pushed elsewhere (see sinks.go).
 
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/perforce/p4prometheus/config"
 	"github.com/perforce/p4prometheus/version"
+	p4dlog "github.com/rcowham/go-libp4dlog"
 	metrics "github.com/rcowham/go-libp4dlog/metrics"
 	"github.com/rcowham/go-libtail/tailer"
 	"github.com/rcowham/go-libtail/tailer/fswatcher"
@@ -39,8 +44,21 @@ type logConfig struct {
 
 // P4Prometheus structure
 type P4Prometheus struct {
-	config *config.Config
-	logger *logrus.Logger
+	config      *config.Config
+	logger      *logrus.Logger
+	state       *stateTracker
+	server      *metricsServer
+	sinks       []metricsSink
+	anonymiser  *anonymiser
+	limiter     *labelLimiter
+	self        *selfMetrics
+	errors      *errorCounter  // Nil unless tailing errors_log_path
+	histograms  *cmdHistograms // Nil unless cmd_histograms set
+	slowLog     *slowCmdLog    // Nil unless slow_cmd_log set
+	tableLocks  *tableLocks    // Nil unless table_lock_metrics set
+	filter      *cmdFilter     // Nil unless any filter_* set
+	custom      *customMetrics // Nil unless custom_metrics set
+	lastMetrics []byte         // As last output by parser
 }
 
 // GO standard reference value/format: Mon Jan 2 15:04:05 -0700 MST 2006
@@ -48,8 +66,12 @@ const p4timeformat = "2006/01/02 15:04:05"
 
 func newP4Prometheus(config *config.Config, logger *logrus.Logger) (p4p *P4Prometheus) {
 	return &P4Prometheus{
-		config: config,
-		logger: logger,
+		config:     config,
+		logger:     logger,
+		sinks:      backgroundSinks(newSinks(config, logger), logger),
+		anonymiser: newAnonymiser(config),
+		limiter:    newLabelLimiter(config),
+		self:       newSelfMetrics(config),
 	}
 }
 
@@ -67,28 +89,135 @@ func readServerID(logger *logrus.Logger, instance string) string {
 	return ""
 }
 
-// Writes metrics to appropriate file - writes to temp file first and renames it after
-func (p4p *P4Prometheus) writeMetricsFile(metrics []byte) {
-	var f *os.File
-	var err error
-	tmpFile := p4p.config.MetricsOutput + ".tmp"
-	f, err = os.Create(tmpFile)
-	if err != nil {
-		p4p.logger.Errorf("Error opening %s: %v", tmpFile, err)
+// outputMetrics - adds self metrics and any saved counter values to the metrics from the parser
+// and writes them to the configured outputs and/or HTTP server
+func (p4p *P4Prometheus) outputMetrics(metrics []byte) {
+	p4p.lastMetrics = metrics
+	if p4p.tableLocks != nil {
+		// Before anonymising as the top commands have user labels
+		metrics = append(append([]byte{}, metrics...), p4p.tableLocks.output(p4p.self.fixedLabels())...)
+	}
+	if p4p.custom != nil {
+		// Also before anonymising as the labels may include users/IPs
+		metrics = append(append([]byte{}, metrics...), p4p.custom.output(p4p.self.fixedLabels())...)
+	}
+	p4p.sinkResults()
+	// Before state is saved so that the state file does not contain users/IPs either
+	metrics = append(p4p.anonymiser.apply(metrics), p4p.self.output()...)
+	if p4p.errors != nil {
+		metrics = append(metrics, p4p.errors.output(p4p.self.fixedLabels())...)
+	}
+	if p4p.histograms != nil {
+		metrics = append(metrics, p4p.histograms.output(p4p.self.fixedLabels())...)
+	}
+	if p4p.filter != nil {
+		metrics = append(metrics, p4p.filter.output(p4p.self.fixedLabels())...)
+	}
+	if p4p.state != nil {
+		metrics = p4p.state.adjust(metrics)
+	}
+	// After adjusting so that all values are saved in the state
+	metrics = p4p.limiter.apply(metrics)
+	for _, s := range p4p.sinks {
+		if _, ok := s.(*asyncSink); ok {
+			s.write(metrics) // Results collected for the next output
+			continue
+		}
+		if err := s.write(metrics); err != nil {
+			p4p.logger.Errorf("Error writing metrics to %s: %v", s.name(), err)
+			p4p.self.writeErrors[s.name()]++
+		} else {
+			p4p.self.lastWrite[s.name()] = time.Now()
+		}
+	}
+	if p4p.server != nil {
+		p4p.server.update(p4p.config.LogPath, metrics)
+	}
+}
+
+// sinkResults - records the results of writes by the sinks written in the background since the
+// previous output
+func (p4p *P4Prometheus) sinkResults() {
+	for _, s := range p4p.sinks {
+		if a, ok := s.(*asyncSink); ok {
+			errors, lastWrite := a.results()
+			if errors > 0 {
+				p4p.self.writeErrors[a.name()] += errors
+			}
+			if !lastWrite.IsZero() {
+				p4p.self.lastWrite[a.name()] = lastWrite
+			}
+		}
+	}
+}
+
+// needCmds - whether commands parsed from the log are required, rather than just the metrics
+func needCmds(cfg *config.Config) bool {
+	return cfg.CmdHistograms || cfg.SlowCmdLog != "" || cfg.TableLockMetrics
+}
+
+// addCmd - a command parsed from the log, for the histograms, table locks and slow command log
+func (p4p *P4Prometheus) addCmd(cmd p4dlog.Command) {
+	if p4p.histograms != nil {
+		p4p.histograms.add(cmd)
+	}
+	if p4p.tableLocks != nil {
+		p4p.tableLocks.add(cmd)
+	}
+	if p4p.slowLog != nil {
+		logged, err := p4p.slowLog.add(cmd)
+		if err != nil {
+			p4p.logger.Errorf("Error writing slow command log: %v", err)
+			p4p.self.slowCmdErrors++
+		} else if logged {
+			p4p.self.slowCmdsLogged++
+		}
+	}
+}
+
+// saveState - saves state if required
+func (p4p *P4Prometheus) saveState() {
+	if p4p.state == nil {
 		return
 	}
-	f.Write(bytes.ToValidUTF8(metrics, []byte{'?'}))
-	err = f.Close()
-	if err != nil {
-		p4p.logger.Errorf("Error closing file: %v", err)
+	if err := p4p.state.save(); err != nil {
+		p4p.logger.Errorf("error saving state to %s: %v", p4p.config.StateFile, err)
+		p4p.self.stateErrors++
 	}
-	err = os.Chmod(tmpFile, 0644)
-	if err != nil {
-		p4p.logger.Errorf("Error chmod-ing file: %v", err)
+}
+
+// prepareInstances - returns the config for each log to be processed, with server id set
+func prepareInstances(logger *logrus.Logger, cfg *config.Config) ([]*config.Config, error) {
+	instances := cfg.InstanceConfigs()
+	for _, icfg := range instances {
+		logger.Infof("Processing log file: '%s' output to '%s' SDP instance '%s'",
+			icfg.LogPath, icfg.MetricsOutput, icfg.SDPInstance)
+		if icfg.SDPInstance == "" && len(icfg.ServerID) == 0 {
+			return nil, fmt.Errorf("if no sdp_instance then please specifiy server_id!")
+		}
+		if len(icfg.ServerID) == 0 && icfg.SDPInstance != "" {
+			icfg.ServerID = readServerID(logger, icfg.SDPInstance)
+		}
+		logger.Infof("Server id: '%s'", icfg.ServerID)
 	}
-	err = os.Rename(tmpFile, p4p.config.MetricsOutput)
-	if err != nil {
-		p4p.logger.Errorf("Error renaming: %s to %s - %v", tmpFile, p4p.config.MetricsOutput, err)
+	return instances, nil
+}
+
+// Returns the config for the log parser/metrics library
+func newMetricsConfig(cfg *config.Config, debug bool) *metrics.Config {
+	debugInt := 0
+	if debug {
+		debugInt = 1
+	}
+	return &metrics.Config{
+		Debug:                 debugInt,
+		ServerID:              cfg.ServerID,
+		SDPInstance:           cfg.SDPInstance,
+		UpdateInterval:        cfg.UpdateInterval,
+		OutputCmdsByUser:      cfg.OutputCmdsByUser,
+		OutputCmdsByUserRegex: cfg.OutputCmdsByUserRegex,
+		OutputCmdsByIP:        cfg.OutputCmdsByIP,
+		CaseSensitiveServer:   cfg.CaseSensitiveServer,
 	}
 }
 
@@ -118,78 +247,375 @@ func getTailer(cfgInput *logConfig, logger *logrus.Logger) (fswatcher.FileTailer
 	return tail, nil
 }
 
-func runLogTailer(logger *logrus.Logger, logcfg *logConfig, cfg *config.Config, debug bool) {
+// Returned if the final metrics could not be output within the shutdown timeout
+var errShutdownTimeout = errors.New("timed out waiting for log lines to be processed on shutdown")
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// runLogTailer - tails the log for a single instance and writes metrics until ctx is cancelled.
+// Errors are returned rather than exiting so that other instances can continue.
+// New configs received on reloadChan are applied without losing counter values.
+// On cancellation, lines already read are processed and final metrics written before returning.
+func runLogTailer(ctx context.Context, logger *logrus.Logger, logcfg *logConfig, cfg *config.Config,
+	server *metricsServer, reloadChan <-chan *config.Config, debug bool) error {
+
+	// The parser has its own context so that it can finish processing on shutdown
+	parserCtx, parserCancel := context.WithCancel(context.Background())
+	defer parserCancel()
+
+	// Setup P4Prometheus object and a file parser
+	p4p := newP4Prometheus(cfg, logger)
+	p4p.server = server
+	defer func() { closeSinks(p4p.sinks, 0) }()
+
+	// Must be loaded before the tailer starts to know which lines need re-reading.
+	// Also used to keep counters monotonic if the parser is restarted.
+	var err error
+	p4p.state, err = newStateTracker(cfg.StateFile, cfg.LogPath, logger)
+	if err != nil {
+		return fmt.Errorf("error loading state: %v", err)
+	}
 
 	tailer, err := getTailer(logcfg, logger)
 	if err != nil {
-		logger.Errorf("error starting to tail log lines: %v", err)
-		os.Exit(-2)
+		return fmt.Errorf("error starting to tail log lines: %v", err)
 	}
+	var closeOnce sync.Once
+	closeTailer := func() { closeOnce.Do(tailer.Close) }
+	defer closeTailer()
 
-	// Setup P4Prometheus object and a file parser
-	p4p := newP4Prometheus(cfg, logger)
+	// The structured error log is optional, and errors reading it are not fatal
+	var errorsLines chan *fswatcher.Line
+	var errorsErrors chan fswatcher.Error
+	if cfg.ErrorsLogPath != "" {
+		errorsLogcfg := *logcfg
+		errorsLogcfg.Path = cfg.ErrorsLogPath
+		errorsTailer, err := getTailer(&errorsLogcfg, logger)
+		if err != nil {
+			return fmt.Errorf("error starting to tail error log lines: %v", err)
+		}
+		defer errorsTailer.Close()
+		errorsLines = errorsTailer.Lines()
+		errorsErrors = errorsTailer.Errors()
+		p4p.errors = newTailErrorCounter(cfg)
+	}
 
-	debugInt := 0
-	if debug {
-		debugInt = 1
+	if cfg.CmdHistograms {
+		p4p.histograms = newCmdHistograms(cfg)
 	}
-	mcfg := &metrics.Config{
-		Debug:                 debugInt,
-		ServerID:              cfg.ServerID,
-		SDPInstance:           cfg.SDPInstance,
-		UpdateInterval:        cfg.UpdateInterval,
-		OutputCmdsByUser:      cfg.OutputCmdsByUser,
-		OutputCmdsByUserRegex: cfg.OutputCmdsByUserRegex,
-		OutputCmdsByIP:        cfg.OutputCmdsByIP,
-		CaseSensitiveServer:   cfg.CaseSensitiveServer,
+	if cfg.SlowCmdLog != "" {
+		p4p.slowLog = newSlowCmdLog(cfg)
+		defer p4p.slowLog.close()
+	}
+	if cfg.TableLockMetrics {
+		p4p.tableLocks = newTableLocks(cfg)
+	}
+	if filtering(cfg) {
+		p4p.filter = newCmdFilter(cfg)
+	}
+	if len(cfg.CustomMetrics) > 0 {
+		p4p.custom = newCustomMetrics(cfg)
 	}
-	logger.Infof("P4Prometheus config: %+v", mcfg)
-	mp := metrics.NewP4DMetricsLogParser(mcfg, logger, false)
 
-	linesChan := make(chan string, 10000)
-	_, metricsChan := mp.ProcessEvents(ctx, linesChan, false)
+	// A new parser is required if parser settings are changed on reload.
+	// Parsed commands are only required for the histograms, table locks and slow command log.
+	startParser := func() (chan string, chan p4dlog.Command, chan string) {
+		mcfg := newMetricsConfig(cfg, debug)
+		logger.Infof("P4Prometheus config: %+v", mcfg)
+		mp := metrics.NewP4DMetricsLogParser(mcfg, logger, false)
+		linesChan := make(chan string, 10000)
+		cmdsChan, metricsChan := mp.ProcessEvents(parserCtx, linesChan, needCmds(cfg))
+		return linesChan, cmdsChan, metricsChan
+	}
+	linesChan, cmdsChan, metricsChan := startParser()
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigs
-		logger.Infof("Terminating - signal %v", sig)
-		tailer.Close()
-		cancel()
-	}()
+	// Commands are sent by the parser before the metrics including them, so all those
+	// counted in the metrics are queued when the metrics are received
+	drainCmds := func() {
+		for {
+			select {
+			case cmd, ok := <-cmdsChan:
+				if !ok {
+					cmdsChan = nil
+					return
+				}
+				p4p.addCmd(cmd)
+			default:
+				return
+			}
+		}
+	}
+
+	// Sends a line to the parser, processing its commands and metrics while waiting, as otherwise
+	// the parser blocks when their channels are full, e.g. when catching up on a large part of the log
+	var paceStart time.Time
+	paceBlocks := 0
+	toParser := func(line string) {
+		var pace <-chan time.Time
+		var now time.Time
+		if blockStart(line) {
+			now = time.Now()
+			if now.Sub(paceStart) >= time.Second {
+				paceStart, paceBlocks = now, 0
+			}
+			paceBlocks++
+			// See config.DefaultParserMaxBlocksPerSec
+			if max := cfg.ParserMaxBlocksPerSec; max > 0 && paceBlocks > max {
+				pace = time.After(paceStart.Add(time.Second).Sub(now))
+			}
+		}
+		for metricsChan := metricsChan; ; {
+			out := linesChan
+			if pace != nil {
+				out = nil
+			}
+			select {
+			case <-pace:
+				pace = nil
+				p4p.self.parserPaced += time.Since(now)
+				paceStart, paceBlocks = time.Now(), 1
+			case out <- line:
+				return
+			case cmd, ok := <-cmdsChan:
+				if !ok {
+					cmdsChan = nil
+					continue
+				}
+				p4p.addCmd(cmd)
+			case metric, ok := <-metricsChan:
+				if !ok {
+					metricsChan = nil
+					continue
+				}
+				p4p.self.linesQueued = len(linesChan)
+				drainCmds()
+				p4p.outputMetrics([]byte(metric))
+			}
+		}
+	}
+	// Excluded commands are dropped before reaching the parser
+	sendLine := func(line string) {
+		if p4p.custom != nil {
+			p4p.custom.add(line)
+		}
+		if p4p.filter != nil {
+			p4p.filter.filter(line, toParser)
+		} else {
+			toParser(line)
+		}
+	}
+
+	if err := p4p.state.catchUp(sendLine); err != nil {
+		logger.Errorf("error re-reading log %s: %v", cfg.LogPath, err)
+	}
+
+	// Checkpoint state periodically and on termination
+	var stateTicker *time.Ticker
+	var stateTickerChan <-chan time.Time
+	if cfg.StateFile != "" {
+		stateTicker = time.NewTicker(cfg.StateSaveInterval)
+		defer stateTicker.Stop()
+		stateTickerChan = stateTicker.C
+		defer p4p.saveState()
+	}
+
+	// Stops tailing and lets the parser finish with all lines read so far, outputting its final metrics.
+	// With no timeout (on reload) waits until complete.
+	flush := func(timeout <-chan time.Time) error {
+		close(linesChan)
+		for {
+			select {
+			case metric, ok := <-metricsChan:
+				if !ok {
+					return nil
+				}
+				drainCmds()
+				p4p.outputMetrics([]byte(metric))
+			case cmd, ok := <-cmdsChan:
+				if !ok {
+					cmdsChan = nil
+					continue
+				}
+				p4p.addCmd(cmd)
+			case <-timeout:
+				return errShutdownTimeout
+			}
+		}
+	}
+	shutdown := func() error {
+		logger.Infof("Shutting down log %s - processing remaining log lines", cfg.LogPath)
+		deadline := time.Now().Add(cfg.ShutdownTimeout)
+		timeout := time.After(cfg.ShutdownTimeout)
+		closeTailer()
+		lines := tailer.Lines()
+		for lines != nil {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					lines = nil
+					continue
+				}
+				p4p.state.lineRead(line.Line)
+				sendLine(line.Line)
+			case <-timeout:
+				return errShutdownTimeout
+			}
+		}
+		if err := flush(timeout); err != nil {
+			return err
+		}
+		// So that the final metrics are pushed
+		closeSinks(p4p.sinks, time.Until(deadline))
+		return nil
+	}
 
 	for {
 		select {
+		case <-ctx.Done():
+			return shutdown()
+		case <-stateTickerChan:
+			p4p.saveState()
+		case newCfg := <-reloadChan:
+			if newCfg.StateFile != cfg.StateFile {
+				logger.Warnf("Change of state_file for log %s requires a restart to take effect", cfg.LogPath)
+				newCfg.StateFile = cfg.StateFile
+			}
+			if newCfg.ErrorsLogPath != cfg.ErrorsLogPath {
+				logger.Warnf("Change of errors_log_path for log %s requires a restart to take effect", cfg.LogPath)
+				newCfg.ErrorsLogPath = cfg.ErrorsLogPath
+			}
+			if newCfg.SlowCmdLog != cfg.SlowCmdLog {
+				logger.Warnf("Change of slow_cmd_log for log %s requires a restart to take effect", cfg.LogPath)
+				newCfg.SlowCmdLog = cfg.SlowCmdLog
+			}
+			restartParser := *newMetricsConfig(cfg, debug) != *newMetricsConfig(newCfg, debug) ||
+				needCmds(newCfg) != needCmds(cfg)
+			resetHistograms := newCfg.CmdHistograms != cfg.CmdHistograms ||
+				!equalBuckets(newCfg.CmdHistogramBuckets, cfg.CmdHistogramBuckets) ||
+				!equalBuckets(newCfg.CmdLockWaitBuckets, cfg.CmdLockWaitBuckets)
+			*cfg = *newCfg
+			closeSinks(p4p.sinks, 0)
+			p4p.sinks = backgroundSinks(newSinks(cfg, logger), logger)
+			if p4p.slowLog != nil {
+				p4p.slowLog.configure(cfg)
+			}
+			if p4p.tableLocks != nil {
+				p4p.tableLocks.configure(cfg)
+			}
+			if !filtering(cfg) {
+				p4p.filter = nil
+			} else if p4p.filter != nil {
+				p4p.filter.configure(cfg)
+			} else {
+				p4p.filter = newCmdFilter(cfg)
+			}
+			if len(cfg.CustomMetrics) == 0 {
+				p4p.custom = nil
+			} else if p4p.custom != nil {
+				p4p.custom.configure(cfg)
+			} else {
+				p4p.custom = newCustomMetrics(cfg)
+			}
+			if stateTicker != nil {
+				stateTicker.Reset(cfg.StateSaveInterval)
+			}
+			if restartParser {
+				logger.Infof("Restarting parser for log %s to apply new config", cfg.LogPath)
+				flush(nil)
+				p4p.state.rebase()
+				p4p.self.reset()
+				if p4p.errors != nil {
+					p4p.errors.reset()
+				}
+				if p4p.tableLocks != nil {
+					p4p.tableLocks.reset()
+				}
+				if p4p.filter != nil {
+					p4p.filter.reset()
+				}
+				if p4p.custom != nil {
+					p4p.custom.reset()
+				}
+			}
+			// After flushing the old parser's commands, and before starting the new parser
+			if resetHistograms {
+				p4p.histograms = nil
+				if cfg.CmdHistograms {
+					p4p.histograms = newCmdHistograms(cfg)
+				}
+			}
+			if cfg.TableLockMetrics != (p4p.tableLocks != nil) {
+				p4p.tableLocks = nil
+				if cfg.TableLockMetrics {
+					p4p.tableLocks = newTableLocks(cfg)
+				}
+			}
+			if restartParser {
+				linesChan, cmdsChan, metricsChan = startParser()
+			}
 		case metric, ok := <-metricsChan:
 			if ok {
-				p4p.writeMetricsFile([]byte(metric))
+				p4p.self.linesQueued = len(linesChan)
+				drainCmds()
+				p4p.outputMetrics([]byte(metric))
 			} else {
-				os.Exit(0)
+				return nil
 			}
 		case line, ok := <-tailer.Lines():
 			if ok {
-				linesChan <- line.Line
+				p4p.state.lineRead(line.Line)
+				sendLine(line.Line)
 			} else {
-				os.Exit(0)
+				return shutdown()
+			}
+		case cmd, ok := <-cmdsChan:
+			if !ok {
+				cmdsChan = nil
+				continue
+			}
+			p4p.addCmd(cmd)
+		case line, ok := <-errorsLines:
+			if !ok {
+				errorsLines = nil
+				continue
+			}
+			if err := p4p.errors.add(line.Line); err != nil {
+				logger.Warnf("%s: %v", cfg.ErrorsLogPath, err)
+			}
+		case err := <-errorsErrors:
+			if err != nil {
+				logger.Errorf("error reading error log lines - no longer counting errors: %v", err)
+				p4p.self.tailerErrors++
 			}
+			errorsLines, errorsErrors = nil, nil
 		case err := <-tailer.Errors():
 			if err != nil {
+				// Make the error visible in the metrics before giving up on this log
+				p4p.self.tailerErrors++
+				p4p.outputMetrics(p4p.lastMetrics)
 				if os.IsNotExist(err.Cause()) {
-					p4p.logger.Errorf("error reading log lines: %v: use 'fail_on_missing_logfile: false' in the input configuration if you want p4prometheus to start even though the logfile is missing", err)
-					os.Exit(-3)
+					return fmt.Errorf("error reading log lines: %v: use 'fail_on_missing_logfile: false' in the input configuration if you want p4prometheus to start even though the logfile is missing", err)
 				}
-				p4p.logger.Errorf("error reading log lines: %v", err)
-				os.Exit(-4)
+				return fmt.Errorf("error reading log lines: %v", err)
 			}
-			os.Exit(0)
+			return shutdown()
 		}
 	}
 }
 
+// Exit codes
+const (
+	exitOK              = 0
+	exitConfigError     = 1 // Invalid config or command line
+	exitLogError        = 2 // Error reading/processing log(s)
+	exitShutdownTimeout = 3 // Final metrics may not have been written
+	exitServerError     = 4 // Error serving metrics via HTTP
+	exitMonitorError    = 5 // Monitor could not connect to the server, or a collector failed
+)
+
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
 	// for profiling
 	// defer profile.Start().Stop()
 	var (
@@ -233,11 +659,59 @@ func main() {
 			"case.insensitive.server",
 			"Set if server is case insensitive.",
 		).Default("false").Bool()
+		configWatch = kingpin.Flag(
+			"config.watch",
+			"If set, the interval at which to check the config file for changes and reload it (in addition to on SIGHUP).",
+		).Duration()
+		listenAddress = kingpin.Flag(
+			"web.listen-address",
+			"Address on which to expose metrics via HTTP, e.g. ':9810' (if not specified in config file).",
+		).String()
+		_ = kingpin.Command(
+			"tail",
+			"Tail p4d log(s) and continuously output metrics (default).",
+		).Default()
+		historicalCmd = kingpin.Command(
+			"historical",
+			"Replay archived p4d log(s) and write timestamped metrics for import into a TSDB.",
+		)
+		historicalFormat = historicalCmd.Flag(
+			"format",
+			"Output format: openmetrics (for promtool tsdb create-blocks-from openmetrics) or victoriametrics (for /api/v1/import).",
+		).Default(formatOpenMetrics).Enum(formatOpenMetrics, formatVictoriaMetrics)
+		historicalOutput = historicalCmd.Flag(
+			"output",
+			"File to write, or '-' for stdout.",
+		).Short('o').Default("-").String()
+		historicalLogs = historicalCmd.Arg(
+			"logfile",
+			"Log file(s) to process in chronological order - may be gzipped.",
+		).Required().Strings()
+		anonymiseCmd = kingpin.Command(
+			"anonymise",
+			"Print the anonymised value output in metrics for user(s) or IP(s), as per the config file.",
+		)
+		anonymiseIPs = anonymiseCmd.Flag(
+			"ip",
+			"Values are IP addresses rather than users.",
+		).Bool()
+		anonymiseValues = anonymiseCmd.Arg(
+			"value",
+			"User(s) or IP(s) to anonymise.",
+		).Required().Strings()
+		monitorCmd = kingpin.Command(
+			"monitor",
+			"Run p4 commands to collect server metrics (uptime, license, replication etc) as per monitor_metrics.sh.",
+		)
+		monitorInterval = monitorCmd.Flag(
+			"interval",
+			"If set, run continuously at this interval rather than once, e.g. from cron (if not specified in config file).",
+		).Duration()
 	)
 
 	kingpin.Version(version.Print("p4prometheus"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	logger := logrus.New()
 	logger.Level = logrus.InfoLevel
@@ -245,56 +719,172 @@ func main() {
 		logger.Level = logrus.DebugLevel
 	}
 
-	cfg, err := config.LoadConfigFile(*configfile)
+	// Command line values override config file values - also used when reloading config
+	loadConfig := func() (*config.Config, error) {
+		cfg, err := config.LoadConfigFile(*configfile)
+		if err != nil {
+			return nil, err
+		}
+		if len(*logPath) > 0 {
+			cfg.LogPath = *logPath
+		}
+		if len(*serverID) > 0 {
+			cfg.ServerID = *serverID
+		}
+		if len(*sdpInstance) > 0 {
+			cfg.SDPInstance = *sdpInstance
+		}
+		if *updateInterval != 10*time.Second {
+			cfg.UpdateInterval = *updateInterval
+		}
+		if !*noOutputCmdsByUser {
+			cfg.OutputCmdsByUser = !*noOutputCmdsByUser
+		}
+		if *outputCmdsByUserRegex != "" {
+			cfg.OutputCmdsByUserRegex = *outputCmdsByUserRegex
+		}
+		if !*noOutputCmdsByIP {
+			cfg.OutputCmdsByIP = !*noOutputCmdsByUser
+		}
+		if *caseInsensitiveServer {
+			cfg.CaseSensitiveServer = !*caseInsensitiveServer
+		}
+		if len(*listenAddress) > 0 {
+			cfg.ListenAddress = *listenAddress
+		}
+		return cfg, nil
+	}
+
+	cfg, err := loadConfig()
 	if err != nil {
 		logger.Errorf("error loading config file: %v", err)
-		os.Exit(-1)
-	}
-	if len(*logPath) > 0 {
-		cfg.LogPath = *logPath
-	}
-	if len(*serverID) > 0 {
-		cfg.ServerID = *serverID
-	}
-	if len(*sdpInstance) > 0 {
-		cfg.SDPInstance = *sdpInstance
-	}
-	if *updateInterval != 10*time.Second {
-		cfg.UpdateInterval = *updateInterval
-	}
-	if !*noOutputCmdsByUser {
-		cfg.OutputCmdsByUser = !*noOutputCmdsByUser
+		return exitConfigError
 	}
-	if *outputCmdsByUserRegex != "" {
-		cfg.OutputCmdsByUserRegex = *outputCmdsByUserRegex
+
+	if command == anonymiseCmd.FullCommand() {
+		if err := runAnonymise(os.Stdout, cfg, *anonymiseValues, *anonymiseIPs); err != nil {
+			logger.Errorf("%v", err)
+			return exitConfigError
+		}
+		return exitOK
 	}
-	if !*noOutputCmdsByIP {
-		cfg.OutputCmdsByIP = !*noOutputCmdsByUser
+
+	logger.Infof("%v", version.Print("p4prometheus"))
+
+	if command == historicalCmd.FullCommand() {
+		if cfg.SDPInstance == "" && len(cfg.ServerID) == 0 {
+			logger.Errorf("error loading config file - if no sdp_instance then please specifiy server_id!")
+			return exitConfigError
+		}
+		if len(cfg.ServerID) == 0 && cfg.SDPInstance != "" {
+			cfg.ServerID = readServerID(logger, cfg.SDPInstance)
+		}
+		if err := runHistorical(logger, cfg, *historicalLogs, *historicalFormat, *historicalOutput, *debug); err != nil {
+			logger.Errorf("error processing historical logs: %v", err)
+			return exitLogError
+		}
+		return exitOK
 	}
-	if *caseInsensitiveServer {
-		cfg.CaseSensitiveServer = !*caseInsensitiveServer
+
+	if command == monitorCmd.FullCommand() {
+		if *monitorInterval > 0 {
+			cfg.Monitor.Interval = *monitorInterval
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-sigs
+			logger.Infof("Terminating - signal %v", sig)
+			cancel()
+		}()
+		if err := runMonitor(ctx, logger, cfg); err != nil {
+			logger.Errorf("error running monitor: %v", err)
+			return exitMonitorError
+		}
+		return exitOK
 	}
-	logger.Infof("%v", version.Print("p4prometheus"))
-	logger.Infof("Processing log file: '%s' output to '%s' SDP instance '%s'",
-		cfg.LogPath, cfg.MetricsOutput, cfg.SDPInstance)
-	if cfg.SDPInstance == "" && len(cfg.ServerID) == 0 {
-		logger.Errorf("error loading config file - if no sdp_instance then please specifiy server_id!")
-		os.Exit(-1)
+
+	instances, err := prepareInstances(logger, cfg)
+	if err != nil {
+		logger.Errorf("error loading config file - %v", err)
+		return exitConfigError
 	}
-	if len(cfg.ServerID) == 0 && cfg.SDPInstance != "" {
-		cfg.ServerID = readServerID(logger, cfg.SDPInstance)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var server *metricsServer
+	var serverFailed int32
+	if cfg.ListenAddress != "" {
+		server = newMetricsServer(cfg, logger)
+		go func() {
+			if err := server.serve(); err != nil {
+				logger.Errorf("error serving metrics: %v", err)
+				atomic.StoreInt32(&serverFailed, 1)
+				cancel()
+			}
+		}()
 	}
-	logger.Infof("Server id: '%s'", cfg.ServerID)
 
-	var logcfg *logConfig
+	rl := newReloader(logger, cfg, loadConfig)
+	reloadChans := make(map[string]<-chan *config.Config)
+	for _, icfg := range instances {
+		reloadChans[icfg.LogPath] = rl.register(icfg.LogPath)
+	}
 
-	logcfg = &logConfig{
-		Type:                 "file",
-		Path:                 cfg.LogPath,
-		PollInterval:         time.Second * 1,
-		Readall:              false,
-		FailOnMissingLogfile: false,
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				logger.Infof("Reloading config file %s - signal %v", *configfile, sig)
+				rl.reload()
+				continue
+			}
+			logger.Infof("Terminating - signal %v", sig)
+			cancel()
+			return
+		}
+	}()
+	if *configWatch > 0 {
+		go watchConfigFile(ctx, logger, *configfile, *configWatch, sigs)
 	}
-	runLogTailer(logger, logcfg, cfg, *debug)
 
+	// One tailer/parser pipeline per instance - failure of one does not affect the others
+	var wg sync.WaitGroup
+	var failures, timeouts int32
+	for _, icfg := range instances {
+		logcfg := &logConfig{
+			Type:                 "file",
+			Path:                 icfg.LogPath,
+			PollInterval:         time.Second * 1,
+			Readall:              false,
+			FailOnMissingLogfile: false,
+		}
+		wg.Add(1)
+		go func(icfg *config.Config) {
+			defer wg.Done()
+			err := runLogTailer(ctx, logger, logcfg, icfg, server, reloadChans[icfg.LogPath], *debug)
+			if errors.Is(err, errShutdownTimeout) {
+				logger.Warnf("%s: %v", icfg.LogPath, err)
+				atomic.AddInt32(&timeouts, 1)
+			} else if err != nil {
+				logger.Errorf("%s: %v", icfg.LogPath, err)
+				atomic.AddInt32(&failures, 1)
+			}
+		}(icfg)
+	}
+	wg.Wait()
+	switch {
+	case atomic.LoadInt32(&serverFailed) > 0:
+		return exitServerError
+	case failures > 0:
+		return exitLogError
+	case timeouts > 0:
+		return exitShutdownTimeout
+	}
+	logger.Infof("Shutdown complete")
+	return exitOK
 }
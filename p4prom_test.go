@@ -240,3 +240,48 @@ p4_cmd_user_detail_cumulative_seconds;serverid=myserverid;user=robert;cmd=user-s
 	compareOutput(t, expected, output)
 
 }
+
+func TestRunLogTailerShutdown(t *testing.T) {
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	cfg := &config.Config{
+		LogPath:           logPath,
+		MetricsOutput:     dir + "/cmds.prom",
+		StateFile:         dir + "/state.json",
+		ServerID:          "myserverid",
+		UpdateInterval:    time.Hour, // So metrics are only written on shutdown
+		StateSaveInterval: time.Hour,
+		ShutdownTimeout:   5 * time.Second,
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, nil, false)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`)
+	f.Close()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1`)
+	st, err := loadState(cfg.StateFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, st.Counters["p4_cmd_counter"].Series[`p4_cmd_counter{serverid="myserverid",cmd="user-sync"}`])
+}
@@ -0,0 +1,112 @@
+package main
+
+// Live reload of the config file, triggered by SIGHUP or (optionally) when the config file changes.
+// The new config is validated and, if OK, sent to each running log tailer to be applied.
+// Invalid configs are rejected and the current config remains in use.
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/sirupsen/logrus"
+)
+
+// reloader - applies a reloaded config to the running log tailers
+type reloader struct {
+	logger     *logrus.Logger
+	loadConfig func() (*config.Config, error)
+	current    *config.Config
+	tailers    map[string]chan *config.Config // By log path
+}
+
+func newReloader(logger *logrus.Logger, cfg *config.Config, loadConfig func() (*config.Config, error)) *reloader {
+	return &reloader{
+		logger:     logger,
+		loadConfig: loadConfig,
+		current:    cfg,
+		tailers:    make(map[string]chan *config.Config),
+	}
+}
+
+// register - returns the channel on which the tailer for the specified log will receive new configs
+func (r *reloader) register(logPath string) <-chan *config.Config {
+	ch := make(chan *config.Config, 1)
+	r.tailers[logPath] = ch
+	return ch
+}
+
+// reload - re-reads and validates the config file and applies it if valid
+func (r *reloader) reload() {
+	newCfg, err := r.loadConfig()
+	if err != nil {
+		r.logger.Errorf("error reloading config - continuing with current config: %v", err)
+		return
+	}
+	instances, err := prepareInstances(r.logger, newCfg)
+	if err != nil {
+		r.logger.Errorf("error reloading config - continuing with current config: %v", err)
+		return
+	}
+	changes := r.current.Diff(newCfg)
+	if len(changes) == 0 {
+		r.logger.Infof("Config reloaded - no changes")
+		return
+	}
+	for _, c := range changes {
+		r.logger.Infof("Config changed: %s", c)
+	}
+	if r.current.ListenAddress != newCfg.ListenAddress || r.current.TLSCertFile != newCfg.TLSCertFile ||
+		r.current.TLSKeyFile != newCfg.TLSKeyFile || !reflect.DeepEqual(r.current.BasicAuthUsers, newCfg.BasicAuthUsers) {
+		r.logger.Warnf("Changes to listen_address, tls_cert_file, tls_key_file or basic_auth_users require a restart to take effect")
+	}
+	found := make(map[string]bool)
+	for _, icfg := range instances {
+		ch, ok := r.tailers[icfg.LogPath]
+		if !ok {
+			r.logger.Warnf("New log_path %s requires a restart to take effect", icfg.LogPath)
+			continue
+		}
+		found[icfg.LogPath] = true
+		select {
+		case ch <- icfg:
+		default:
+			r.logger.Warnf("Unable to apply config to log %s - previous reload still pending or no longer running", icfg.LogPath)
+		}
+	}
+	for logPath := range r.tailers {
+		if !found[logPath] {
+			r.logger.Warnf("Removal of log_path %s requires a restart to take effect", logPath)
+		}
+	}
+	r.current = newCfg
+}
+
+// watchConfigFile - polls the config file and sends SIGHUP to notify when its modification time changes
+func watchConfigFile(ctx context.Context, logger *logrus.Logger, filename string, interval time.Duration, notify chan<- os.Signal) {
+	var lastMod time.Time
+	if fi, err := os.Stat(filename); err == nil {
+		lastMod = fi.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(filename)
+			if err != nil {
+				continue
+			}
+			if !fi.ModTime().Equal(lastMod) {
+				lastMod = fi.ModTime()
+				logger.Infof("Config file %s changed", filename)
+				notify <- syscall.SIGHUP
+			}
+		}
+	}
+}
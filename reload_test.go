@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	cfg := &config.Config{LogPath: "/p4/1/logs/log", ServerID: "myserverid", UpdateInterval: 15 * time.Second}
+	var newCfg *config.Config
+	var loadErr error
+	rl := newReloader(logger, cfg, func() (*config.Config, error) { return newCfg, loadErr })
+	ch := rl.register(cfg.LogPath)
+
+	// Invalid config is not applied
+	loadErr = fmt.Errorf("invalid configuration")
+	rl.reload()
+	assert.Equal(t, 0, len(ch))
+	assert.Equal(t, cfg, rl.current)
+
+	// No changes
+	loadErr = nil
+	c := *cfg
+	newCfg = &c
+	rl.reload()
+	assert.Equal(t, 0, len(ch))
+
+	// Changed config sent to tailer
+	c2 := *cfg
+	c2.UpdateInterval = 30 * time.Second
+	newCfg = &c2
+	rl.reload()
+	assert.Equal(t, 1, len(ch))
+	icfg := <-ch
+	assert.Equal(t, 30*time.Second, icfg.UpdateInterval)
+	assert.Equal(t, newCfg, rl.current)
+
+	// Missing server id is rejected
+	c3 := c2
+	c3.ServerID = ""
+	c3.OutputCmdsByIP = true
+	newCfg = &c3
+	rl.reload()
+	assert.Equal(t, 0, len(ch))
+	assert.Equal(t, &c2, rl.current)
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "p4prometheus.yaml")
+	assert.NoError(t, os.WriteFile(cfgFile, []byte("log_path: /p4/1/logs/log\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notify := make(chan os.Signal, 1)
+	go watchConfigFile(ctx, logger, cfgFile, 10*time.Millisecond, notify)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 0, len(notify))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(cfgFile, later, later))
+	select {
+	case <-notify:
+	case <-time.After(time.Second):
+		t.Fatalf("config change not notified")
+	}
+}
+
+// readMetric - the value of the first sample of the metric in the output file, if present
+func readMetric(filename, name string) (int, bool) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, false
+	}
+	m := regexp.MustCompile(`(?m)^` + name + `\{[^}]*\} (\d+)$`).FindStringSubmatch(string(buf))
+	if m == nil {
+		return 0, false
+	}
+	v, _ := strconv.Atoi(m[1])
+	return v, true
+}
+
+// waitForMetric - waits for the value of the metric in the output file to reach at least min,
+// returning the value
+func waitForMetric(t *testing.T, filename, name string, min int) int {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if v, ok := readMetric(filename, name); ok && v >= min {
+			return v
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not reach %d in %s", name, min, filename)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunLogTailerReloadSelfMetrics(t *testing.T) {
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	metricsOutput := dir + "/cmds.prom"
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	cfg := &config.Config{
+		LogPath:           logPath,
+		MetricsOutput:     metricsOutput,
+		ServerID:          "myserverid",
+		UpdateInterval:    100 * time.Millisecond,
+		StateSaveInterval: time.Hour,
+		ShutdownTimeout:   5 * time.Second,
+	}
+	newCfg := *cfg
+	newCfg.OutputCmdsByIP = true
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	reloadChan := make(chan *config.Config) // Unbuffered so the send returns once the reload is received
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, reloadChan, false)
+	}()
+	before := waitForMetric(t, metricsOutput, "p4prom_metrics_produced", 20)
+
+	// Restarts the parser, with the values last output as the baseline. Had the count been added
+	// to the baseline it would jump to about twice its previous value.
+	reloadChan <- &newCfg
+	sent, ok := readMetric(metricsOutput, "p4prom_metrics_produced")
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, sent, before)
+	after := waitForMetric(t, metricsOutput, "p4prom_metrics_produced", sent+3)
+	assert.Less(t, after, sent+before)
+
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+// Metrics about p4prometheus itself (as opposed to the p4d log), so that we can alert
+// if it is stuck or falling behind. These are in addition to the p4_prom_* metrics
+// output by the log parser.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/perforce/p4prometheus/version"
+	metrics "github.com/rcowham/go-libp4dlog/metrics"
+)
+
+// selfMetrics - values are only updated from the runLogTailer goroutine
+type selfMetrics struct {
+	config          *config.Config
+	tailerErrors    int64
+	writeErrors     map[string]int64 // By output name
+	stateErrors     int64
+	linesQueued     int
+	lastWrite       map[string]time.Time // By output name
+	metricsProduced int64
+	slowCmdsLogged  int64
+	slowCmdErrors   int64         // Errors writing the slow command log
+	parserPaced     time.Duration // Waiting to send lines to the parser as per parser_max_blocks_per_second
+}
+
+func newSelfMetrics(config *config.Config) *selfMetrics {
+	return &selfMetrics{
+		config:      config,
+		writeErrors: make(map[string]int64),
+		lastWrite:   make(map[string]time.Time),
+	}
+}
+
+// Formats labels as per the log parser, omitting any with blank values
+func formatLabels(labels []labelPair) string {
+	vals := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l.value != "" {
+			vals = append(vals, fmt.Sprintf("%s=\"%s\"", l.name, metrics.NotLabelValueRE.ReplaceAllString(l.value, "_")))
+		}
+	}
+	return "{" + strings.Join(vals, ",") + "}"
+}
+
+func printHeader(buf *bytes.Buffer, name, help, metricType string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func printSample(buf *bytes.Buffer, name string, labels []labelPair, value string) {
+	fmt.Fprintf(buf, "%s%s %s\n", name, formatLabels(labels), value)
+}
+
+// printMetric - a metric with a single sample
+func printMetric(buf *bytes.Buffer, name, help, metricType string, labels []labelPair, value string) {
+	printHeader(buf, name, help, metricType)
+	printSample(buf, name, labels, value)
+}
+
+func (sm *selfMetrics) fixedLabels() []labelPair {
+	return []labelPair{{"serverid", sm.config.ServerID}, {"sdpinst", sm.config.SDPInstance}}
+}
+
+// reset - clears the counters, e.g. when the log parser is restarted and the values last output
+// are used as a baseline
+func (sm *selfMetrics) reset() {
+	sm.tailerErrors = 0
+	sm.writeErrors = make(map[string]int64)
+	sm.stateErrors = 0
+	sm.metricsProduced = 0
+	sm.slowCmdsLogged = 0
+	sm.slowCmdErrors = 0
+	sm.parserPaced = 0
+}
+
+// outputNames - the configured outputs, and any others for which values have been recorded
+func (sm *selfMetrics) outputNames() []string {
+	names := make(map[string]bool)
+	if sm.config.MetricsOutput != "" {
+		names[config.OutputTextfile] = true
+	}
+	for _, o := range sm.config.Outputs {
+		names[o.Name] = true
+	}
+	for o := range sm.writeErrors {
+		names[o] = true
+	}
+	for o := range sm.lastWrite {
+		names[o] = true
+	}
+	result := make([]string, 0, len(names))
+	for o := range names {
+		result = append(result, o)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// output - returns the metrics in text format
+func (sm *selfMetrics) output() []byte {
+	buf := new(bytes.Buffer)
+	fixed := sm.fixedLabels()
+	sm.metricsProduced++
+	labels := append(fixed, []labelPair{
+		{"version", version.Version},
+		{"revision", version.Revision},
+		{"branch", version.Branch},
+		{"goversion", version.GoVersion},
+	}...)
+	printMetric(buf, "p4prom_build_info", "Build information for p4prometheus (value is always 1)", "gauge", labels, "1")
+	printMetric(buf, "p4prom_metrics_produced", "A count of metrics outputs produced", "counter", fixed,
+		fmt.Sprintf("%d", sm.metricsProduced))
+	printMetric(buf, "p4prom_lines_queued", "Log lines read but not yet processed by the parser", "gauge", fixed,
+		fmt.Sprintf("%d", sm.linesQueued))
+	printMetric(buf, "p4prom_tailer_errors", "A count of errors reading the log", "counter", fixed,
+		fmt.Sprintf("%d", sm.tailerErrors))
+	printMetric(buf, "p4prom_parser_paced_seconds", "Time spent waiting to send log lines to the parser, as limited by parser_max_blocks_per_second",
+		"counter", fixed, fmt.Sprintf("%.3f", sm.parserPaced.Seconds()))
+	if sm.config.SlowCmdLog != "" {
+		printMetric(buf, "p4prom_slow_cmds_logged", "A count of commands written to the slow command log", "counter", fixed,
+			fmt.Sprintf("%d", sm.slowCmdsLogged))
+		printMetric(buf, "p4prom_slow_cmd_log_errors", "A count of errors writing the slow command log", "counter", fixed,
+			fmt.Sprintf("%d", sm.slowCmdErrors))
+	}
+	if sm.config.StateFile != "" {
+		printMetric(buf, "p4prom_state_save_errors", "A count of errors saving state", "counter", fixed,
+			fmt.Sprintf("%d", sm.stateErrors))
+	}
+	outputs := sm.outputNames()
+	if len(outputs) > 0 {
+		printHeader(buf, "p4prom_write_errors", "A count of errors writing metrics to an output", "counter")
+		for _, o := range outputs {
+			printSample(buf, "p4prom_write_errors", append(fixed, labelPair{"output", o}),
+				fmt.Sprintf("%d", sm.writeErrors[o]))
+		}
+	}
+	if len(sm.lastWrite) > 0 {
+		printHeader(buf, "p4prom_last_write_time", "Time of last successful write of metrics to an output (unix epoch)", "gauge")
+		for _, o := range outputs {
+			if t, ok := sm.lastWrite[o]; ok {
+				printSample(buf, "p4prom_last_write_time", append(fixed, labelPair{"output", o}),
+					fmt.Sprintf("%d", t.Unix()))
+			}
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/perforce/p4prometheus/version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	version.Version = "v1.2.3"
+	version.Revision = "abc123"
+	version.Branch = "main"
+	defer func() { version.Version, version.Revision, version.Branch = "", "", "" }()
+
+	cfg := &config.Config{ServerID: "myserverid", SDPInstance: "1", MetricsOutput: "/tmp/cmds.prom",
+		Outputs: []config.Output{{Type: config.OutputPushgateway, Name: "pushgateway"}}}
+	sm := newSelfMetrics(cfg)
+	sm.linesQueued = 5
+	sm.writeErrors["textfile"] = 2
+	output := string(sm.output())
+	assert.Contains(t, output, `p4prom_build_info{serverid="myserverid",sdpinst="1",version="v1.2.3",revision="abc123",branch="main",goversion="`)
+	assert.Contains(t, output, "# TYPE p4prom_write_errors counter\n")
+	assert.Contains(t, output, `p4prom_write_errors{serverid="myserverid",sdpinst="1",output="textfile"} 2`)
+	assert.Contains(t, output, `p4prom_write_errors{serverid="myserverid",sdpinst="1",output="pushgateway"} 0`)
+	assert.Contains(t, output, `p4prom_lines_queued{serverid="myserverid",sdpinst="1"} 5`)
+	assert.Contains(t, output, `p4prom_parser_paced_seconds{serverid="myserverid",sdpinst="1"} 0.000`)
+	assert.Contains(t, output, `p4prom_metrics_produced{serverid="myserverid",sdpinst="1"} 1`)
+	assert.NotContains(t, output, "p4prom_last_write_time")
+	assert.NotContains(t, output, "p4prom_state_save_errors")
+
+	sm.lastWrite["pushgateway"] = time.Unix(1441207389, 0)
+	output = string(sm.output())
+	assert.Contains(t, output, `p4prom_last_write_time{serverid="myserverid",sdpinst="1",output="pushgateway"} 1441207389`)
+	assert.NotContains(t, output, `p4prom_last_write_time{serverid="myserverid",sdpinst="1",output="textfile"}`)
+	assert.Contains(t, output, `p4prom_metrics_produced{serverid="myserverid",sdpinst="1"} 2`)
+}
+
+func TestOutputMetrics(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{ServerID: "myserverid", MetricsOutput: dir + "/cmds.prom"}
+	p4p := newP4Prometheus(cfg, logger)
+	p4p.outputMetrics([]byte("p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	assert.False(t, p4p.self.lastWrite["textfile"].IsZero())
+	assert.Equal(t, int64(0), p4p.self.writeErrors["textfile"])
+
+	// Unwritable location
+	cfg.MetricsOutput = dir + "/missing/cmds.prom"
+	p4p.sinks = newSinks(cfg, logger)
+	p4p.outputMetrics([]byte("p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	assert.Equal(t, int64(1), p4p.self.writeErrors["textfile"])
+	cfg.MetricsOutput = dir + "/cmds.prom"
+	p4p.sinks = newSinks(cfg, logger)
+	p4p.outputMetrics([]byte("p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf), "p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	assert.Contains(t, string(buf), `p4prom_write_errors{serverid="myserverid",output="textfile"} 1`)
+}
+
+func TestOutputMetricsSlowOutput(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	cfg := &config.Config{ServerID: "myserverid", MetricsOutput: dir + "/cmds.prom", Outputs: []config.Output{
+		{Type: config.OutputPushgateway, Name: "pushgateway", URL: server.URL, Job: "p4prometheus", Timeout: time.Minute}}}
+	p4p := newP4Prometheus(cfg, logger)
+
+	// Not held up waiting for the pushgateway
+	start := time.Now()
+	p4p.outputMetrics([]byte("p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	<-requests
+	for i := 0; i < 4; i++ {
+		p4p.outputMetrics([]byte("p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	}
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.False(t, p4p.self.lastWrite["textfile"].IsZero())
+
+	// Failed pushes are counted in the next output - the first, and the latest queued meanwhile
+	close(release)
+	closeSinks(p4p.sinks, 10*time.Second)
+	p4p.sinkResults()
+	assert.Equal(t, int64(2), p4p.self.writeErrors["pushgateway"])
+	_, ok := p4p.self.lastWrite["pushgateway"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,411 @@
+package main
+
+// Output sinks - destinations for the metrics output after each update interval.
+// The textfile sink (for node_exporter's textfile collector) is the default, but metrics can
+// also be pushed, so that node_exporter is not required on the p4d host:
+//   - pushgateway: Prometheus Pushgateway (text format, replacing the previous push)
+//   - remote_write: Prometheus remote write protocol (e.g. Prometheus, VictoriaMetrics, Mimir)
+//   - influxdb: InfluxDB line protocol (v1 /write or v2 /api/v2/write endpoints)
+//
+// The pushed outputs are written from their own goroutines (see asyncSink), so that an unreachable
+// endpoint does not hold up processing of the log.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/perforce/p4prometheus/config"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// metricsSink - a destination for metrics in Prometheus text format
+type metricsSink interface {
+	name() string
+	write(metrics []byte) error
+}
+
+// newSinks - returns the sinks for the metrics_output file (if any) and each configured output
+func newSinks(cfg *config.Config, logger *logrus.Logger) []metricsSink {
+	sinks := make([]metricsSink, 0)
+	if cfg.MetricsOutput != "" {
+		sinks = append(sinks, &textfileSink{sinkName: config.OutputTextfile, path: cfg.MetricsOutput, logger: logger})
+	}
+	for _, o := range cfg.Outputs {
+		switch o.Type {
+		case config.OutputTextfile:
+			sinks = append(sinks, &textfileSink{sinkName: o.Name, path: o.Path, logger: logger})
+		case config.OutputPushgateway:
+			sinks = append(sinks, newPushgatewaySink(cfg, o))
+		case config.OutputRemoteWrite:
+			sinks = append(sinks, &remoteWriteSink{httpSink: newHTTPSink(o)})
+		case config.OutputInfluxDB:
+			sinks = append(sinks, &influxDBSink{httpSink: newHTTPSink(o)})
+		}
+	}
+	return sinks
+}
+
+// asyncSink - writes to a sink from its own goroutine. Only the latest metrics are queued, so if a
+// write is still in progress (e.g. waiting for the timeout of an unreachable endpoint) the previous
+// metrics not yet written are replaced rather than holding up the caller. Results of the writes are
+// collected by results() for the self metrics.
+type asyncSink struct {
+	sink      metricsSink
+	logger    *logrus.Logger
+	pending   chan []byte // Latest metrics not yet written
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	errors    int64     // Since results last collected
+	lastWrite time.Time // Of last successful write
+}
+
+func newAsyncSink(sink metricsSink, logger *logrus.Logger) *asyncSink {
+	s := &asyncSink{
+		sink:    sink,
+		logger:  logger,
+		pending: make(chan []byte, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// backgroundSinks - wraps the sinks which push metrics over the network in asyncSinks, leaving
+// textfile sinks to be written directly
+func backgroundSinks(sinks []metricsSink, logger *logrus.Logger) []metricsSink {
+	result := make([]metricsSink, 0, len(sinks))
+	for _, s := range sinks {
+		if _, ok := s.(*textfileSink); ok {
+			result = append(result, s)
+		} else {
+			result = append(result, newAsyncSink(s, logger))
+		}
+	}
+	return result
+}
+
+// closeSinks - stops the goroutines of any asyncSinks once their queued metrics are written,
+// waiting up to the timeout for them to finish (not at all if 0)
+func closeSinks(sinks []metricsSink, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for _, s := range sinks {
+		if a, ok := s.(*asyncSink); ok {
+			a.close()
+			if timeout <= 0 {
+				continue
+			}
+			select {
+			case <-a.done:
+			case <-deadline:
+				return
+			}
+		}
+	}
+}
+
+func (s *asyncSink) name() string {
+	return s.sink.name()
+}
+
+func (s *asyncSink) run() {
+	defer close(s.done)
+	for metrics := range s.pending {
+		err := s.sink.write(metrics)
+		s.mu.Lock()
+		if err != nil {
+			s.errors++
+		} else {
+			s.lastWrite = time.Now()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			s.logger.Errorf("Error writing metrics to %s: %v", s.name(), err)
+		}
+	}
+}
+
+// write - queues the metrics, replacing any not yet written. Only to be called from a single
+// goroutine. Errors are logged and returned by results() rather than here.
+func (s *asyncSink) write(metrics []byte) error {
+	for {
+		select {
+		case s.pending <- metrics:
+			return nil
+		default:
+		}
+		select {
+		case <-s.pending:
+			s.logger.Debugf("Metrics not yet written to %s replaced by later ones", s.name())
+		default:
+		}
+	}
+}
+
+// results - the number of failed writes since last called, and the time of the last successful write
+func (s *asyncSink) results() (int64, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errors := s.errors
+	s.errors = 0
+	return errors, s.lastWrite
+}
+
+func (s *asyncSink) close() {
+	s.closeOnce.Do(func() { close(s.pending) })
+}
+
+// textfileSink - writes to a file for node_exporter's textfile collector
+type textfileSink struct {
+	sinkName string
+	path     string
+	logger   *logrus.Logger
+}
+
+func (s *textfileSink) name() string {
+	return s.sinkName
+}
+
+// write - writes to temp file first and renames it after
+func (s *textfileSink) write(metrics []byte) error {
+	tmpFile := s.path + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", tmpFile, err)
+	}
+	_, err = f.Write(bytes.ToValidUTF8(metrics, []byte{'?'}))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error writing %s: %v", tmpFile, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %v", tmpFile, err)
+	}
+	if err = os.Chmod(tmpFile, 0644); err != nil {
+		s.logger.Errorf("Error chmod-ing file: %v", err)
+	}
+	if err = os.Rename(tmpFile, s.path); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %v", tmpFile, s.path, err)
+	}
+	return nil
+}
+
+// httpSink - common handling for sinks which send metrics via HTTP
+type httpSink struct {
+	output config.Output
+	client *http.Client
+}
+
+func newHTTPSink(o config.Output) httpSink {
+	return httpSink{output: o, client: &http.Client{Timeout: o.Timeout}}
+}
+
+func (s *httpSink) name() string {
+	return s.output.Name
+}
+
+// send - sends the body, returning an error for any non 2xx response
+func (s *httpSink) send(method, url string, body []byte, headers map[string]string, tokenScheme string) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if s.output.Token != "" {
+		req.Header.Set("Authorization", tokenScheme+" "+s.output.Token)
+	} else if s.output.Username != "" {
+		req.SetBasicAuth(s.output.Username, s.output.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// pushgatewaySink - pushes to a Prometheus Pushgateway, grouped by job, host and instance
+// so that pushes from different p4d logs do not replace each other.
+type pushgatewaySink struct {
+	httpSink
+	url string
+}
+
+func newPushgatewaySink(cfg *config.Config, o config.Output) *pushgatewaySink {
+	hostname, _ := os.Hostname()
+	grouping := []labelPair{{"instance", hostname}}
+	if cfg.ServerID != "" {
+		grouping = append(grouping, labelPair{"serverid", cfg.ServerID})
+	}
+	if cfg.SDPInstance != "" {
+		grouping = append(grouping, labelPair{"sdpinst", cfg.SDPInstance})
+	}
+	return &pushgatewaySink{
+		httpSink: newHTTPSink(o),
+		url:      pushgatewayURL(o.URL, o.Job, grouping),
+	}
+}
+
+// pushgatewayURL - as per the Pushgateway API, values which may contain '/' are base64 encoded
+func pushgatewayURL(baseURL string, job string, grouping []labelPair) string {
+	encode := func(name, value string) string {
+		if value == "" {
+			return name + "@base64/="
+		}
+		if strings.Contains(value, "/") {
+			return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+		}
+		return name + "/" + url.PathEscape(value)
+	}
+	parts := []string{strings.TrimSuffix(baseURL, "/"), "metrics", encode("job", job)}
+	for _, l := range grouping {
+		parts = append(parts, encode(l.name, l.value))
+	}
+	return strings.Join(parts, "/")
+}
+
+func (s *pushgatewaySink) write(metrics []byte) error {
+	// PUT replaces all metrics previously pushed with the same grouping
+	return s.send(http.MethodPut, s.url, bytes.ToValidUTF8(metrics, []byte{'?'}),
+		map[string]string{"Content-Type": metricsContentType}, "Bearer")
+}
+
+// timeSeries - a sample with its name and labels, as required by the push protocols
+type timeSeries struct {
+	name   string
+	labels []labelPair
+	value  float64
+}
+
+// parseTimeSeries - returns all samples in the text, ignoring any which are invalid
+func parseTimeSeries(metrics []byte) []timeSeries {
+	result := make([]timeSeries, 0)
+	for _, line := range strings.Split(string(metrics), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, err := parseSample(line)
+		if err != nil {
+			continue
+		}
+		name, labels, err := parseSeries(series)
+		if err != nil {
+			continue
+		}
+		result = append(result, timeSeries{name: name, labels: labels, value: value})
+	}
+	return result
+}
+
+// remoteWriteSink - sends samples timestamped with the current time using the Prometheus
+// remote write protocol (snappy compressed protobuf WriteRequest)
+type remoteWriteSink struct {
+	httpSink
+}
+
+// Field numbers from prometheus/prompb/types.proto and remote.proto
+const (
+	pbWriteRequestTimeseries = 1
+	pbTimeSeriesLabels       = 1
+	pbTimeSeriesSamples      = 2
+	pbLabelName              = 1
+	pbLabelValue             = 2
+	pbSampleValue            = 1
+	pbSampleTimestamp        = 2
+)
+
+// encodeWriteRequest - encodes the series as a prompb.WriteRequest with labels sorted by name
+func encodeWriteRequest(series []timeSeries, ts time.Time) []byte {
+	var req []byte
+	for _, s := range series {
+		labels := append([]labelPair{{"__name__", s.name}}, s.labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		var tsBuf []byte
+		for _, l := range labels {
+			if l.value == "" {
+				continue // Equivalent to the label not being present
+			}
+			var lb []byte
+			lb = protowire.AppendTag(lb, pbLabelName, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, pbLabelValue, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			tsBuf = protowire.AppendTag(tsBuf, pbTimeSeriesLabels, protowire.BytesType)
+			tsBuf = protowire.AppendBytes(tsBuf, lb)
+		}
+		var sb []byte
+		sb = protowire.AppendTag(sb, pbSampleValue, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, pbSampleTimestamp, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(ts.UnixNano()/int64(time.Millisecond)))
+		tsBuf = protowire.AppendTag(tsBuf, pbTimeSeriesSamples, protowire.BytesType)
+		tsBuf = protowire.AppendBytes(tsBuf, sb)
+		req = protowire.AppendTag(req, pbWriteRequestTimeseries, protowire.BytesType)
+		req = protowire.AppendBytes(req, tsBuf)
+	}
+	return req
+}
+
+func (s *remoteWriteSink) write(metrics []byte) error {
+	req := encodeWriteRequest(parseTimeSeries(metrics), time.Now())
+	return s.send(http.MethodPost, s.output.URL, snappy.Encode(nil, req), map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	}, "Bearer")
+}
+
+// influxDBSink - sends samples as InfluxDB line protocol, one measurement per metric with a
+// single "value" field. No timestamp is sent so the server time is used, which avoids
+// dependence on the precision setting of the endpoint.
+type influxDBSink struct {
+	httpSink
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+	influxTagEscaper         = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+)
+
+// formatLineProtocol - e.g. p4_cmd_counter,serverid=master,cmd=user-sync value=3
+func formatLineProtocol(series []timeSeries) []byte {
+	var buf bytes.Buffer
+	for _, s := range series {
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue // Not supported by line protocol
+		}
+		buf.WriteString(influxMeasurementEscaper.Replace(s.name))
+		for _, l := range s.labels {
+			if l.value == "" {
+				continue
+			}
+			fmt.Fprintf(&buf, ",%s=%s", influxTagEscaper.Replace(l.name), influxTagEscaper.Replace(l.value))
+		}
+		fmt.Fprintf(&buf, " value=%s\n", formatValue(s.value))
+	}
+	return buf.Bytes()
+}
+
+func (s *influxDBSink) write(metrics []byte) error {
+	return s.send(http.MethodPost, s.output.URL, formatLineProtocol(parseTimeSeries(metrics)),
+		map[string]string{"Content-Type": "text/plain; charset=utf-8"}, "Token")
+}
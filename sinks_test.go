@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const testSinkMetrics = `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="master",cmd="user-sync"} 3
+p4_cmd_counter{serverid="master",cmd="user-submit"} 1
+# HELP p4_cmd_running The number of running commands
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="master",sdpinst=""} 2.5
+`
+
+type receivedRequest struct {
+	method  string
+	path    string
+	headers http.Header
+	body    []byte
+}
+
+// Returns a test server recording the requests it receives
+func newRecordingServer(t *testing.T, status int) (*httptest.Server, chan receivedRequest) {
+	received := make(chan receivedRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received <- receivedRequest{method: r.Method, path: r.URL.RequestURI(), headers: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func getSink(t *testing.T, cfg *config.Config, name string) metricsSink {
+	for _, s := range newSinks(cfg, logger) {
+		if s.name() == name {
+			return s
+		}
+	}
+	t.Fatalf("sink %s not found", name)
+	return nil
+}
+
+func TestNewSinks(t *testing.T) {
+	cfg := &config.Config{
+		MetricsOutput: "/hxlogs/metrics/cmds.prom",
+		Outputs: []config.Output{
+			{Type: config.OutputTextfile, Name: "/tmp/extra.prom", Path: "/tmp/extra.prom"},
+			{Type: config.OutputPushgateway, Name: "pushgateway", URL: "http://pushgateway:9091"},
+			{Type: config.OutputRemoteWrite, Name: "remote_write", URL: "http://prometheus:9090/api/v1/write"},
+			{Type: config.OutputInfluxDB, Name: "influxdb", URL: "http://influxdb:8086/write?db=p4"},
+		},
+	}
+	names := []string{}
+	for _, s := range newSinks(cfg, logger) {
+		names = append(names, s.name())
+	}
+	assert.Equal(t, []string{"textfile", "/tmp/extra.prom", "pushgateway", "remote_write", "influxdb"}, names)
+
+	cfg.MetricsOutput = ""
+	cfg.Outputs = nil
+	assert.Empty(t, newSinks(cfg, logger))
+}
+
+func TestTextfileSink(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{MetricsOutput: dir + "/cmds.prom"}
+	s := getSink(t, cfg, "textfile")
+	assert.NoError(t, s.write([]byte(testSinkMetrics)))
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Equal(t, testSinkMetrics, string(buf))
+
+	cfg.MetricsOutput = dir + "/missing/cmds.prom"
+	s = getSink(t, cfg, "textfile")
+	assert.Error(t, s.write([]byte(testSinkMetrics)))
+}
+
+func TestPushgatewayURL(t *testing.T) {
+	assert.Equal(t, "http://pg:9091/metrics/job/p4prometheus/instance/myhost/serverid/master",
+		pushgatewayURL("http://pg:9091/", "p4prometheus", []labelPair{{"instance", "myhost"}, {"serverid", "master"}}))
+	assert.Equal(t, "http://pg:9091/metrics/job/p4prometheus/instance@base64/=/path@base64/L3A0LzE",
+		pushgatewayURL("http://pg:9091", "p4prometheus", []labelPair{{"instance", ""}, {"path", "/p4/1"}}))
+}
+
+func TestPushgatewaySink(t *testing.T) {
+	server, received := newRecordingServer(t, http.StatusOK)
+	cfg := &config.Config{ServerID: "master", SDPInstance: "1", Outputs: []config.Output{
+		{Type: config.OutputPushgateway, Name: "pushgateway", URL: server.URL, Job: "p4prometheus", Timeout: time.Second},
+	}}
+	s := getSink(t, cfg, "pushgateway")
+	assert.NoError(t, s.write([]byte(testSinkMetrics)))
+	req := <-received
+	hostname, _ := os.Hostname()
+	assert.Equal(t, http.MethodPut, req.method)
+	assert.Equal(t, "/metrics/job/p4prometheus/instance/"+hostname+"/serverid/master/sdpinst/1", req.path)
+	assert.Equal(t, metricsContentType, req.headers.Get("Content-Type"))
+	assert.Equal(t, testSinkMetrics, string(req.body))
+}
+
+func TestHTTPSinkErrors(t *testing.T) {
+	server, received := newRecordingServer(t, http.StatusBadRequest)
+	cfg := &config.Config{Outputs: []config.Output{
+		{Type: config.OutputInfluxDB, Name: "influxdb", URL: server.URL + "/api/v2/write?org=p4&bucket=p4",
+			Token: "mytoken", Timeout: time.Second},
+		{Type: config.OutputRemoteWrite, Name: "remote_write", URL: server.URL + "/api/v1/write",
+			Username: "user", Password: "pass", Timeout: time.Second},
+	}}
+	err := getSink(t, cfg, "influxdb").write([]byte(testSinkMetrics))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "400 Bad Request")
+	req := <-received
+	assert.Equal(t, "Token mytoken", req.headers.Get("Authorization"))
+
+	assert.Error(t, getSink(t, cfg, "remote_write").write([]byte(testSinkMetrics)))
+	req = <-received
+	user, pass, ok := (&http.Request{Header: req.headers}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "pass", pass)
+
+	server.Close()
+	assert.Error(t, getSink(t, cfg, "influxdb").write([]byte(testSinkMetrics)))
+}
+
+// blockingSink - each write waits to be released, returning the error given
+type blockingSink struct {
+	started chan string
+	release chan error
+}
+
+func (s *blockingSink) name() string {
+	return "blocking"
+}
+
+func (s *blockingSink) write(metrics []byte) error {
+	s.started <- string(metrics)
+	return <-s.release
+}
+
+func TestAsyncSink(t *testing.T) {
+	bs := &blockingSink{started: make(chan string, 3), release: make(chan error)}
+	s := newAsyncSink(bs, logger)
+	assert.Equal(t, "blocking", s.name())
+	assert.NoError(t, s.write([]byte("1")))
+	assert.Equal(t, "1", <-bs.started)
+
+	// Not held up by the write in progress, with only the latest metrics queued
+	start := time.Now()
+	assert.NoError(t, s.write([]byte("2")))
+	assert.NoError(t, s.write([]byte("3")))
+	assert.Less(t, time.Since(start), time.Second)
+	bs.release <- nil
+	assert.Equal(t, "3", <-bs.started)
+	bs.release <- fmt.Errorf("unreachable")
+
+	closeSinks([]metricsSink{s}, 5*time.Second)
+	select {
+	case <-s.done:
+	default:
+		t.Fatalf("sink not closed")
+	}
+	errors, lastWrite := s.results()
+	assert.Equal(t, int64(1), errors)
+	assert.False(t, lastWrite.IsZero())
+	errors, _ = s.results()
+	assert.Equal(t, int64(0), errors)
+	closeSinks([]metricsSink{s}, 0)
+
+	// Only pushed outputs are written in the background
+	sinks := backgroundSinks(newSinks(&config.Config{MetricsOutput: "/tmp/cmds.prom", Outputs: []config.Output{
+		{Type: config.OutputPushgateway, Name: "pushgateway", URL: "http://pushgateway:9091"}}}, logger), logger)
+	defer closeSinks(sinks, 0)
+	assert.IsType(t, &textfileSink{}, sinks[0])
+	assert.IsType(t, &asyncSink{}, sinks[1])
+}
+
+func TestInfluxDBSink(t *testing.T) {
+	server, received := newRecordingServer(t, http.StatusNoContent)
+	cfg := &config.Config{Outputs: []config.Output{
+		{Type: config.OutputInfluxDB, Name: "influxdb", URL: server.URL + "/write?db=p4", Timeout: time.Second},
+	}}
+	metrics := testSinkMetrics + "p4_test{name=\"a b,c=d\"} NaN\np4_test{name=\"a b,c=d\"} 1\n"
+	assert.NoError(t, getSink(t, cfg, "influxdb").write([]byte(metrics)))
+	req := <-received
+	assert.Equal(t, http.MethodPost, req.method)
+	assert.Equal(t, "/write?db=p4", req.path)
+	assert.Equal(t, "", req.headers.Get("Authorization"))
+	assert.Equal(t, `p4_cmd_counter,serverid=master,cmd=user-sync value=3
+p4_cmd_counter,serverid=master,cmd=user-submit value=1
+p4_cmd_running,serverid=master value=2.5
+p4_test,name=a\ b\,c\=d value=1
+`, string(req.body))
+}
+
+type decodedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// Decodes a remote write request, failing the test if it is not valid protobuf
+func decodeWriteRequest(t *testing.T, buf []byte) []decodedSeries {
+	result := make([]decodedSeries, 0)
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = f(num, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	fields(buf, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		assert.Equal(t, protowire.Number(pbWriteRequestTimeseries), num)
+		tsBuf, n := protowire.ConsumeBytes(b)
+		s := decodedSeries{labels: make(map[string]string)}
+		fields(tsBuf, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case pbTimeSeriesLabels:
+				var name, value string
+				fields(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					str, n := protowire.ConsumeString(b)
+					if num == pbLabelName {
+						name = str
+					} else {
+						value = str
+					}
+					return n
+				})
+				s.labels[name] = value
+			case pbTimeSeriesSamples:
+				fields(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num == pbSampleValue {
+						v, n := protowire.ConsumeFixed64(b)
+						s.value = math.Float64frombits(v)
+						return n
+					}
+					v, n := protowire.ConsumeVarint(b)
+					s.timestamp = int64(v)
+					return n
+				})
+			}
+			return n
+		})
+		result = append(result, s)
+		return n
+	})
+	return result
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	server, received := newRecordingServer(t, http.StatusNoContent)
+	cfg := &config.Config{Outputs: []config.Output{
+		{Type: config.OutputRemoteWrite, Name: "remote_write", URL: server.URL + "/api/v1/write",
+			Token: "mytoken", Timeout: time.Second},
+	}}
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	assert.NoError(t, getSink(t, cfg, "remote_write").write([]byte(testSinkMetrics)))
+	req := <-received
+	assert.Equal(t, http.MethodPost, req.method)
+	assert.Equal(t, "/api/v1/write", req.path)
+	assert.Equal(t, "Bearer mytoken", req.headers.Get("Authorization"))
+	assert.Equal(t, "snappy", req.headers.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", req.headers.Get("Content-Type"))
+	assert.Equal(t, "0.1.0", req.headers.Get("X-Prometheus-Remote-Write-Version"))
+
+	buf, err := snappy.Decode(nil, req.body)
+	assert.NoError(t, err)
+	series := decodeWriteRequest(t, buf)
+	assert.Equal(t, 3, len(series))
+	assert.Equal(t, map[string]string{"__name__": "p4_cmd_counter", "serverid": "master", "cmd": "user-sync"}, series[0].labels)
+	assert.Equal(t, 3.0, series[0].value)
+	assert.True(t, series[0].timestamp >= before)
+	// Empty label values are omitted
+	assert.Equal(t, map[string]string{"__name__": "p4_cmd_running", "serverid": "master"}, series[2].labels)
+	assert.Equal(t, 2.5, series[2].value)
+}
+
+func TestEncodeWriteRequestLabelOrder(t *testing.T) {
+	series := parseTimeSeries([]byte(`p4_test{zz="1",aa="2"} 1`))
+	buf := encodeWriteRequest(series, time.Unix(1441207389, 0))
+	// Labels must be sorted by name
+	s := string(buf)
+	assert.True(t, strings.Index(s, "__name__") < strings.Index(s, "aa"))
+	assert.True(t, strings.Index(s, "aa") < strings.Index(s, "zz"))
+	decoded := decodeWriteRequest(t, buf)
+	assert.Equal(t, int64(1441207389000), decoded[0].timestamp)
+}
@@ -0,0 +1,118 @@
+package main
+
+// Slow command log - commands parsed from the log whose lapse is at least the threshold for their cmd
+// are written as JSON lines (as per p4dlog.Command, including table lock times), so individual slow
+// commands can be found when investigating spikes in the metrics. The file is rotated when it reaches
+// its maximum size, keeping <path>.1 (most recent) to <path>.<backups>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+type slowCmdLog struct {
+	path       string
+	thresholds map[string]time.Duration
+	maxSize    int64 // bytes
+	backups    int
+	f          *os.File
+	size       int64
+}
+
+func newSlowCmdLog(cfg *config.Config) *slowCmdLog {
+	l := &slowCmdLog{path: cfg.SlowCmdLog}
+	l.configure(cfg)
+	return l
+}
+
+// configure - applies the thresholds and rotation settings, e.g. on reload
+func (l *slowCmdLog) configure(cfg *config.Config) {
+	l.thresholds = cfg.SlowCmdThresholds
+	l.maxSize = int64(cfg.SlowCmdLogMaxSize) << 20
+	l.backups = cfg.SlowCmdLogBackups
+}
+
+// isSlow - whether the command's lapse is at least the threshold for its cmd (or the default)
+func (l *slowCmdLog) isSlow(cmd *p4dlog.Command) bool {
+	threshold, ok := l.thresholds[cmd.Cmd]
+	if !ok {
+		threshold, ok = l.thresholds[config.SlowCmdDefault]
+	}
+	return ok && float64(cmd.CompletedLapse) >= threshold.Seconds()
+}
+
+// add - writes the command if it is slow, returning whether it was written
+func (l *slowCmdLog) add(cmd p4dlog.Command) (bool, error) {
+	if !l.isSlow(&cmd) {
+		return false, nil
+	}
+	line, err := json.Marshal(&cmd)
+	if err != nil {
+		return false, err
+	}
+	line = append(line, '\n')
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return false, err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return false, err
+		}
+		if err := l.open(); err != nil {
+			return false, err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return false, fmt.Errorf("error writing %s: %v", l.path, err)
+	}
+	return true, nil
+}
+
+func (l *slowCmdLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+// rotate - renames <path>.N to <path>.N+1 (removing the oldest) and <path> to <path>.1
+func (l *slowCmdLog) rotate() error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	if l.backups == 0 {
+		return os.Remove(l.path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.backups))
+	for i := l.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	return os.Rename(l.path, l.path+".1")
+}
+
+func (l *slowCmdLog) close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	l.size = 0
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func readSlowCmds(t *testing.T, path string) []map[string]interface{} {
+	buf, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	result := make([]map[string]interface{}, 0)
+	for _, line := range nonEmptyLines(buf) {
+		var cmd map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &cmd))
+		result = append(result, cmd)
+	}
+	return result
+}
+
+func TestSlowCmdLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.json")
+	l := newSlowCmdLog(&config.Config{
+		SlowCmdLog:        path,
+		SlowCmdThresholds: map[string]time.Duration{config.SlowCmdDefault: 10 * time.Second, "user-sync": time.Minute},
+		SlowCmdLogMaxSize: 1,
+		SlowCmdLogBackups: 2,
+	})
+	defer l.close()
+	start := time.Date(2022, 1, 27, 1, 2, 3, 0, time.UTC)
+	sync := p4dlog.Command{Cmd: "user-sync", User: "fred", Workspace: "fred_ws", IP: "10.1.2.3", Args: "//depot/...",
+		StartTime: start, EndTime: start.Add(90 * time.Second), CompletedLapse: 90,
+		Tables: map[string]*p4dlog.Table{"rev": {TableName: "rev", TotalReadWait: 1500, TotalReadHeld: 2000}}}
+
+	for _, tc := range []struct {
+		cmd    string
+		lapse  float32
+		logged bool
+	}{
+		{"user-sync", 59, false}, {"user-sync", 60, true}, {"user-submit", 9.9, false}, {"user-submit", 10, true},
+	} {
+		cmd := sync
+		cmd.Cmd = tc.cmd
+		cmd.CompletedLapse = tc.lapse
+		logged, err := l.add(cmd)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.logged, logged, "%s %v", tc.cmd, tc.lapse)
+	}
+	cmds := readSlowCmds(t, path)
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, "user-sync", cmds[0]["cmd"])
+	assert.Equal(t, "fred", cmds[0]["user"])
+	assert.Equal(t, "fred_ws", cmds[0]["workspace"])
+	assert.Equal(t, "10.1.2.3", cmds[0]["ip"])
+	assert.Equal(t, "//depot/...", cmds[0]["args"])
+	assert.Equal(t, 60.0, cmds[0]["completedLapse"])
+	tables := cmds[0]["tables"].([]interface{})
+	assert.Equal(t, 1500.0, tables[0].(map[string]interface{})["totalReadWait"])
+	assert.Equal(t, "user-submit", cmds[1]["cmd"])
+
+	// Only listed cmds are logged without a default
+	l.thresholds = map[string]time.Duration{"user-sync": time.Minute}
+	logged, err := l.add(p4dlog.Command{Cmd: "user-submit", CompletedLapse: 1000})
+	assert.NoError(t, err)
+	assert.False(t, logged)
+}
+
+func TestSlowCmdLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.json")
+	l := newSlowCmdLog(&config.Config{
+		SlowCmdLog:        path,
+		SlowCmdThresholds: map[string]time.Duration{config.SlowCmdDefault: 0},
+		SlowCmdLogMaxSize: 1,
+		SlowCmdLogBackups: 2,
+	})
+	defer l.close()
+	l.maxSize = 1 // So that each command is in a separate file
+	for _, user := range []string{"u1", "u2", "u3", "u4"} {
+		_, err := l.add(p4dlog.Command{Cmd: "user-sync", User: user})
+		assert.NoError(t, err)
+	}
+	for suffix, user := range map[string]string{"": "u4", ".1": "u3", ".2": "u2"} {
+		cmds := readSlowCmds(t, path+suffix)
+		assert.Equal(t, 1, len(cmds), suffix)
+		assert.Equal(t, user, cmds[0]["user"], suffix)
+	}
+	_, err := os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Existing file is appended to
+	l.close()
+	l.maxSize = 1 << 20
+	_, err = l.add(p4dlog.Command{Cmd: "user-sync", User: "u5"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(readSlowCmds(t, path)))
+
+	// No backups
+	l.backups = 0
+	l.maxSize = 1
+	_, err = l.add(p4dlog.Command{Cmd: "user-sync", User: "u6"})
+	assert.NoError(t, err)
+	cmds := readSlowCmds(t, path)
+	assert.Equal(t, 1, len(cmds))
+	assert.Equal(t, "u6", cmds[0]["user"])
+}
+
+func TestRunLogTailerSlowCmdLog(t *testing.T) {
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	cfg := &config.Config{
+		LogPath:           logPath,
+		MetricsOutput:     dir + "/cmds.prom",
+		ServerID:          "myserverid",
+		UpdateInterval:    time.Hour, // So metrics are only written on shutdown
+		StateSaveInterval: time.Hour,
+		ShutdownTimeout:   5 * time.Second,
+		SlowCmdLog:        dir + "/slow.json",
+		SlowCmdThresholds: map[string]time.Duration{"user-sync": time.Second},
+		SlowCmdLogMaxSize: 100,
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, nil, false)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1616 completed 2.031s
+Perforce server info:
+	2015/09/02 15:23:12 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //depot/a/...'
+Perforce server info:
+	2015/09/02 15:23:12 pid 1617 completed .031s
+`)
+	f.Close()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	cmds := readSlowCmds(t, cfg.SlowCmdLog)
+	assert.Equal(t, 1, len(cmds))
+	assert.Equal(t, "robert", cmds[0]["user"])
+	assert.Equal(t, "//...", cmds[0]["args"])
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4prom_slow_cmds_logged{serverid="myserverid"} 1`)
+}
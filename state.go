@@ -0,0 +1,286 @@
+package main
+
+// Persistence of state between runs of p4prometheus, so that counters remain monotonic
+// across restarts and log lines written while p4prometheus was not running are still processed.
+// The state is the position in the log file (inode and byte offset) and the values of all counters
+// last output. On restart the log is re-read from the saved offset, and the saved counter values
+// are added to those output by the (newly started) log parser.
+//
+// Note that the offset is approximate - commands which were still running when the state was
+// saved may not be counted.
+//
+// The same mechanism is used to keep counters monotonic when the parser is restarted on config reload,
+// in which case no state file is required.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// counterFamily - saved values for all series of a single counter
+type counterFamily struct {
+	Help   string             `json:"help"`
+	Type   string             `json:"type"`
+	Series map[string]float64 `json:"series"`
+}
+
+// savedState - as written to the state file
+type savedState struct {
+	LogPath  string                    `json:"logPath"`
+	Inode    uint64                    `json:"inode"`
+	Offset   int64                     `json:"offset"`
+	SavedAt  time.Time                 `json:"savedAt"`
+	Counters map[string]*counterFamily `json:"counters"`
+}
+
+// stateTracker - tracks log position and counter values for a single log file
+type stateTracker struct {
+	filename       string
+	logPath        string
+	logger         *logrus.Logger
+	baseline       map[string]*counterFamily // Restored from state file
+	counters       map[string]*counterFamily // As last output
+	inode          uint64
+	offset         int64 // Current position in log
+	countersOffset int64 // Position in log when counters last output
+	catchUpFrom    int64
+	catchUpTo      int64
+}
+
+// loadState - returns nil if the state file doesn't exist
+func loadState(filename string) (*savedState, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	st := &savedState{}
+	if err := json.Unmarshal(buf, st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", filename, err)
+	}
+	return st, nil
+}
+
+// save - writes to temp file first and renames it after
+func (st *savedState) save(filename string) error {
+	buf, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+// newStateTracker - loads any previous state, and determines which part of the log needs to be
+// re-read. This must be called before the tailer is started.
+func newStateTracker(filename string, logPath string, logger *logrus.Logger) (*stateTracker, error) {
+	st := &stateTracker{
+		filename: filename,
+		logPath:  logPath,
+		logger:   logger,
+		baseline: make(map[string]*counterFamily),
+		counters: make(map[string]*counterFamily),
+	}
+	if filename == "" {
+		return st, nil
+	}
+	saved, err := loadState(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		// Nothing to catch up on - tailer will wait for log to appear
+		if saved != nil {
+			st.baseline = saved.Counters
+		}
+		return st, nil
+	}
+	st.inode = fileInode(fi)
+	st.offset = fi.Size()
+	st.catchUpTo = fi.Size()
+	st.catchUpFrom = fi.Size()
+	st.countersOffset = fi.Size()
+	if saved == nil {
+		return st, nil
+	}
+	if saved.LogPath != logPath {
+		logger.Warnf("State file %s is for log %s, not %s - ignoring", filename, saved.LogPath, logPath)
+		return st, nil
+	}
+	if saved.Counters != nil {
+		st.baseline = saved.Counters
+	}
+	if saved.Inode == st.inode && saved.Offset <= fi.Size() {
+		st.catchUpFrom = saved.Offset
+	} else {
+		// Log rotated while we were not running
+		logger.Warnf("Log %s has been rotated since state saved at %v - processing all of current log", logPath, saved.SavedAt)
+		st.catchUpFrom = 0
+	}
+	st.countersOffset = st.catchUpFrom
+	logger.Infof("Restored state from %s saved at %v: %d counters, catching up on %d bytes of log",
+		filename, saved.SavedAt, len(st.baseline), st.catchUpTo-st.catchUpFrom)
+	return st, nil
+}
+
+// catchUp - sends the log lines written since the state was saved
+func (st *stateTracker) catchUp(send func(line string)) error {
+	if st.catchUpFrom >= st.catchUpTo {
+		return nil
+	}
+	f, err := os.Open(st.logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(st.catchUpFrom, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.LimitReader(f, st.catchUpTo-st.catchUpFrom))
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			send(trimEOL(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func trimEOL(line string) string {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+// lineRead - records the position of the tailer in the log
+func (st *stateTracker) lineRead(line string) {
+	st.offset += int64(len(line)) + 1
+}
+
+// checkRotation - as the tailer does not report log rotation, check for a new inode (or the log
+// getting smaller) and assume that the tailer has caught up with the new log.
+func (st *stateTracker) checkRotation() {
+	fi, err := os.Stat(st.logPath)
+	if err != nil {
+		return
+	}
+	inode := fileInode(fi)
+	if inode != st.inode || fi.Size() < st.offset {
+		st.logger.Debugf("Log %s rotated", st.logPath)
+		st.inode = inode
+		st.offset = fi.Size()
+		st.countersOffset = fi.Size()
+	}
+}
+
+// adjust - adds restored counter values to the metrics output by the parser, and records the
+// resulting counter values to be saved.
+func (st *stateTracker) adjust(metrics []byte) []byte {
+	mf := newMetricFamilies()
+	mf.add(metrics)
+	if len(st.baseline) > 0 {
+		names := make([]string, 0, len(st.baseline))
+		for name := range st.baseline {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cf := st.baseline[name]
+			_, exists := mf.families[name]
+			f := mf.get(name)
+			if !exists {
+				f.help = cf.Help
+				f.mtype = cf.Type
+			}
+			seen := make(map[string]bool)
+			for i, line := range f.samples {
+				series, v, err := parseSample(line)
+				if err != nil {
+					continue
+				}
+				if b, ok := cf.Series[series]; ok {
+					f.samples[i] = formatSample(series, v+b)
+					seen[series] = true
+				}
+			}
+			// Series not yet seen since restart
+			missing := make([]string, 0)
+			for series := range cf.Series {
+				if !seen[series] {
+					missing = append(missing, series)
+				}
+			}
+			sort.Strings(missing)
+			for _, series := range missing {
+				f.samples = append(f.samples, formatSample(series, cf.Series[series]))
+			}
+		}
+		metrics = mf.bytes()
+	}
+	counters := make(map[string]*counterFamily)
+	for _, name := range mf.order {
+		f := mf.families[name]
+		if f.metricType() != "counter" {
+			continue
+		}
+		cf := &counterFamily{Help: f.help, Type: f.mtype, Series: make(map[string]float64)}
+		for _, line := range f.samples {
+			if series, v, err := parseSample(line); err == nil {
+				cf.Series[series] = v
+			}
+		}
+		counters[name] = cf
+	}
+	st.counters = counters
+	st.countersOffset = st.offset
+	return metrics
+}
+
+// rebase - to be called when the parser is restarted, so that the counter values last output
+// are added to those from the new parser.
+func (st *stateTracker) rebase() {
+	if len(st.counters) > 0 {
+		st.baseline = st.counters
+	}
+}
+
+// save - writes current state if a state file was specified
+func (st *stateTracker) save() error {
+	if st.filename == "" {
+		return nil
+	}
+	st.checkRotation()
+	saved := &savedState{
+		LogPath:  st.logPath,
+		Inode:    st.inode,
+		Offset:   st.countersOffset,
+		SavedAt:  time.Now(),
+		Counters: st.counters,
+	}
+	if len(saved.Counters) == 0 {
+		// Nothing output yet so keep any previous values
+		saved.Counters = st.baseline
+	}
+	return saved.save(st.filename)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const stateTestMetrics = `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 2
+# HELP p4_cmd_running The number of running commands at any one time
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="myserverid"} 3
+`
+
+func TestStateAdjust(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	stateFile := filepath.Join(dir, "state.json")
+	assert.NoError(t, os.WriteFile(logPath, []byte("line1\nline2\n"), 0644))
+
+	st, err := newStateTracker(stateFile, logPath, logger)
+	assert.NoError(t, err)
+	// No baseline so output unchanged
+	assert.Equal(t, stateTestMetrics, string(st.adjust([]byte(stateTestMetrics))))
+	assert.Equal(t, map[string]float64{`p4_cmd_counter{serverid="myserverid",cmd="user-sync"}`: 2},
+		st.counters["p4_cmd_counter"].Series)
+	assert.NotContains(t, st.counters, "p4_cmd_running")
+	assert.NoError(t, st.save())
+
+	// Restart - counters are added to, gauges are not, and series not yet seen are still output
+	st, err = newStateTracker(stateFile, logPath, logger)
+	assert.NoError(t, err)
+	result := st.adjust([]byte(`# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-edit"} 1
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1
+# HELP p4_cmd_running The number of running commands at any one time
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="myserverid"} 1
+`))
+	assert.Equal(t, `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-edit"} 1
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 3
+# HELP p4_cmd_running The number of running commands at any one time
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="myserverid"} 1
+`, string(result))
+
+	result = st.adjust([]byte(`# HELP p4_cmd_running The number of running commands at any one time
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="myserverid"} 0
+`))
+	assert.Equal(t, `# HELP p4_cmd_running The number of running commands at any one time
+# TYPE p4_cmd_running gauge
+p4_cmd_running{serverid="myserverid"} 0
+# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 2
+`, string(result))
+}
+
+func sendTo(linesChan chan<- string) func(line string) {
+	return func(line string) { linesChan <- line }
+}
+
+func TestStateCatchUp(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	stateFile := filepath.Join(dir, "state.json")
+	assert.NoError(t, os.WriteFile(logPath, []byte("line1\nline2\n"), 0644))
+
+	st, err := newStateTracker(stateFile, logPath, logger)
+	assert.NoError(t, err)
+	linesChan := make(chan string, 10)
+	// Nothing to catch up on first run as tailer starts at end of log
+	assert.NoError(t, st.catchUp(sendTo(linesChan)))
+	assert.Equal(t, 0, len(linesChan))
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString("line3\n")
+	st.lineRead("line3")
+	st.adjust([]byte(stateTestMetrics))
+	assert.NoError(t, st.save())
+
+	// Lines written while not running are re-read on restart
+	f.WriteString("line4\r\nline5\n")
+	f.Close()
+	st, err = newStateTracker(stateFile, logPath, logger)
+	assert.NoError(t, err)
+	assert.NoError(t, st.catchUp(sendTo(linesChan)))
+	close(linesChan)
+	assert.Equal(t, []string{"line4", "line5"}, getResult(linesChan))
+
+	// Rotated log is read from the start
+	assert.NoError(t, os.Remove(logPath))
+	assert.NoError(t, os.WriteFile(logPath, []byte("new1\n"), 0644))
+	st, err = newStateTracker(stateFile, logPath, logger)
+	assert.NoError(t, err)
+	linesChan = make(chan string, 10)
+	assert.NoError(t, st.catchUp(sendTo(linesChan)))
+	close(linesChan)
+	assert.Equal(t, []string{"new1"}, getResult(linesChan))
+}
+
+func TestStateRebase(t *testing.T) {
+	// No state file - just keeping counters monotonic when parser restarted
+	st, err := newStateTracker("", "/p4/1/logs/log", logger)
+	assert.NoError(t, err)
+	assert.Equal(t, stateTestMetrics, string(st.adjust([]byte(stateTestMetrics))))
+	st.rebase()
+	result := st.adjust([]byte(`# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1
+`))
+	assert.Equal(t, `# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter counter
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 3
+`, string(result))
+	assert.NoError(t, st.save())
+}
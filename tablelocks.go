@@ -0,0 +1,162 @@
+package main
+
+// Per table lock contention from the track output of the commands parsed from the log. The parser
+// only outputs total wait/held seconds by table (p4_total_read_wait_seconds etc), so these add
+// distributions by table and lock mode, and the commands holding locks longest, so that lock storms
+// on e.g. db.rev or db.have can be investigated without processing the log offline.
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/perforce/p4prometheus/config"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+)
+
+// Track output for triggers is recorded as a table with this prefix
+const triggerTablePrefix = "trigger_"
+
+// tableLockKey - the labels of the table lock metrics
+type tableLockKey struct {
+	table, mode string // mode is read or write
+}
+
+// tableLockHolder - a command which held locks on a table, for the top commands
+type tableLockHolder struct {
+	cmd, user string
+	pid       int64
+	held      float64 // Read and write held seconds
+}
+
+// tableLocks - histograms of wait and held times (per command) by table and mode, a count of
+// commands which had to wait, and the commands which held locks longest since the last output
+type tableLocks struct {
+	buckets []float64
+	topN    int
+	waited  map[tableLockKey]int64
+	wait    map[tableLockKey]*histogram
+	held    map[tableLockKey]*histogram
+	top     map[string][]tableLockHolder // By table, longest first
+}
+
+func newTableLocks(cfg *config.Config) *tableLocks {
+	t := &tableLocks{waited: make(map[tableLockKey]int64), top: make(map[string][]tableLockHolder)}
+	t.configure(cfg)
+	return t
+}
+
+// configure - applies the settings, e.g. on reload. Histograms are restarted if the buckets change.
+func (t *tableLocks) configure(cfg *config.Config) {
+	t.topN = cfg.TableLockTopCmds
+	if t.wait == nil || !equalBuckets(t.buckets, cfg.CmdLockWaitBuckets) {
+		t.buckets = cfg.CmdLockWaitBuckets
+		t.wait = make(map[tableLockKey]*histogram)
+		t.held = make(map[tableLockKey]*histogram)
+	}
+}
+
+func (t *tableLocks) observe(key tableLockKey, locks, wait, held int64) {
+	if locks == 0 && wait == 0 && held == 0 {
+		return
+	}
+	if _, ok := t.wait[key]; !ok {
+		t.wait[key] = newHistogram(t.buckets)
+		t.held[key] = newHistogram(t.buckets)
+	}
+	t.wait[key].observe(float64(wait) / 1000)
+	t.held[key].observe(float64(held) / 1000)
+	if wait > 0 {
+		t.waited[key]++
+	}
+}
+
+// add - records the lock times (in milliseconds in the track output) for each table used by the command
+func (t *tableLocks) add(cmd p4dlog.Command) {
+	for _, tbl := range cmd.Tables {
+		if strings.HasPrefix(tbl.TableName, triggerTablePrefix) {
+			continue
+		}
+		t.observe(tableLockKey{tbl.TableName, "read"}, tbl.ReadLocks, tbl.TotalReadWait, tbl.TotalReadHeld)
+		t.observe(tableLockKey{tbl.TableName, "write"}, tbl.WriteLocks, tbl.TotalWriteWait, tbl.TotalWriteHeld)
+		held := float64(tbl.TotalReadHeld+tbl.TotalWriteHeld) / 1000
+		if t.topN == 0 || held == 0 {
+			continue
+		}
+		top := t.top[tbl.TableName]
+		i := sort.Search(len(top), func(i int) bool { return top[i].held < held })
+		if i >= t.topN {
+			continue
+		}
+		top = append(top, tableLockHolder{})
+		copy(top[i+1:], top[i:])
+		top[i] = tableLockHolder{cmd: cmd.Cmd, user: cmd.User, pid: cmd.Pid, held: held}
+		if len(top) > t.topN {
+			top = top[:t.topN]
+		}
+		t.top[tbl.TableName] = top
+	}
+}
+
+// reset - clears the counters when the log parser is restarted and the values last output are
+// used as a baseline. The histograms are not counter metrics so are not adjusted.
+func (t *tableLocks) reset() {
+	t.waited = make(map[tableLockKey]int64)
+}
+
+func sortedTableLockKeys(m map[tableLockKey]*histogram) []tableLockKey {
+	keys := make([]tableLockKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].table != keys[j].table {
+			return keys[i].table < keys[j].table
+		}
+		return keys[i].mode < keys[j].mode
+	})
+	return keys
+}
+
+// output - the metrics with the self metrics labels. The top commands are those completed since
+// the previous output.
+func (t *tableLocks) output(fixed []labelPair) []byte {
+	buf := new(bytes.Buffer)
+	labels := func(extra ...labelPair) []labelPair {
+		return append(append([]labelPair{}, fixed...), extra...)
+	}
+	keys := sortedTableLockKeys(t.wait)
+	if len(keys) > 0 {
+		printHeader(buf, "p4_table_lock_wait_counter", "Count of commands which waited for table locks (by table and mode)", "counter")
+		for _, k := range keys {
+			printSample(buf, "p4_table_lock_wait_counter", labels(labelPair{"table", k.table}, labelPair{"mode", k.mode}),
+				strconv.FormatInt(t.waited[k], 10))
+		}
+		printHeader(buf, "p4_table_lock_wait_seconds", "Time commands waited for table locks (by table and mode)", "histogram")
+		for _, k := range keys {
+			t.wait[k].write(buf, "p4_table_lock_wait_seconds", labels(labelPair{"table", k.table}, labelPair{"mode", k.mode}))
+		}
+		printHeader(buf, "p4_table_lock_held_seconds", "Time commands held table locks (by table and mode)", "histogram")
+		for _, k := range keys {
+			t.held[k].write(buf, "p4_table_lock_held_seconds", labels(labelPair{"table", k.table}, labelPair{"mode", k.mode}))
+		}
+	}
+	if len(t.top) > 0 {
+		tables := make([]string, 0, len(t.top))
+		for table := range t.top {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		printHeader(buf, "p4_table_lock_top_held_seconds", "Commands holding table locks longest since last update (by table)", "gauge")
+		for _, table := range tables {
+			for _, h := range t.top[table] {
+				printSample(buf, "p4_table_lock_top_held_seconds", labels(labelPair{"table", table}, labelPair{"cmd", h.cmd},
+					labelPair{"user", h.user}, labelPair{"pid", strconv.FormatInt(h.pid, 10)}),
+					strconv.FormatFloat(h.held, 'f', 3, 64))
+			}
+		}
+		t.top = make(map[string][]tableLockHolder)
+	}
+	return buf.Bytes()
+}
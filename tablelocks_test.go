@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	p4dlog "github.com/rcowham/go-libp4dlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableLocks(t *testing.T) {
+	tl := newTableLocks(&config.Config{CmdLockWaitBuckets: []float64{0.1, 1}, TableLockTopCmds: 2})
+	tl.add(p4dlog.Command{Cmd: "user-sync", User: "fred", Pid: 1, Tables: map[string]*p4dlog.Table{
+		"rev":             {TableName: "rev", ReadLocks: 1, TotalReadWait: 500, TotalReadHeld: 2000},
+		"trigger_swarm":   {TableName: "trigger_swarm", TriggerLapse: 1.5},
+		"counters":        {TableName: "counters"},
+		"storageup_R":     {TableName: "storageup_R", TotalReadHeld: 3},
+		"have":            {TableName: "have", WriteLocks: 1, TotalWriteHeld: 50},
+		"trigger_unknown": {TableName: "trigger_unknown"},
+	}})
+	tl.add(p4dlog.Command{Cmd: "user-submit", User: "bob", Pid: 2, Tables: map[string]*p4dlog.Table{
+		"rev": {TableName: "rev", WriteLocks: 1, TotalWriteHeld: 3000},
+	}})
+	tl.add(p4dlog.Command{Cmd: "user-fstat", User: "jim", Pid: 3, Tables: map[string]*p4dlog.Table{
+		"rev": {TableName: "rev", ReadLocks: 1, TotalReadHeld: 100},
+	}})
+	tl.add(p4dlog.Command{Cmd: "user-files", User: "sue", Pid: 4, Tables: map[string]*p4dlog.Table{
+		"rev": {TableName: "rev", ReadLocks: 1, TotalReadWait: 20, TotalReadHeld: 2500},
+	}})
+
+	fixed := []labelPair{{"serverid", "myserverid"}, {"sdpinst", ""}}
+	assert.Equal(t, `# HELP p4_table_lock_wait_counter Count of commands which waited for table locks (by table and mode)
+# TYPE p4_table_lock_wait_counter counter
+p4_table_lock_wait_counter{serverid="myserverid",table="have",mode="write"} 0
+p4_table_lock_wait_counter{serverid="myserverid",table="rev",mode="read"} 2
+p4_table_lock_wait_counter{serverid="myserverid",table="rev",mode="write"} 0
+p4_table_lock_wait_counter{serverid="myserverid",table="storageup_R",mode="read"} 0
+# HELP p4_table_lock_wait_seconds Time commands waited for table locks (by table and mode)
+# TYPE p4_table_lock_wait_seconds histogram
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="have",mode="write",le="0.1"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="have",mode="write",le="1"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="have",mode="write",le="+Inf"} 1
+p4_table_lock_wait_seconds_sum{serverid="myserverid",table="have",mode="write"} 0.000
+p4_table_lock_wait_seconds_count{serverid="myserverid",table="have",mode="write"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="rev",mode="read",le="0.1"} 2
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="rev",mode="read",le="1"} 3
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="rev",mode="read",le="+Inf"} 3
+p4_table_lock_wait_seconds_sum{serverid="myserverid",table="rev",mode="read"} 0.520
+p4_table_lock_wait_seconds_count{serverid="myserverid",table="rev",mode="read"} 3
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="rev",mode="write",le="0.1"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="rev",mode="write",le="1"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="rev",mode="write",le="+Inf"} 1
+p4_table_lock_wait_seconds_sum{serverid="myserverid",table="rev",mode="write"} 0.000
+p4_table_lock_wait_seconds_count{serverid="myserverid",table="rev",mode="write"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="storageup_R",mode="read",le="0.1"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="storageup_R",mode="read",le="1"} 1
+p4_table_lock_wait_seconds_bucket{serverid="myserverid",table="storageup_R",mode="read",le="+Inf"} 1
+p4_table_lock_wait_seconds_sum{serverid="myserverid",table="storageup_R",mode="read"} 0.000
+p4_table_lock_wait_seconds_count{serverid="myserverid",table="storageup_R",mode="read"} 1
+# HELP p4_table_lock_held_seconds Time commands held table locks (by table and mode)
+# TYPE p4_table_lock_held_seconds histogram
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="have",mode="write",le="0.1"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="have",mode="write",le="1"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="have",mode="write",le="+Inf"} 1
+p4_table_lock_held_seconds_sum{serverid="myserverid",table="have",mode="write"} 0.050
+p4_table_lock_held_seconds_count{serverid="myserverid",table="have",mode="write"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="rev",mode="read",le="0.1"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="rev",mode="read",le="1"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="rev",mode="read",le="+Inf"} 3
+p4_table_lock_held_seconds_sum{serverid="myserverid",table="rev",mode="read"} 4.600
+p4_table_lock_held_seconds_count{serverid="myserverid",table="rev",mode="read"} 3
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="rev",mode="write",le="0.1"} 0
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="rev",mode="write",le="1"} 0
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="rev",mode="write",le="+Inf"} 1
+p4_table_lock_held_seconds_sum{serverid="myserverid",table="rev",mode="write"} 3.000
+p4_table_lock_held_seconds_count{serverid="myserverid",table="rev",mode="write"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="storageup_R",mode="read",le="0.1"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="storageup_R",mode="read",le="1"} 1
+p4_table_lock_held_seconds_bucket{serverid="myserverid",table="storageup_R",mode="read",le="+Inf"} 1
+p4_table_lock_held_seconds_sum{serverid="myserverid",table="storageup_R",mode="read"} 0.003
+p4_table_lock_held_seconds_count{serverid="myserverid",table="storageup_R",mode="read"} 1
+# HELP p4_table_lock_top_held_seconds Commands holding table locks longest since last update (by table)
+# TYPE p4_table_lock_top_held_seconds gauge
+p4_table_lock_top_held_seconds{serverid="myserverid",table="have",cmd="user-sync",user="fred",pid="1"} 0.050
+p4_table_lock_top_held_seconds{serverid="myserverid",table="rev",cmd="user-submit",user="bob",pid="2"} 3.000
+p4_table_lock_top_held_seconds{serverid="myserverid",table="rev",cmd="user-files",user="sue",pid="4"} 2.500
+p4_table_lock_top_held_seconds{serverid="myserverid",table="storageup_R",cmd="user-sync",user="fred",pid="1"} 0.003
+`, string(tl.output(fixed)))
+
+	// Top commands are since the last output, and counters are reset when the parser is restarted
+	tl.reset()
+	out := string(tl.output(fixed))
+	assert.Contains(t, out, `p4_table_lock_wait_counter{serverid="myserverid",table="rev",mode="read"} 0`)
+	assert.Contains(t, out, `p4_table_lock_held_seconds_count{serverid="myserverid",table="rev",mode="read"} 3`)
+	assert.NotContains(t, out, "p4_table_lock_top_held_seconds")
+
+	// Histograms restarted if buckets change
+	tl.configure(&config.Config{CmdLockWaitBuckets: []float64{0.1, 1}, TableLockTopCmds: 0})
+	assert.Contains(t, string(tl.output(fixed)), `p4_table_lock_held_seconds_count{serverid="myserverid",table="rev",mode="read"} 3`)
+	tl.configure(&config.Config{CmdLockWaitBuckets: []float64{1}, TableLockTopCmds: 0})
+	tl.add(p4dlog.Command{Cmd: "user-sync", Tables: map[string]*p4dlog.Table{
+		"rev": {TableName: "rev", ReadLocks: 1, TotalReadHeld: 2000},
+	}})
+	out = string(tl.output(fixed))
+	assert.Contains(t, out, `p4_table_lock_held_seconds_count{serverid="myserverid",table="rev",mode="read"} 1`)
+	assert.NotContains(t, out, "p4_table_lock_top_held_seconds")
+}
+
+func TestRunLogTailerTableLocks(t *testing.T) {
+	dir := t.TempDir()
+	logPath := dir + "/log"
+	assert.NoError(t, os.WriteFile(logPath, []byte(""), 0644))
+	cfg := &config.Config{
+		LogPath:            logPath,
+		MetricsOutput:      dir + "/cmds.prom",
+		ServerID:           "myserverid",
+		UpdateInterval:     time.Hour, // So metrics are only written on shutdown
+		StateSaveInterval:  time.Hour,
+		ShutdownTimeout:    5 * time.Second,
+		CmdLockWaitBuckets: config.DefaultCmdLockWaitBuckets,
+		TableLockMetrics:   true,
+		TableLockTopCmds:   5,
+		AnonymiseUsers:     config.AnonymiseHash,
+		AnonymiseKey:       "secret",
+	}
+	logcfg := &logConfig{Type: "file", Path: logPath}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runLogTailer(ctx, logger, logcfg, cfg, nil, nil, false)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(`Perforce server info:
+	2017/02/15 13:46:42 pid 81805 bruno@robert_cowham-dvcs-1487082773 10.62.185.98 [p4/2016.2/LINUX26X86_64/1468155] 'user-client -d -f bruno.139631598948304.irp210-h03'
+Perforce server info:
+	2017/02/15 13:46:42 pid 81805 completed .009s 8+1us 0+1408io 0+0net 4088k 0pf
+Perforce server info:
+	2017/02/15 13:46:42 pid 81805 bruno@robert_cowham-dvcs-1487082773 10.62.185.98 [p4/2016.2/LINUX26X86_64/1468155] 'user-client -d -f bruno.139631598948304.irp210-h03'
+--- lapse .009s
+--- db.have
+---   pages in+out+cached 1+2+3
+---   locks read/write 4/5 rows get+pos+scan put+del 6+7+8 9+10
+---   total lock wait+held read/write 12ms+13ms/14ms+15ms
+
+`)
+	f.Close()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("runLogTailer did not shut down")
+	}
+	buf, err := os.ReadFile(cfg.MetricsOutput)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `p4_table_lock_wait_counter{serverid="myserverid",table="have",mode="write"} 1`)
+	assert.Contains(t, string(buf), `p4_table_lock_held_seconds_sum{serverid="myserverid",table="have",mode="read"} 0.013`)
+	user := newAnonymiser(cfg).user("bruno")
+	assert.Contains(t, string(buf), `p4_table_lock_top_held_seconds{serverid="myserverid",table="have",cmd="user-client",user="`+user+`",pid="81805"} 0.028`)
+}
@@ -0,0 +1,119 @@
+package main
+
+// Optional HTTP endpoint which serves the latest metrics snapshot so that Prometheus
+// can scrape p4prometheus directly, rather than via node_exporter's textfile collector.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Content type for Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsServer holds the most recent metrics snapshot per instance and serves them over HTTP
+type metricsServer struct {
+	config   *config.Config
+	logger   *logrus.Logger
+	mutex    sync.RWMutex
+	latest   map[string][]byte
+	lastTime time.Time
+}
+
+func newMetricsServer(config *config.Config, logger *logrus.Logger) *metricsServer {
+	return &metricsServer{
+		config: config,
+		logger: logger,
+		latest: make(map[string][]byte),
+	}
+}
+
+// update - saves the latest snapshot for an instance (identified by its log path) to be returned by the next scrape
+func (ms *metricsServer) update(instance string, metrics []byte) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.latest[instance] = metrics
+	ms.lastTime = time.Now()
+}
+
+// verifyUserPass verifies that username/password is a valid pair matching
+// the bcrypted passwords in basic_auth_users
+func (ms *metricsServer) verifyUserPass(username, password string) bool {
+	wantPass, hasUser := ms.config.BasicAuthUsers[username]
+	if !hasUser {
+		return false
+	}
+	if cmperr := bcrypt.CompareHashAndPassword([]byte(wantPass), []byte(password)); cmperr == nil {
+		return true
+	}
+	return false
+}
+
+func (ms *metricsServer) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	if len(ms.config.BasicAuthUsers) > 0 {
+		user, pass, ok := req.BasicAuth()
+		if !ok || !ms.verifyUserPass(user, pass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="p4prometheus"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	if len(ms.latest) == 0 {
+		http.Error(w, "No metrics available yet", http.StatusServiceUnavailable)
+		return
+	}
+	// Consistent ordering of instances between scrapes
+	instances := make([]string, 0, len(ms.latest))
+	for k := range ms.latest {
+		instances = append(instances, k)
+	}
+	sort.Strings(instances)
+	blobs := make([][]byte, 0, len(instances))
+	for _, k := range instances {
+		blobs = append(blobs, ms.latest[k])
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Header().Set("Last-Modified", ms.lastTime.UTC().Format(http.TimeFormat))
+	w.Write(mergeMetrics(blobs))
+}
+
+func (ms *metricsServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", ms.metricsHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprintf(w, "<html><head><title>P4Prometheus</title></head><body><h1>P4Prometheus</h1><p><a href=\"/metrics\">Metrics</a></p></body></html>\n")
+	})
+	return mux
+}
+
+// serve - listens on the configured address until the server fails. Intended to be run as a goroutine.
+func (ms *metricsServer) serve() error {
+	srv := &http.Server{
+		Addr:    ms.config.ListenAddress,
+		Handler: ms.handler(),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if ms.config.TLSCertFile != "" {
+		ms.logger.Infof("Serving metrics on https://%s/metrics", ms.config.ListenAddress)
+		return srv.ListenAndServeTLS(ms.config.TLSCertFile, ms.config.TLSKeyFile)
+	}
+	ms.logger.Infof("Serving metrics on http://%s/metrics", ms.config.ListenAddress)
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/perforce/p4prometheus/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMetricsServer(t *testing.T) {
+	cfg := &config.Config{ListenAddress: ":0"}
+	ms := newMetricsServer(cfg, logger)
+	h := ms.handler()
+
+	// Nothing available until first update
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	ms.update("/p4/1/logs/log", []byte("p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, metricsContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "p4_cmd_running{serverid=\"myserverid\"} 1\n", rec.Body.String())
+
+	// Multiple instances are concatenated
+	ms.update("/p4/2/logs/log", []byte("p4_cmd_running{serverid=\"other\"} 2\n"))
+	ms.update("/p4/1/logs/log", []byte("p4_cmd_running{serverid=\"myserverid\"} 3\n"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "p4_cmd_running{serverid=\"myserverid\"} 3\np4_cmd_running{serverid=\"other\"} 2\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/other", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestMetricsServerBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		ListenAddress:  ":0",
+		BasicAuthUsers: map[string]string{"prometheus": string(hash)},
+	}
+	ms := newMetricsServer(cfg, logger)
+	ms.update("/p4/1/logs/log", []byte("p4_cmd_running{serverid=\"myserverid\"} 1\n"))
+	h := ms.handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("prometheus", "wrong")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("prometheus", "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}